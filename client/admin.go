@@ -0,0 +1,110 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/spf13/cobra"
+)
+
+// adminRequest calls a cluster admin endpoint and returns the response body indented for printing
+func adminRequest(method, path string) (string, error) {
+	token, err := accessToken()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(method, apiUrl("/api/admin/cluster"+path), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Authorization", token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 300 {
+		var responseBody map[string]interface{}
+		json.Unmarshal(body, &responseBody)
+		return "", fmt.Errorf("%s: %v", resp.Status, responseBody["message"])
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, body, "", "  "); err != nil {
+		return string(body), nil
+	}
+	return indented.String(), nil
+}
+
+func adminCommand(use, short, method string, path func(args []string) string, args cobra.PositionalArgs) *cobra.Command {
+	return &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  args,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := AuthGuard(); err != nil {
+				fmt.Println("error authenticating:", err.Error())
+				return
+			}
+			result, err := adminRequest(method, path(args))
+			if err != nil {
+				fmt.Println("admin request failed:", err.Error())
+				return
+			}
+			fmt.Println(result)
+		},
+	}
+}
+
+func fixedPath(path string) func([]string) string {
+	return func([]string) string { return path }
+}
+
+var adminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "inspect and operate the storage cluster",
+}
+
+var rebalanceCmd = &cobra.Command{
+	Use:   "rebalance",
+	Short: "start, pause, resume or inspect rebalancing",
+}
+
+func initAdminCli() {
+	adminCmd.AddCommand(
+		adminCommand("cluster", "cluster overview", "GET", fixedPath(""), cobra.NoArgs),
+		adminCommand("nodes", "list storage nodes", "GET", fixedPath("/nodes"), cobra.NoArgs),
+		adminCommand("indexes", "list storage indexes", "GET", fixedPath("/indexes"), cobra.NoArgs),
+		adminCommand("health", "heartbeat health of storage nodes", "GET", fixedPath("/health"), cobra.NoArgs),
+		adminCommand("capacity", "used capacity per storage node", "GET", fixedPath("/capacity"), cobra.NoArgs),
+		adminCommand("replication", "replication health of versions", "GET", fixedPath("/replication"), cobra.NoArgs),
+		adminCommand("jobs", "repair, rebalance, drain and gc jobs", "GET", fixedPath("/jobs"), cobra.NoArgs),
+		adminCommand("repairs", "list repair jobs", "GET", fixedPath("/repairs"), cobra.NoArgs),
+		adminCommand("repair", "repair under replicated versions", "POST", fixedPath("/repair"), cobra.NoArgs),
+		adminCommand("gc", "delete blobs no version refers to", "POST", fixedPath("/gc"), cobra.NoArgs),
+		adminCommand("migrations", "schema version and pending metadata migrations", "GET", fixedPath("/migrations"), cobra.NoArgs),
+		adminCommand("migrate", "apply pending metadata migrations", "POST", fixedPath("/migrations"), cobra.NoArgs),
+		adminCommand("migrate-dry-run", "list the changes pending metadata migrations would make", "POST", fixedPath("/migrations?dry_run=true"), cobra.NoArgs),
+		adminCommand("migrate-rollback", "undo the last metadata migration run", "POST", fixedPath("/migrations/rollback"), cobra.NoArgs),
+		adminCommand("drain <id>", "drain and decommission a storage node", "POST", func(args []string) string {
+			return "/nodes/" + args[0] + "/drain"
+		}, cobra.ExactArgs(1)),
+		adminCommand("drain-status <id>", "progress of draining a storage node", "GET", func(args []string) string {
+			return "/nodes/" + args[0] + "/drain"
+		}, cobra.ExactArgs(1)),
+	)
+	rebalanceCmd.AddCommand(
+		adminCommand("start", "start rebalancing", "POST", fixedPath("/rebalance"), cobra.NoArgs),
+		adminCommand("pause", "pause rebalancing", "POST", fixedPath("/rebalance/pause"), cobra.NoArgs),
+		adminCommand("resume", "resume rebalancing", "POST", fixedPath("/rebalance/resume"), cobra.NoArgs),
+		adminCommand("status", "rebalancing progress", "GET", fixedPath("/rebalance"), cobra.NoArgs),
+	)
+	adminCmd.AddCommand(rebalanceCmd)
+	rootCmd.AddCommand(adminCmd)
+}
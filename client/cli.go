@@ -3,9 +3,12 @@ package client
 import (
 	"fmt"
 	"log/slog"
+	"net/url"
+	"strings"
 
 	"github.com/jafari-mohammad-reza/dotsync/pkg"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var cfg *pkg.ClientConfig
@@ -42,9 +45,26 @@ var uploadCmd = &cobra.Command{
 			fmt.Println("invalid path")
 			return
 		}
-		if err := UploadFile(filePath); err != nil {
+		fileTags, err := tagsFromFlags(cmd, "file-tag", "file-label")
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		versionTags, err := tagsFromFlags(cmd, "tag", "label")
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		versionId, err := UploadFile(filePath, UploadOptions{
+			Parent:      cmd.Flag("parent").Value.String(),
+			FileTags:    fileTags,
+			VersionTags: versionTags,
+		})
+		if err != nil {
 			fmt.Println("error uploading file", err.Error())
+			return
 		}
+		fmt.Println("uploaded version", versionId)
 	},
 }
 
@@ -71,28 +91,62 @@ var authCmd = &cobra.Command{
 
 var revokeCmd = &cobra.Command{
 	Use:   "revoke",
-	Short: "revoke your token",
+	Short: "revoke your token, or with --all every session of your account",
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := RevokeToken(); err != nil {
+		all, _ := cmd.Flags().GetBool("all")
+		if err := RevokeToken(all); err != nil {
 			fmt.Println("revoke token error", err.Error())
 		}
 	},
 }
 
+// tagsFromFlags reads the key=value pairs and labels given with the flags named tagFlag and labelFlag
+func tagsFromFlags(cmd *cobra.Command, tagFlag, labelFlag string) (pkg.Tags, error) {
+	pairs, _ := cmd.Flags().GetStringArray(tagFlag)
+	labels, _ := cmd.Flags().GetStringArray(labelFlag)
+	return pkg.ParseTags(pairs, labels)
+}
+
+func printTags(indent string, tags pkg.Tags) {
+	if len(tags.Values) > 0 {
+		fmt.Printf("%sTags: %s\n", indent, strings.Join(tags.Pairs(), ", "))
+	}
+	if len(tags.Labels) > 0 {
+		fmt.Printf("%sLabels: %s\n", indent, strings.Join(tags.Labels, ", "))
+	}
+}
+
 func printUploads(uploads []pkg.ListUploadsResult) {
 	for _, upload := range uploads {
 		fmt.Printf("ID: %s\n", upload.ID)
 		fmt.Printf("File: %s\n", upload.FileName)
-		fmt.Printf("Directory: %s\n\n", upload.Directory)
-		fmt.Println("Versions:")
+		fmt.Printf("Directory: %s\n", upload.Directory)
+		printTags("", upload.Tags)
+		fmt.Println("\nVersions:")
 		for _, version := range upload.Versions {
 			fmt.Printf("  - ID: %s\n", version.ID)
+			if version.Parent != "" {
+				fmt.Printf("    Parent: %s\n", version.Parent)
+			}
+			printTags("    ", version.Tags)
 			fmt.Printf("    Created At: %s\n", version.CreatedAt)
 		}
 		fmt.Printf("\nCreated At: %s\n", upload.CreatedAt)
 	}
 }
 
+// ofLimit shows an amount with the limit it counts against, 0 being no limit
+func ofLimit(used, limit int64) string {
+	if limit == 0 {
+		return fmt.Sprintf("%d", used)
+	}
+	return fmt.Sprintf("%d of %d", used, limit)
+}
+
+func printUsage(usage *pkg.UsageResponse) {
+	fmt.Printf("\nUsage: %s bytes, %s files, %s versions\n", ofLimit(usage.Bytes, usage.MaxBytes), ofLimit(usage.Files, usage.MaxFiles), ofLimit(usage.Versions, usage.MaxVersions))
+}
+
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "list your uploaded files",
@@ -101,12 +155,112 @@ var listCmd = &cobra.Command{
 			fmt.Println("error authenticating:", err.Error())
 			return
 		}
-		result, err := ListUploads()
+		filter, err := tagsFromFlags(cmd, "tag", "label")
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		result, err := ListUploads(filter)
 		if err != nil {
 			fmt.Sprintf("error fetching list of uploads %s", err.Error())
 			return
 		}
 		printUploads(result)
+		usage, err := Usage()
+		if err != nil {
+			fmt.Println("error fetching usage", err.Error())
+			return
+		}
+		printUsage(usage)
+	},
+}
+
+var searchCmd = &cobra.Command{
+	Use:   "search",
+	Short: "search versions of your files by name, directory, dates, agent, size and tags",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := AuthGuard(); err != nil {
+			fmt.Println("error authenticating:", err.Error())
+			return
+		}
+		params := url.Values{}
+		cmd.Flags().Visit(func(flag *pflag.Flag) {
+			key := strings.ReplaceAll(flag.Name, "-", "_")
+			if values, err := cmd.Flags().GetStringArray(flag.Name); err == nil {
+				params[key] = values
+				return
+			}
+			params.Set(key, flag.Value.String())
+		})
+		result, err := Search(params)
+		if err != nil {
+			fmt.Println("error searching", err.Error())
+			return
+		}
+		for _, found := range result.Results {
+			fmt.Printf("File: %s%s (%s)\n", found.Directory, found.FileName, found.FileID)
+			fmt.Printf("  Version: %s\n", found.VersionID)
+			fmt.Printf("  Agent: %s\n", found.Agent)
+			fmt.Printf("  Size: %d\n", found.Size)
+			printTags("  ", found.VersionTags)
+			fmt.Printf("  Created At: %s\n", found.CreatedAt)
+		}
+		fmt.Printf("\nshowing %d of %d from %d\n", len(result.Results), result.Total, result.Offset)
+	},
+}
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "list what was done with your account, newest first",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := AuthGuard(); err != nil {
+			fmt.Println("error authenticating:", err.Error())
+			return
+		}
+		params := url.Values{}
+		cmd.Flags().Visit(func(flag *pflag.Flag) {
+			params.Set(strings.ReplaceAll(flag.Name, "-", "_"), flag.Value.String())
+		})
+		entries, err := Audit(params)
+		if err != nil {
+			fmt.Println("error listing audit trail", err.Error())
+			return
+		}
+		for _, entry := range entries {
+			fmt.Printf("%s %s %s from %s (%s)\n", entry.Time, entry.Command, entry.Result, entry.Source, entry.Agent)
+			if entry.FileID != "" {
+				fmt.Printf("  File: %s Version: %s\n", entry.FileID, entry.Version)
+			}
+			if entry.Error != "" {
+				fmt.Printf("  Error: %s\n", entry.Error)
+			}
+		}
+	},
+}
+
+var tagCmd = &cobra.Command{
+	Use:   "tag",
+	Short: "replace the tags and labels of a file or one of its versions",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := AuthGuard(); err != nil {
+			fmt.Println("error authenticating:", err.Error())
+			return
+		}
+		id := cmd.Flag("id").Value.String()
+		if id == "" {
+			fmt.Println("id can not be empty")
+			return
+		}
+		tags, err := tagsFromFlags(cmd, "tag", "label")
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		if err := SetTags(id, cmd.Flag("version").Value.String(), tags); err != nil {
+			fmt.Println("error tagging file", err.Error())
+			return
+		}
+		fmt.Println("tags updated")
 	},
 }
 
@@ -143,13 +297,52 @@ var downloadCmd = &cobra.Command{
 
 func InitCli() error {
 	uploadCmd.PersistentFlags().StringP("path", "p", "", "file to upload")
+	uploadCmd.PersistentFlags().StringP("parent", "", "", "version this upload is based on, refused when it is no longer the latest")
+	uploadCmd.PersistentFlags().StringArray("tag", nil, "key=value tag of the new version, repeatable")
+	uploadCmd.PersistentFlags().StringArray("label", nil, "label of the new version, repeatable")
+	uploadCmd.PersistentFlags().StringArray("file-tag", nil, "key=value tag added to the file, repeatable")
+	uploadCmd.PersistentFlags().StringArray("file-label", nil, "label added to the file, repeatable")
 	rootCmd.AddCommand(uploadCmd)
 	rootCmd.AddCommand(authCmd)
+	revokeCmd.Flags().Bool("all", false, "revoke the tokens of every device signed in to your account")
 	rootCmd.AddCommand(revokeCmd)
+	listCmd.PersistentFlags().StringArray("tag", nil, "only list versions tagged key=value, or with key for any value")
+	listCmd.PersistentFlags().StringArray("label", nil, "only list versions with this label")
 	rootCmd.AddCommand(listCmd)
+	searchCmd.Flags().String("name", "", "file name, a glob when it has *, ? or [ and a substring otherwise")
+	searchCmd.Flags().String("dir", "", "directory, a glob or a substring like name")
+	searchCmd.Flags().String("uploaded-from", "", "first upload of the file on or after this date or RFC3339 time")
+	searchCmd.Flags().String("uploaded-to", "", "first upload of the file before this time or by the end of this date")
+	searchCmd.Flags().String("created-from", "", "version created on or after this date or RFC3339 time")
+	searchCmd.Flags().String("created-to", "", "version created before this time or by the end of this date")
+	searchCmd.Flags().String("agent", "", "agent that uploaded the version")
+	searchCmd.Flags().Int64("min-size", 0, "smallest size in bytes")
+	searchCmd.Flags().Int64("max-size", 0, "largest size in bytes")
+	searchCmd.Flags().StringArray("tag", nil, "key=value tag of the version or its file, or key for any value")
+	searchCmd.Flags().StringArray("label", nil, "label of the version or its file")
+	searchCmd.Flags().String("sort", "created", "created, uploaded, name, dir or size")
+	searchCmd.Flags().String("order", "asc", "asc or desc")
+	searchCmd.Flags().Int("offset", 0, "results to skip")
+	searchCmd.Flags().Int("limit", 50, "results to show")
+	rootCmd.AddCommand(searchCmd)
+	auditCmd.Flags().String("command", "", "only this command, e.g. \"tcp upload\" or \"GET /api/search\"")
+	auditCmd.Flags().String("file-id", "", "only operations on this file")
+	auditCmd.Flags().String("from", "", "operations on or after this date or RFC3339 time")
+	auditCmd.Flags().String("to", "", "operations before this time or by the end of this date")
+	auditCmd.Flags().String("actor", "", "user whose trail to list, admins only")
+	auditCmd.Flags().Int("limit", 100, "entries to show")
+	rootCmd.AddCommand(auditCmd)
+	tagCmd.PersistentFlags().StringP("id", "", "", "file to tag")
+	tagCmd.PersistentFlags().StringP("version", "v", "", "version to tag instead of the file")
+	tagCmd.PersistentFlags().StringArray("tag", nil, "key=value tag, repeatable")
+	tagCmd.PersistentFlags().StringArray("label", nil, "label, repeatable")
+	rootCmd.AddCommand(tagCmd)
 	downloadCmd.PersistentFlags().StringP("id", "", "", "fileId to download")
 	downloadCmd.PersistentFlags().StringP("version", "v", "", "version to download")
 	downloadCmd.PersistentFlags().StringP("output", "o", "", "where to store downloaded file")
 	rootCmd.AddCommand(downloadCmd)
+	initAdminCli()
+	initTrashCli()
+	initPasswordCli()
 	return rootCmd.Execute()
 }
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+)
+
+func requestTickets(req *http.Request, token string) (*pkg.TicketsResponse, error) {
+	req.Header.Add("Authorization", token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var responseBody map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&responseBody)
+		return nil, fmt.Errorf("requesting tickets failed: %v", responseBody["message"])
+	}
+	var tickets pkg.TicketsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tickets); err != nil {
+		return nil, err
+	}
+	return &tickets, nil
+}
+
+// sendToStorage sends packet to a storage and returns its reply
+func sendToStorage(port int, packet *pkg.TransferPacket) (*pkg.TransferPacket, error) {
+	serialized, err := pkg.SerializePacket(packet)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pkg.SendDataOverTcp(port, int64(len(serialized)), serialized)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	response, err := pkg.ReadConnBuffers(conn)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := pkg.DeserializePacket(response)
+	if err != nil {
+		return nil, err
+	}
+	if message, exists := reply.Meta["Error"]; exists {
+		return nil, errors.New(message)
+	}
+	return reply, nil
+}
+
+// uploadDirect asks the server where to store the file and streams it to those storages itself.
+// Storages are shown tickets, never the access token.
+func uploadDirect(token string, packet *pkg.TransferPacket) (string, error) {
+	packet.Token = ""
+	checksum := pkg.Checksum(packet.Compressed)
+	fileTags, err := pkg.DecodeTags(packet.Meta, "FileTags")
+	if err != nil {
+		return "", err
+	}
+	versionTags, err := pkg.DecodeTags(packet.Meta, "VersionTags")
+	if err != nil {
+		return "", err
+	}
+	body, _ := json.Marshal(pkg.UploadTicketBody{
+		FileName:      packet.Meta["FileName"],
+		Directory:     packet.Meta["Dir"],
+		Checksum:      checksum,
+		ParentVersion: packet.Meta["ParentVersion"],
+		FileTags:      fileTags,
+		VersionTags:   versionTags,
+		Size:          packet.OriginalSize,
+	})
+	req, err := http.NewRequest("POST", apiUrl("/api/tickets/upload"), bytes.NewBuffer(body))
+	if err != nil {
+		return "", err
+	}
+	tickets, err := requestTickets(req, token)
+	if err != nil {
+		return "", err
+	}
+	stored := 0
+	packet.Command = "direct-upload"
+	for _, ticket := range tickets.Tickets {
+		packet.Meta["Ticket"] = ticket.Ticket
+		if _, err := sendToStorage(ticket.Port, packet); err != nil {
+			slog.Error("error uploading to storage", "storage", ticket.StorageId, "err", err.Error())
+			continue
+		}
+		stored++
+	}
+	if stored == 0 {
+		return "", errors.New("no storage accepted the upload")
+	}
+	return tickets.VersionId, nil
+}
+
+// downloadDirect reads a version straight from its replicas, trying the next one when a replica fails
+func downloadDirect(token, id, version, output string) error {
+	query := url.Values{"id": {id}}
+	if version != "" {
+		query.Set("version", version)
+	}
+	req, err := http.NewRequest("GET", apiUrl("/api/tickets/download?"+query.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	tickets, err := requestTickets(req, token)
+	if err != nil {
+		return err
+	}
+	for _, ticket := range tickets.Tickets {
+		reply, err := sendToStorage(ticket.Port, &pkg.TransferPacket{
+			Command: "direct-download",
+			Meta:    map[string]string{"Ticket": ticket.Ticket},
+		})
+		if err != nil {
+			slog.Error("error downloading from storage", "storage", ticket.StorageId, "err", err.Error())
+			continue
+		}
+		if tickets.Checksum != "" && pkg.Checksum(reply.Compressed) != tickets.Checksum {
+			slog.Error("corrupt data from storage", "storage", ticket.StorageId)
+			continue
+		}
+		data, err := pkg.DecompressPacket(reply)
+		if err != nil {
+			return err
+		}
+		target := filepath.Base(tickets.FileName)
+		if output != "" {
+			target = output
+		}
+		return os.WriteFile(target, data, 0755)
+	}
+	return errors.New("no replica could serve the download")
+}
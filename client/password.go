@@ -0,0 +1,171 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/spf13/cobra"
+)
+
+// jsonRequest sends body as JSON, with token when it is set, and decodes the response into result
+func jsonRequest(method, path, token string, body, result any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, apiUrl(path), bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Add("Authorization", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var responseBody map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&responseBody)
+		return fmt.Errorf("%s: %v", resp.Status, responseBody["message"])
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// ChangePassword replaces the user's password, other devices have to authenticate again
+func ChangePassword(oldPassword, newPassword string) error {
+	token, err := accessToken()
+	if err != nil {
+		return err
+	}
+	claims, err := pkg.DecodeToken(token)
+	if err != nil {
+		return err
+	}
+	if err := pkg.ValidatePassword(newPassword, claims["email"].(string)); err != nil {
+		return err
+	}
+	var result map[string]interface{}
+	return jsonRequest("PUT", "/api/password", token, pkg.PasswordChangeBody{OldPassword: oldPassword, NewPassword: newPassword}, &result)
+}
+
+// ResetPassword sets a new password with a reset token an admin issued
+func ResetPassword(email, resetToken, newPassword string) error {
+	if err := pkg.ValidatePassword(newPassword, email); err != nil {
+		return err
+	}
+	var result map[string]interface{}
+	return jsonRequest("POST", "/api/password/reset", "", pkg.PasswordResetBody{Email: email, Token: resetToken, NewPassword: newPassword}, &result)
+}
+
+// IssueResetToken asks for a password reset token for a user, admins only
+func IssueResetToken(email string) (*pkg.ResetTokenResponse, error) {
+	token, err := accessToken()
+	if err != nil {
+		return nil, err
+	}
+	var reset pkg.ResetTokenResponse
+	err = jsonRequest("POST", "/api/admin/users/"+url.PathEscape(email)+"/reset-token", token, struct{}{}, &reset)
+	return &reset, err
+}
+
+var registerCmd = &cobra.Command{
+	Use:   "register",
+	Short: "create an account",
+	Run: func(cmd *cobra.Command, args []string) {
+		var email, password string
+		fmt.Print("Enter Email: ")
+		fmt.Scanln(&email)
+
+		fmt.Print("Enter Password: ")
+		fmt.Scanln(&password)
+
+		if email == "" || password == "" {
+			fmt.Println("email and password are required")
+			return
+		}
+		if err := Register(email, password); err != nil {
+			fmt.Println("error registering", err.Error())
+			return
+		}
+		fmt.Println("account created")
+	},
+}
+
+var passwordCmd = &cobra.Command{
+	Use:   "password",
+	Short: "change or reset your password",
+}
+
+var passwordChangeCmd = &cobra.Command{
+	Use:   "change",
+	Short: "change your password, other devices have to authenticate again",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := AuthGuard(); err != nil {
+			fmt.Println("error authenticating:", err.Error())
+			return
+		}
+		var oldPassword, newPassword string
+		fmt.Print("Enter Current Password: ")
+		fmt.Scanln(&oldPassword)
+
+		fmt.Print("Enter New Password: ")
+		fmt.Scanln(&newPassword)
+
+		if err := ChangePassword(oldPassword, newPassword); err != nil {
+			fmt.Println("error changing password", err.Error())
+			return
+		}
+		fmt.Println("password changed")
+	},
+}
+
+var passwordResetCmd = &cobra.Command{
+	Use:   "reset <email> <reset-token>",
+	Short: "set a new password with a reset token from an admin",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var newPassword string
+		fmt.Print("Enter New Password: ")
+		fmt.Scanln(&newPassword)
+
+		if err := ResetPassword(args[0], args[1], newPassword); err != nil {
+			fmt.Println("error resetting password", err.Error())
+			return
+		}
+		fmt.Println("password reset, authenticate with dss auth")
+	},
+}
+
+var resetTokenCmd = &cobra.Command{
+	Use:   "reset-token <email>",
+	Short: "issue a password reset token for a user",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := AuthGuard(); err != nil {
+			fmt.Println("error authenticating:", err.Error())
+			return
+		}
+		reset, err := IssueResetToken(args[0])
+		if err != nil {
+			fmt.Println("admin request failed:", err.Error())
+			return
+		}
+		fmt.Printf("Reset Token: %s\n", reset.Token)
+		fmt.Printf("Expires At: %s\n", reset.ExpiresAt)
+	},
+}
+
+func initPasswordCli() {
+	passwordCmd.AddCommand(passwordChangeCmd, passwordResetCmd)
+	adminCmd.AddCommand(resetTokenCmd)
+	rootCmd.AddCommand(registerCmd)
+	rootCmd.AddCommand(passwordCmd)
+}
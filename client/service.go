@@ -4,27 +4,48 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/jafari-mohammad-reza/dotsync/pkg"
 )
 
-func UploadFile(filePath string) error {
-	token, err := loadTokenFromFile()
+// UploadOptions are the optional parts of an upload
+type UploadOptions struct {
+	// Parent is the version the upload is based on, the upload is refused if another version was uploaded after it
+	Parent      string
+	FileTags    pkg.Tags // added to the tags of the file
+	VersionTags pkg.Tags // tags of the new version only
+}
+
+// UploadFile uploads filePath as a new version and returns its id
+func UploadFile(filePath string, opts UploadOptions) (string, error) {
+	token, err := accessToken()
 	if err != nil {
-		return err
+		return "", err
 	}
 	claims, err := pkg.DecodeToken(token)
 	if err != nil {
-		return err
+		return "", err
 	}
-	packet, err := pkg.CompressFile(filePath, pkg.SenderMeta{Email: claims["email"].(string), Agent: claims["agent"].(string), Application: "client"})
+	packet, err := pkg.CompressFile(filePath, pkg.SenderMeta{Email: claims["email"].(string), Agent: claims["agent"].(string), Application: "client", Token: token})
 	if err != nil {
 		slog.Error("error compressing file", "err", err)
-		return err
+		return "", err
+	}
+	if opts.Parent != "" {
+		packet.Meta["ParentVersion"] = opts.Parent
+	}
+	pkg.EncodeTags(packet.Meta, "FileTags", opts.FileTags)
+	pkg.EncodeTags(packet.Meta, "VersionTags", opts.VersionTags)
+	if cfg.DirectTransfer {
+		return uploadDirect(token, packet)
 	}
 	packet.Command = "upload"
 
@@ -34,19 +55,32 @@ func UploadFile(filePath string) error {
 	}
 	conn, err := pkg.SendDataOverTcp(cfg.ServerTcpPort, int64(len(serialized)), serialized)
 	if err != nil {
-		return err
+		return "", err
 	}
-	return conn.Close()
+	defer conn.Close()
+	response, err := pkg.ReadConnBuffers(conn)
+	if err != nil {
+		return "", err
+	}
+	reply, err := pkg.DeserializePacket(response)
+	if err != nil {
+		return "", err
+	}
+	if message, exists := reply.Meta["Error"]; exists {
+		return "", errors.New(message)
+	}
+	return reply.Meta["VersionID"], nil
 }
 
-func ListUploads() ([]pkg.ListUploadsResult, error) {
+// ListUploads lists the user's files, with a filter only the versions carrying its tags and labels
+func ListUploads(filter pkg.Tags) ([]pkg.ListUploadsResult, error) {
 	var result []pkg.ListUploadsResult
-	token, err := loadTokenFromFile()
+	token, err := accessToken()
 	if err != nil {
 		return nil, err
 	}
-	// req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/api/upload-list", cfg.ServerAddr), nil)
-	req, err := http.NewRequest("GET", "http://localhost:8080/api/upload-list", nil)
+	query := url.Values{"tag": filter.Pairs(), "label": filter.Labels}
+	req, err := http.NewRequest("GET", apiUrl("/api/upload-list?"+query.Encode()), nil)
 	req.Header.Add("Authorization", token)
 	if err != nil {
 		return nil, err
@@ -61,54 +95,197 @@ func ListUploads() ([]pkg.ListUploadsResult, error) {
 	}
 	return result, nil
 }
+
+// Usage tells what the user stores against their quota
+func Usage() (*pkg.UsageResponse, error) {
+	token, err := accessToken()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", apiUrl("/api/usage"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var responseBody map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&responseBody)
+		return nil, fmt.Errorf("fetching usage failed: %v", responseBody["message"])
+	}
+	var usage pkg.UsageResponse
+	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// Search finds versions of the user's files, params are the query parameters of /api/search
+func Search(params url.Values) (*pkg.SearchResponse, error) {
+	token, err := accessToken()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", apiUrl("/api/search?"+params.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var responseBody map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&responseBody)
+		return nil, fmt.Errorf("search failed: %v", responseBody["message"])
+	}
+	var result pkg.SearchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Audit lists the operations of the user newest first, params are the filters of /api/audit
+func Audit(params url.Values) ([]pkg.AuditEntry, error) {
+	token, err := accessToken()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", apiUrl("/api/audit?"+params.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var responseBody map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&responseBody)
+		return nil, fmt.Errorf("listing audit trail failed: %v", responseBody["message"])
+	}
+	var entries []pkg.AuditEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// SetTags replaces the tags and labels of a file, or of one of its versions when version is set
+func SetTags(id, version string, tags pkg.Tags) error {
+	token, err := accessToken()
+	if err != nil {
+		return err
+	}
+	path := "/api/files/" + url.PathEscape(id)
+	if version != "" {
+		path += "/versions/" + url.PathEscape(version)
+	}
+	body, _ := json.Marshal(tags)
+	req, err := http.NewRequest("PUT", apiUrl(path+"/tags"), bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var responseBody map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&responseBody)
+		return fmt.Errorf("setting tags failed: %v", responseBody["message"])
+	}
+	return nil
+}
+
 func DownloadFile(id, version, output string) error {
-	token, err := loadTokenFromFile()
+	token, err := accessToken()
 	if err != nil {
 		return err
 	}
+	if cfg.DirectTransfer {
+		return downloadDirect(token, id, version, output)
+	}
 	claims, err := pkg.DecodeToken(token)
 	if err != nil {
 		return err
 	}
 	meta := map[string]string{"FileID": id}
 	if version != "" {
-		meta["FileVersion"] = version
+		meta["Version"] = version
 	}
 	packet := pkg.TransferPacket{
 		Command:    "download",
 		Meta:       meta,
-		SenderMeta: pkg.SenderMeta{Email: claims["email"].(string), Agent: claims["agent"].(string), Application: "client"},
+		SenderMeta: pkg.SenderMeta{Email: claims["email"].(string), Agent: claims["agent"].(string), Application: "client", Token: token},
 	}
 
 	serialized, err := pkg.SerializePacket(&packet)
 	if err != nil {
 		slog.Error("error serializing file", "err", err)
+		return err
 	}
 	conn, err := pkg.SendDataOverTcp(cfg.ServerTcpPort, int64(len(serialized)), serialized)
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
 	response, err := pkg.ReadConnBuffers(conn)
 	if err != nil {
 		slog.Error("error reading download response", "err", err.Error())
+		return err
 	}
 	tr, err := pkg.DeserializePacket(response)
 	if err != nil {
 		return err
 	}
+	if message, exists := tr.Meta["Error"]; exists {
+		return errors.New(message)
+	}
 	data, err := pkg.DecompressPacket(tr)
 
 	if err != nil {
 		return err
 	}
-	err = os.WriteFile(tr.Meta["FileName"], data, 0755)
+	target := filepath.Base(tr.Meta["FileName"])
+	if output != "" {
+		target = output
+	}
+	err = os.WriteFile(target, data, 0755)
 	if err != nil {
 		slog.Error("error writing file to output", "err", err.Error())
 	}
-	return nil
+	return err
 }
+
+// Auth logs in to an existing account and saves the tokens it was issued
 func Auth(email, password string) error {
+	return authenticate("/api/login", email, password)
+}
+
+// Register creates an account and saves the tokens it was issued
+func Register(email, password string) error {
+	if err := pkg.ValidatePassword(password, email); err != nil {
+		return err
+	}
+	return authenticate("/api/register", email, password)
+}
+
+func authenticate(path, email, password string) error {
 	data, _ := json.Marshal(pkg.InvokeBody{Email: email, Password: password})
-	// resp, err := http.Post(fmt.Sprintf("http://%s/api/invoke-token", cfg.ServerAddr), "application/json", bytes.NewBuffer(data))
-	resp, err := http.Post("http://localhost:8080/api/invoke-token", "application/json", bytes.NewBuffer(data))
+	resp, err := http.Post(apiUrl(path), "application/json", bytes.NewBuffer(data))
 	if err != nil {
 		return err
 	}
@@ -118,13 +295,14 @@ func Auth(email, password string) error {
 	if message, exist := responseBody["message"]; exist {
 		return errors.New(message.(string))
 	}
-	if err := saveTokenToFile(responseBody["token"].(string)); err != nil {
+	refreshToken, _ := responseBody["refresh_token"].(string)
+	if err := saveTokenToFile(responseBody["token"].(string), refreshToken); err != nil {
 		return err
 	}
 	return nil
 }
 func AuthGuard() error {
-	token, err := loadTokenFromFile()
+	token, err := accessToken()
 	if err != nil {
 		return err
 	}
@@ -133,12 +311,18 @@ func AuthGuard() error {
 	}
 	return nil
 }
-func RevokeToken() error {
-	token, err := loadTokenFromFile()
+
+// RevokeToken signs this device out, or with all every device of the account
+func RevokeToken(all bool) error {
+	token, err := accessToken()
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("GET", "http://localhost:8080/api/revoke-token", nil)
+	path := "/api/revoke-token"
+	if all {
+		path += "?all=true"
+	}
+	req, err := http.NewRequest("GET", apiUrl(path), nil)
 
 	if err != nil {
 		return err
@@ -153,32 +337,86 @@ func RevokeToken() error {
 	return nil
 }
 
+func apiUrl(path string) string {
+	return fmt.Sprintf("http://%s%s", strings.TrimSpace(cfg.ServerAddr), path)
+}
+
+// refreshMargin is how long before it expires an access token is refreshed
+const refreshMargin = 30 * time.Second
+
+// accessToken returns the saved access token, trading the refresh token for a new one first
+// when it expired or is about to
+func accessToken() (string, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return "", err
+	}
+	if config.Token == "" {
+		return "", errors.New("token not found")
+	}
+	expiresAt, err := pkg.TokenExpiry(config.Token)
+	if err == nil && time.Until(expiresAt) > refreshMargin {
+		return config.Token, nil
+	}
+	if config.RefreshToken == "" {
+		return "", errors.New("session expired, authenticate again")
+	}
+	return refreshAccessToken(config.RefreshToken)
+}
+
+func refreshAccessToken(refreshToken string) (string, error) {
+	data, _ := json.Marshal(pkg.RefreshBody{RefreshToken: refreshToken})
+	resp, err := http.Post(apiUrl("/api/refresh-token"), "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var responseBody map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&responseBody)
+		return "", fmt.Errorf("session expired, authenticate again: %v", responseBody["message"])
+	}
+	var tokens pkg.InvokeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+	if err := saveTokenToFile(tokens.Token, tokens.RefreshToken); err != nil {
+		return "", err
+	}
+	return tokens.Token, nil
+}
+
 type Config struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
 }
 
-func saveTokenToFile(token string) error {
+func saveTokenToFile(token, refreshToken string) error {
 	configDir, _ := os.UserConfigDir()
 	configPath := filepath.Join(configDir, "dss", "config.json")
 
 	os.MkdirAll(filepath.Dir(configPath), 0700)
 
-	data, _ := json.MarshalIndent(Config{Token: token}, "", "  ")
+	data, _ := json.MarshalIndent(Config{Token: token, RefreshToken: refreshToken}, "", "  ")
 	return os.WriteFile(configPath, data, 0600)
 }
 
-func loadTokenFromFile() (string, error) {
+func loadConfig() (Config, error) {
 	configDir, _ := os.UserConfigDir()
 	configPath := filepath.Join(configDir, "dss", "config.json")
 
+	var config Config
 	data, err := os.ReadFile(configPath)
 	if err != nil {
-		return "", err
+		return config, err
 	}
-
-	var config Config
 	json.Unmarshal(data, &config)
-	return config.Token, nil
+	return config, nil
+}
+
+func loadTokenFromFile() (string, error) {
+	config, err := loadConfig()
+	return config.Token, err
 }
 func removeTokenFromFile() error {
 	configDir, _ := os.UserConfigDir()
@@ -192,7 +430,7 @@ func removeTokenFromFile() error {
 	if err := json.Unmarshal(data, &config); err != nil {
 		return err
 	}
-	config.Token = ""
+	config.Token, config.RefreshToken = "", ""
 	updatedData, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return err
@@ -9,7 +9,8 @@ import (
 
 func TestInvokeToken(t *testing.T) {
 	go server.InitServer()
-	err := Auth("test@gmail.com", "testPassword")
+	assert.Nil(t, Register("test@gmail.com", "Dotsync-Pass-7"))
+	err := Auth("test@gmail.com", "Dotsync-Pass-7")
 	assert.Nil(t, err)
 	token, err := loadTokenFromFile()
 	assert.Nil(t, err)
@@ -21,21 +22,25 @@ func TestInvokeToken(t *testing.T) {
 	assert.Nil(t, err)
 }
 func TestRevokeToken(t *testing.T) {
-	err := Auth("test@gmail.com", "testPassword")
+	err := Auth("test@gmail.com", "Dotsync-Pass-7")
 	assert.Nil(t, err)
-	err = RevokeToken()
+	err = RevokeToken(false)
 	assert.Nil(t, err)
 	token, err := loadTokenFromFile()
 	assert.Equal(t, token, "")
 	assert.Nil(t, err)
 }
 func TestUploadFile(t *testing.T) {
-	Auth("test@gmail.com", "testPassword")
-	err := UploadFile("./service_test.go")
+	Auth("test@gmail.com", "Dotsync-Pass-7")
+	versionId, err := UploadFile("./service_test.go", UploadOptions{})
 	assert.Nil(t, err)
-	err = UploadFile("./service_test_invalid.go")
+	_, err = UploadFile("./service_test.go", UploadOptions{Parent: versionId})
+	assert.Nil(t, err)
+	_, err = UploadFile("./service_test.go", UploadOptions{Parent: versionId})
+	assert.NotNil(t, err, "a stale parent version must conflict")
+	_, err = UploadFile("./service_test_invalid.go", UploadOptions{})
 	assert.NotNil(t, err)
-	RevokeToken()
-	err = UploadFile("./service_test.go")
+	RevokeToken(false)
+	_, err = UploadFile("./service_test.go", UploadOptions{})
 	assert.NotNil(t, err)
 }
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/spf13/cobra"
+)
+
+// trashRequest calls a trash endpoint and decodes the response into result
+func trashRequest(method, path string, result any) error {
+	token, err := accessToken()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, apiUrl(path), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var responseBody map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&responseBody)
+		return fmt.Errorf("%s: %v", resp.Status, responseBody["message"])
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// DeleteFile moves a file with all its versions to the trash
+func DeleteFile(id string) error {
+	var result map[string]interface{}
+	return trashRequest("DELETE", "/api/files/"+url.PathEscape(id), &result)
+}
+
+func ListTrash() ([]pkg.TrashedFile, error) {
+	var trash []pkg.TrashedFile
+	return trash, trashRequest("GET", "/api/trash", &trash)
+}
+
+func RestoreFile(id string) error {
+	var result map[string]interface{}
+	return trashRequest("POST", "/api/trash/"+url.PathEscape(id)+"/restore", &result)
+}
+
+// EmptyTrash deletes every file in the trash for good and returns how many there were
+func EmptyTrash() (int, error) {
+	var result struct {
+		Purged int `json:"purged"`
+	}
+	err := trashRequest("DELETE", "/api/trash", &result)
+	return result.Purged, err
+}
+
+var deleteCmd = &cobra.Command{
+	Use:   "delete <id>",
+	Short: "move a file with all its versions to the trash",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := AuthGuard(); err != nil {
+			fmt.Println("error authenticating:", err.Error())
+			return
+		}
+		if err := DeleteFile(args[0]); err != nil {
+			fmt.Println("error deleting file", err.Error())
+			return
+		}
+		fmt.Println("file moved to the trash, restore it with dss trash restore", args[0])
+	},
+}
+
+var trashCmd = &cobra.Command{
+	Use:   "trash",
+	Short: "list, restore or empty deleted files",
+}
+
+var trashListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list deleted files",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := AuthGuard(); err != nil {
+			fmt.Println("error authenticating:", err.Error())
+			return
+		}
+		trash, err := ListTrash()
+		if err != nil {
+			fmt.Println("error listing trash", err.Error())
+			return
+		}
+		for _, file := range trash {
+			fmt.Printf("ID: %s\n", file.ID)
+			fmt.Printf("File: %s%s\n", file.Directory, file.FileName)
+			fmt.Printf("Versions: %d (%d bytes)\n", file.Versions, file.Size)
+			fmt.Printf("Deleted At: %s\n", file.DeletedAt)
+			if file.PurgeAt != "" {
+				fmt.Printf("Purged At: %s\n", file.PurgeAt)
+			}
+			fmt.Println()
+		}
+	},
+}
+
+var trashRestoreCmd = &cobra.Command{
+	Use:   "restore <id>",
+	Short: "restore a deleted file with all its versions",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := AuthGuard(); err != nil {
+			fmt.Println("error authenticating:", err.Error())
+			return
+		}
+		if err := RestoreFile(args[0]); err != nil {
+			fmt.Println("error restoring file", err.Error())
+			return
+		}
+		fmt.Println("file restored")
+	},
+}
+
+var trashEmptyCmd = &cobra.Command{
+	Use:   "empty",
+	Short: "delete every file in the trash for good",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := AuthGuard(); err != nil {
+			fmt.Println("error authenticating:", err.Error())
+			return
+		}
+		purged, err := EmptyTrash()
+		if err != nil {
+			fmt.Println("error emptying trash", err.Error())
+			return
+		}
+		fmt.Printf("%d files deleted for good\n", purged)
+	},
+}
+
+func initTrashCli() {
+	trashCmd.AddCommand(trashListCmd, trashRestoreCmd, trashEmptyCmd)
+	rootCmd.AddCommand(deleteCmd)
+	rootCmd.AddCommand(trashCmd)
+}
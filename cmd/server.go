@@ -1,10 +1,39 @@
 package main
 
 import (
+	"fmt"
+	"log/slog"
+	"os"
+
 	"github.com/jafari-mohammad-reza/dotsync/server"
 )
 
+const usage = `usage: server                 run the server
+       server export <file>   write all metadata to file
+       server import <file>   load metadata written by export into an empty store`
+
 func main() {
+	if len(os.Args) > 1 {
+		if len(os.Args) != 3 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		var err error
+		switch os.Args[1] {
+		case "export":
+			err = server.ExportMetadata(os.Args[2])
+		case "import":
+			err = server.ImportMetadata(os.Args[2])
+		default:
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		if err != nil {
+			slog.Error("Error "+os.Args[1]+"ing metadata", "err", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 	server.InitServer()
 	// handle storage connections and version controll
 	// there will be many replicas of server to prevent single point of failure
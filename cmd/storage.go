@@ -8,9 +8,8 @@ import (
 
 func main() {
 	// storage first connects to server and gets its own index that will carry during its lifetime
-	// create its own file system and starts to cosume exist data from previous index
-	// subscribe to a channel using its index to give data to next index
-	// iof its the 0 index it will just create its own file system
+	// create its own file system and keeps its membership alive with heartbeats
+	// the leader server rebalances data onto it according to the placement policy
 	if err := storage.InitStorage(); err != nil {
 		slog.Error("Error init storage", "err", err.Error())
 	}
@@ -8,18 +8,64 @@ import (
 )
 
 type ClientConfig struct {
-	ServerAddr    string
-	ServerPort    int
-	ServerTcpPort int
+	ServerAddr     string
+	ServerPort     int
+	ServerTcpPort  int
+	DirectTransfer bool // move file data straight between client and storages
 }
 type ServerConfig struct {
-	HttpPort            int
-	TcpPort             int
-	HealthCheckInterval int
-	HealthCheckTimeout  int
+	HttpPort                int
+	TcpPort                 int
+	MembershipSweepInterval int // seconds between membership sweeps
+	SuspectTimeout          int // seconds without heartbeat before a storage is suspect
+	DeadTimeout             int // seconds without heartbeat before a storage is dead
+	LeaderLeaseTimeout      int // seconds the leader lock is held without renewal
+	ReplicationFactor       int
+	RebalanceBandwidth      int      // KB per second the rebalancer may move, unlimited when 0
+	PlacementSpreadBy       []string // storage labels replicas should not share, most important first
+	PlacementStrict         bool     // refuse placements that cannot satisfy PlacementSpreadBy
+	TicketTTL               int      // seconds a direct transfer ticket stays valid
+	AccessTokenTTL          int      // seconds an access token stays valid
+	RefreshTokenTTL         int      // seconds a refresh token stays valid
+	Admins                  []string
+	RedisAddr               string // host:port of redis, the local default when empty
+	MetadataStore           string // redis, embedded or memory
+	MetadataPath            string // file the embedded metadata store persists to
+	MigrationDryRun         bool   // only log the metadata migrations startup would apply
+	RetentionPolicies       []RetentionPolicy
+	PruneInterval           int // seconds between pruning runs, pruning is off when 0
+	AuditRetention          int // seconds audit entries are kept, forever when 0
+	TrashRetention          int // seconds deleted files stay in the trash before they are purged, forever when 0
+	Quotas                  []Quota
+	SnapshotDir             string // local directory the leader writes metadata snapshots to
+	SnapshotInterval        int    // seconds between metadata snapshots, snapshots are off when 0
+	SnapshotRetention       int    // newest snapshots to keep, all of them when 0
+}
+
+// Quota limits what a user may store, a limit of 0 is no limit. The first quota matching a user applies.
+type Quota struct {
+	User        string // email the quota applies to, every user when empty
+	MaxBytes    int64  // sizes of all versions before compression
+	MaxFiles    int64
+	MaxVersions int64
+}
+
+// RetentionPolicy decides which versions of a file are kept, a version is kept when any rule keeps it.
+// The first policy matching a file applies, and a policy without rules keeps everything.
+type RetentionPolicy struct {
+	User        string // email the policy applies to, every user when empty
+	Pattern     string // glob matched against the file name or its directory joined with it, every file when empty
+	KeepLast    int    // newest versions to keep
+	KeepWithin  int    // seconds, versions younger than this are kept
+	KeepDaily   int    // days to keep the newest version of
+	KeepWeekly  int    // weeks to keep the newest version of
+	KeepMonthly int    // months to keep the newest version of
 }
 type StorageConfig struct {
-	Port int
+	Port              int
+	HeartbeatInterval int               // seconds between heartbeats sent to servers
+	Labels            map[string]string // where the storage lives, e.g. zone, rack, host and disk
+	RedisAddr         string            // host:port of redis, the local default when empty
 }
 
 func InitConfig(name string) (*viper.Viper, error) {
@@ -0,0 +1,62 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Results of audited operations
+const (
+	AuditOK     = "ok"
+	AuditDenied = "denied"
+	AuditFailed = "failed"
+)
+
+// AuditEntry records one operation someone did over the API or the TCP protocol
+type AuditEntry struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"` // email of the user the operation was done as
+	Agent   string    `json:"agent,omitempty"`
+	Source  string    `json:"source"`  // address the operation came from
+	Command string    `json:"command"` // e.g. "GET /api/search" or "tcp upload"
+	FileID  string    `json:"file_id,omitempty"`
+	Version string    `json:"version,omitempty"`
+	Result  string    `json:"result"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// AuditQuery selects entries of one actor, every one of them when the rest is left empty
+type AuditQuery struct {
+	Actor   string
+	Command string
+	FileID  string
+	From    time.Time // inclusive
+	To      time.Time // exclusive
+	Limit   int       // newest entries to return, all of them when 0
+}
+
+// Matches tells whether entry is one of the entries query selects
+func (q AuditQuery) Matches(entry AuditEntry) bool {
+	if entry.Actor != q.Actor {
+		return false
+	}
+	if q.Command != "" && entry.Command != q.Command {
+		return false
+	}
+	if q.FileID != "" && entry.FileID != q.FileID {
+		return false
+	}
+	return (q.From.IsZero() || !entry.Time.Before(q.From)) && (q.To.IsZero() || entry.Time.Before(q.To))
+}
+
+// AuditLog is the append only trail of what users did. Entries are never changed, only the ones
+// older than the retention are dropped.
+type AuditLog interface {
+	// AppendAudit adds entry stamped with the time it is added at
+	AppendAudit(ctx context.Context, entry AuditEntry) error
+	// QueryAudit returns the entries query selects newest first
+	QueryAudit(ctx context.Context, query AuditQuery) ([]AuditEntry, error)
+	// TrimAudit drops the entries from before a time and returns how many it dropped
+	TrimAudit(ctx context.Context, before time.Time) (int64, error)
+}
@@ -15,29 +15,58 @@ type User struct {
 	Password  string  `json:"password"`
 	CreatedAt string  `json:"created_at"`
 	Agents    []Agent `json:"agents"`
-	Files     []File  `json:"files"`
+	// ResetToken is the digest of the password reset token the user was last issued, empty when there is none
+	ResetToken     string `json:"reset_token,omitempty"`
+	ResetExpiresAt string `json:"reset_expires_at,omitempty"`
+	// SchemaVersion is the schema version the record was last written with, see Migrate
+	SchemaVersion int `json:"schema_version"`
 }
 
 type Agent struct {
 	ID          string `json:"id"`
 	Name        string `json:"name"`
 	LastRequest string `json:"last_request"`
+	// Generation is carried by every token the agent is issued, raising it revokes them all
+	Generation int `json:"generation"`
+	// RefreshToken is the digest of the id of the refresh token the agent was last issued, empty when it has none
+	RefreshToken     string `json:"refresh_token,omitempty"`
+	RefreshExpiresAt string `json:"refresh_expires_at,omitempty"`
 }
 
 type File struct {
-	ID         string        `json:"id"`
-	Name       string        `json:"name"`
-	Path       string        `json:"path"`
-	UploadedAt string        `json:"uploaded_at"`
-	UploadedBy string        `json:"uploaded_by"`
-	Versions   []FileVersion `json:"versions"`
+	ID            string            `json:"id"`
+	Owner         string            `json:"owner"`
+	Name          string            `json:"name"`
+	Path          string            `json:"path"`
+	UploadedAt    string            `json:"uploaded_at"`
+	UploadedBy    string            `json:"uploaded_by"`
+	Tags          map[string]string `json:"tags,omitempty"`
+	Labels        []string          `json:"labels,omitempty"`
+	DeletedAt     string            `json:"deleted_at,omitempty"` // when the file was moved to the trash
+	SchemaVersion int               `json:"schema_version"`
 }
 
 type FileVersion struct {
-	ID        string   `json:"id"`
-	Hash      string   `json:"hash"`
-	Storages  []string `json:"storages"`
-	CreatedAt string   `json:"created_at"`
+	ID            string            `json:"id"`
+	FileID        string            `json:"file_id"`
+	Parent        string            `json:"parent"` // version that was the latest when this one was created
+	Hash          string            `json:"hash"`
+	Checksum      string            `json:"checksum"`
+	Storages      []string          `json:"storages"`
+	BlobDir       string            `json:"blob_dir,omitempty"`    // directory holding the blob on storages, derived for older versions
+	Size          int64             `json:"size"`                  // size of the file before compression
+	UploadedBy    string            `json:"uploaded_by,omitempty"` // agent that uploaded the version
+	CreatedAt     string            `json:"created_at"`
+	Tags          map[string]string `json:"tags,omitempty"`
+	Labels        []string          `json:"labels,omitempty"`
+	SchemaVersion int               `json:"schema_version"`
+}
+
+// Usage is what a user stores, counted over the versions of all their files
+type Usage struct {
+	Files    int64 `json:"files" redis:"files"`
+	Versions int64 `json:"versions" redis:"versions"`
+	Bytes    int64 `json:"bytes" redis:"bytes"` // sizes of all versions before compression
 }
 
 func InsertMany(ctx context.Context, redisClient *redis.Client, data map[string]any) error {
@@ -0,0 +1,156 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// DumpFormat names the dump file format, DumpFormatVersion changes whenever its layout does
+const (
+	DumpFormat        = "dotsync-metadata"
+	DumpFormatVersion = 1
+)
+
+// ErrNotEmpty means a dump was to be imported into a store that already holds records
+var ErrNotEmpty = errors.New("store is not empty")
+
+// recordKinds are the kinds of records a dump holds, in the order they are imported
+var recordKinds = []string{KindUser, KindFile, KindVersion}
+
+// Dump is every user, file and version of a store as raw records by kind and id, with the schema
+// version they were written at. Audit entries and migration journals are not part of it.
+type Dump struct {
+	Format        string                               `json:"format"`
+	FormatVersion int                                  `json:"format_version"`
+	SchemaVersion int                                  `json:"schema_version"`
+	CreatedAt     time.Time                            `json:"created_at"`
+	Records       map[string]map[string]map[string]any `json:"records"`
+}
+
+// Count is how many records of a kind the dump holds
+func (d *Dump) Count(kind string) int {
+	return len(d.Records[kind])
+}
+
+// pointInTime is a store that can read every record as of one moment while it keeps taking writes
+type pointInTime interface {
+	readRecords(ctx context.Context) (int, map[string]map[string]map[string]any, error)
+}
+
+// Export reads every record of the store into a dump. Stores that can read their records at one point
+// in time do, so a dump taken while the store is written to never holds a version without its file.
+func Export(ctx context.Context, records Records) (*Dump, error) {
+	read := func(ctx context.Context) (int, map[string]map[string]map[string]any, error) {
+		return readRecords(ctx, records)
+	}
+	if store, ok := records.(pointInTime); ok {
+		read = store.readRecords
+	}
+	schema, dumped, err := read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Dump{
+		Format:        DumpFormat,
+		FormatVersion: DumpFormatVersion,
+		SchemaVersion: schema,
+		CreatedAt:     time.Now().UTC(),
+		Records:       dumped,
+	}, nil
+}
+
+// readRecords reads the schema version and every record one by one
+func readRecords(ctx context.Context, records Records) (int, map[string]map[string]map[string]any, error) {
+	schema, err := records.StoredSchemaVersion(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	dumped := make(map[string]map[string]map[string]any)
+	for _, kind := range recordKinds {
+		ids, err := records.RecordIDs(ctx, kind)
+		if err != nil {
+			return 0, nil, err
+		}
+		dumped[kind] = make(map[string]map[string]any, len(ids))
+		for _, id := range ids {
+			record, err := records.GetRecord(ctx, kind, id)
+			if err != nil {
+				return 0, nil, fmt.Errorf("%s %s: %w", kind, id, err)
+			}
+			if record != nil {
+				dumped[kind][id] = record
+			}
+		}
+	}
+	return schema, dumped, nil
+}
+
+// Validate checks that every file's owner and every version's file are in the dump
+func (d *Dump) Validate() error {
+	for id, file := range d.Records[KindFile] {
+		if owner, _ := file["owner"].(string); d.Records[KindUser][owner] == nil {
+			return fmt.Errorf("file %s: owner %q is not in the dump", id, owner)
+		}
+	}
+	for id, version := range d.Records[KindVersion] {
+		if fileId, _ := version["file_id"].(string); d.Records[KindFile][fileId] == nil {
+			return fmt.Errorf("version %s: file %q is not in the dump", id, fileId)
+		}
+	}
+	return nil
+}
+
+// Import puts every record of a dump into an empty store, users first, then files and then their
+// versions, and leaves the store at the dump's schema version so Migrate can take it from there.
+// It fails with ErrNotEmpty when the store holds any user, file or version, and before writing anything
+// when a file or version of the dump refers to a record it does not hold.
+func Import(ctx context.Context, records Records, dump *Dump) error {
+	if dump.SchemaVersion > SchemaVersion {
+		return fmt.Errorf("dump is at schema version %d, newer than %d", dump.SchemaVersion, SchemaVersion)
+	}
+	if err := dump.Validate(); err != nil {
+		return err
+	}
+	for _, kind := range recordKinds {
+		ids, err := records.RecordIDs(ctx, kind)
+		if err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			return fmt.Errorf("%w: it has %d %s records", ErrNotEmpty, len(ids), kind)
+		}
+	}
+	for _, kind := range recordKinds {
+		for id, record := range dump.Records[kind] {
+			if err := records.PutRecord(ctx, kind, id, record); err != nil {
+				return fmt.Errorf("%s %s: %w", kind, id, err)
+			}
+		}
+	}
+	return records.SetStoredSchemaVersion(ctx, dump.SchemaVersion)
+}
+
+func WriteDump(w io.Writer, dump *Dump) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(dump)
+}
+
+// ReadDump decodes a dump, refusing files of another format or of a format version it does not know
+func ReadDump(r io.Reader) (*Dump, error) {
+	var dump Dump
+	if err := json.NewDecoder(r).Decode(&dump); err != nil {
+		return nil, err
+	}
+	if dump.Format != DumpFormat {
+		return nil, fmt.Errorf("not a metadata dump, format is %q", dump.Format)
+	}
+	if dump.FormatVersion < 1 || dump.FormatVersion > DumpFormatVersion {
+		return nil, fmt.Errorf("unsupported dump format version %d", dump.FormatVersion)
+	}
+	return &dump, nil
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// exerciseExport dumps a store with a trashed file into the empty store to and checks nothing got lost
+func exerciseExport(t *testing.T, from, to MetadataStore) {
+	ctx := context.Background()
+	assert.Nil(t, from.SetStoredSchemaVersion(ctx, SchemaVersion))
+	assert.Nil(t, from.CreateUser(ctx, User{ID: "u1", Email: "dump@gmail.com", Agents: []Agent{{Name: "laptop"}}}))
+	day := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	for i, versionId := range []string{"d1", "d2", "d3"} {
+		_, _, err := from.PutVersion(ctx, File{ID: "df1", Owner: "dump@gmail.com", Name: ".bashrc", Path: "home/"},
+			FileVersion{ID: versionId, Checksum: "sum-" + versionId, Storages: []string{"s1"}, Size: 10, CreatedAt: day.AddDate(0, 0, i).Format(time.RFC3339)}, "", nil)
+		assert.Nil(t, err)
+	}
+	_, _, err := from.PutVersion(ctx, File{ID: "df2", Owner: "dump@gmail.com", Name: "hosts", Path: "etc/"},
+		FileVersion{ID: "d4", Storages: []string{"s2"}, Size: 5, CreatedAt: day.Format(time.RFC3339)}, "", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, from.TrashFile(ctx, "df2", day))
+
+	dump, err := Export(ctx, from)
+	assert.Nil(t, err)
+	assert.Equal(t, SchemaVersion, dump.SchemaVersion)
+	assert.Equal(t, 1, dump.Count(KindUser))
+	assert.Equal(t, 2, dump.Count(KindFile))
+	assert.Equal(t, 4, dump.Count(KindVersion))
+	var buf bytes.Buffer
+	assert.Nil(t, WriteDump(&buf, dump))
+	read, err := ReadDump(&buf)
+	assert.Nil(t, err)
+
+	assert.Nil(t, Import(ctx, to, read))
+	user, err := to.GetUser(ctx, "dump@gmail.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "laptop", user.Agents[0].Name)
+	file, err := to.FindFile(ctx, "dump@gmail.com", "home/", ".bashrc")
+	assert.Nil(t, err)
+	assert.Equal(t, "df1", file.ID)
+	versions, err := to.ListVersions(ctx, "df1")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 3)
+	assert.Equal(t, []string{"d1", "d2", "d3"}, []string{versions[0].ID, versions[1].ID, versions[2].ID}, "histories keep their order")
+	byDigest, err := to.VersionsByDigest(ctx, "sum-d2")
+	assert.Nil(t, err)
+	assert.Len(t, byDigest, 1)
+	byStorage, err := to.VersionsByStorage(ctx, "s2")
+	assert.Nil(t, err)
+	assert.Len(t, byStorage, 1)
+	trashed, err := to.FindFile(ctx, "dump@gmail.com", "etc/", "hosts")
+	assert.Nil(t, err)
+	assert.Nil(t, trashed, "trashed files stay in the trash")
+	assert.Nil(t, to.RestoreFile(ctx, "df2"))
+	usage, err := to.GetUsage(ctx, "dump@gmail.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{Files: 2, Versions: 4, Bytes: 35}, *usage)
+	schema, err := to.StoredSchemaVersion(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, SchemaVersion, schema)
+
+	assert.True(t, errors.Is(Import(ctx, to, read), ErrNotEmpty))
+}
+
+// exerciseExportUnderWrites takes dumps while files are added and checks none of them holds a version
+// of a file it does not hold
+func exerciseExportUnderWrites(t *testing.T, store MetadataStore) {
+	ctx := context.Background()
+	assert.Nil(t, store.CreateUser(ctx, User{ID: "u2", Email: "busy@gmail.com"}))
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var puts atomic.Int64
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			fileId := fmt.Sprintf("busy%d", i)
+			_, _, err := store.PutVersion(ctx, File{ID: fileId, Owner: "busy@gmail.com", Name: fileId, Path: "busy/"}, FileVersion{ID: fileId + "-v1"}, "", nil)
+			assert.Nil(t, err)
+			puts.Add(1)
+		}
+	}()
+	for exports := 0; exports < 20 || puts.Load() < 200; exports++ {
+		dump, err := Export(ctx, store)
+		assert.Nil(t, err)
+		assert.Nil(t, dump.Validate())
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestExport(t *testing.T) {
+	exerciseExport(t, NewMemoryStore(), NewMemoryStore())
+	store, err := OpenFileStore(filepath.Join(t.TempDir(), "metadata.json"))
+	assert.Nil(t, err)
+	exerciseExport(t, NewMemoryStore(), store)
+	reopened, err := OpenFileStore(filepath.Join(filepath.Dir(store.path), "metadata.json"))
+	assert.Nil(t, err)
+	versions, err := reopened.ListVersions(context.Background(), "df1")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 3, "imports are persisted")
+
+	exerciseExportUnderWrites(t, NewMemoryStore())
+	exerciseExportUnderWrites(t, reopened)
+}
+
+func TestRedisExport(t *testing.T) {
+	client := NewRedisClient("")
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		t.Skip("redis is not available:", err.Error())
+	}
+	defer FlushRedis(context.Background(), client)
+	exerciseExport(t, NewMemoryStore(), NewRedisStore(client))
+	exerciseExportUnderWrites(t, NewRedisStore(client))
+}
+
+func TestImportChecksReferences(t *testing.T) {
+	ctx := context.Background()
+	dump := &Dump{Format: DumpFormat, FormatVersion: DumpFormatVersion, SchemaVersion: SchemaVersion, Records: map[string]map[string]map[string]any{
+		KindUser:    {"ref@gmail.com": {"email": "ref@gmail.com"}},
+		KindFile:    {"rf1": {"id": "rf1", "owner": "ref@gmail.com"}},
+		KindVersion: {"rv1": {"id": "rv1", "file_id": "rf2"}},
+	}}
+	store := NewMemoryStore()
+	assert.ErrorContains(t, Import(ctx, store, dump), "rf2")
+	users, err := store.RecordIDs(ctx, KindUser)
+	assert.Nil(t, err)
+	assert.Empty(t, users, "nothing is imported from a dump that does not check out")
+
+	dump.Records[KindVersion]["rv1"]["file_id"] = "rf1"
+	dump.Records[KindFile]["rf1"]["owner"] = "gone@gmail.com"
+	assert.ErrorContains(t, Import(ctx, store, dump), "gone@gmail.com")
+	dump.Records[KindFile]["rf1"]["owner"] = "ref@gmail.com"
+	assert.Nil(t, Import(ctx, store, dump))
+}
+
+func TestImportRefusesNewerSchemas(t *testing.T) {
+	dump := &Dump{Format: DumpFormat, FormatVersion: DumpFormatVersion, SchemaVersion: SchemaVersion + 1}
+	assert.NotNil(t, Import(context.Background(), NewMemoryStore(), dump))
+}
+
+func TestReadDump(t *testing.T) {
+	for _, data := range []string{
+		`{"format": "something-else", "format_version": 1}`,
+		`{"format": "dotsync-metadata", "format_version": 2}`,
+		`not json`,
+	} {
+		_, err := ReadDump(strings.NewReader(data))
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,438 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// compactAfter is how many logged records make the file store write a new snapshot
+const compactAfter = 1000
+
+// Kinds of the log entries that are not records of their own
+const (
+	kindSchema       = "schema"
+	kindMigrationRun = "migration-run"
+)
+
+// FileStore is the embedded store for single node deployments. It serves reads from memory and keeps
+// three files: a snapshot of the records, a log of the records changed since, one per line, and the
+// audit trail, one entry per line. A change costs an append to the log whatever the size of the store,
+// and once the log is long enough its records are folded into a new snapshot, which replaces the old
+// one atomically so a crash never leaves it half written.
+type FileStore struct {
+	*MemoryStore
+	path    string
+	writeMu sync.Mutex // serialises changes with their log entries and compactions
+	log     *os.File
+	seq     int64 // number of the last logged change
+	logged  int   // records logged since the snapshot
+	auditMu sync.Mutex
+	audit   *os.File
+}
+
+// fileSnapshot is what the snapshot file holds, the records as of the change numbered Seq
+type fileSnapshot struct {
+	memoryData
+	Seq int64 `json:"seq"`
+}
+
+// logEntry is a record as a change left it, nil when the change deleted it
+type logEntry struct {
+	Seq    int64          `json:"seq"`
+	Kind   string         `json:"kind"`
+	ID     string         `json:"id"`
+	Record map[string]any `json:"record"`
+}
+
+type logKey struct {
+	kind string
+	id   string
+}
+
+func OpenFileStore(path string) (*FileStore, error) {
+	if path == "" {
+		path = "metadata.json"
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	store := &FileStore{MemoryStore: NewMemoryStore(), path: path}
+	snapshot := fileSnapshot{memoryData: store.data}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return nil, err
+		}
+	}
+	// snapshots written before the audit trail had a file of its own hold the trail themselves
+	legacyAudit := snapshot.Audit
+	store.data, store.seq = snapshot.memoryData, snapshot.Seq
+	store.data.Audit = nil
+	store.reindex()
+	replayed, err := store.replay()
+	if err != nil {
+		return nil, err
+	}
+	if err := store.openAudit(legacyAudit); err != nil {
+		return nil, err
+	}
+	if replayed > 0 || len(legacyAudit) > 0 {
+		store.writeMu.Lock()
+		defer store.writeMu.Unlock()
+		if err := store.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// replay applies the changes logged after the snapshot and opens the log for appending. A last line
+// cut short by a crash is dropped, it belongs to a change that was never acknowledged.
+func (s *FileStore) replay() (int, error) {
+	log, err := os.OpenFile(s.path+".log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, err
+	}
+	s.log = log
+	data, err := os.ReadFile(s.path + ".log")
+	if err != nil {
+		return 0, err
+	}
+	replayed := 0
+	for len(data) > 0 {
+		line, rest, complete := bytes.Cut(data, []byte("\n"))
+		data = rest
+		if !complete {
+			break
+		}
+		var entry logEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return replayed, fmt.Errorf("reading %s.log: %w", s.path, err)
+		}
+		if entry.Seq <= s.seq {
+			continue
+		}
+		if err := s.apply(entry); err != nil {
+			return replayed, fmt.Errorf("replaying %s %s: %w", entry.Kind, entry.ID, err)
+		}
+		s.seq = entry.Seq
+		replayed++
+	}
+	return replayed, nil
+}
+
+func (s *FileStore) apply(entry logEntry) error {
+	ctx := context.Background()
+	switch entry.Kind {
+	case kindSchema:
+		version, _ := entry.Record["version"].(float64)
+		return s.MemoryStore.SetStoredSchemaVersion(ctx, int(version))
+	case kindMigrationRun:
+		if entry.Record == nil {
+			return s.MemoryStore.SaveMigrationRun(ctx, nil)
+		}
+		run, err := fromRecord[MigrationRun](entry.Record)
+		if err != nil {
+			return err
+		}
+		return s.MemoryStore.SaveMigrationRun(ctx, run)
+	}
+	if entry.Record == nil {
+		return s.MemoryStore.DeleteRecord(ctx, entry.Kind, entry.ID)
+	}
+	return s.MemoryStore.PutRecord(ctx, entry.Kind, entry.ID, entry.Record)
+}
+
+// record reads the record key names as it is now, nil when there is none
+func (s *FileStore) record(key logKey) (map[string]any, error) {
+	ctx := context.Background()
+	switch key.kind {
+	case kindSchema:
+		version, err := s.MemoryStore.StoredSchemaVersion(ctx)
+		return map[string]any{"version": version}, err
+	case kindMigrationRun:
+		run, err := s.MemoryStore.LoadMigrationRun(ctx)
+		if err != nil || run == nil {
+			return nil, err
+		}
+		return toRecord(run), nil
+	}
+	return s.MemoryStore.GetRecord(ctx, key.kind, key.id)
+}
+
+// change runs fn, which changes the memory store and names the records it changed, and logs those
+// records as fn left them
+func (s *FileStore) change(fn func() ([]logKey, error)) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	keys, err := fn()
+	if err != nil {
+		return err
+	}
+	var lines []byte
+	for _, key := range keys {
+		record, err := s.record(key)
+		if err != nil {
+			return err
+		}
+		line, err := json.Marshal(logEntry{Seq: s.seq + 1, Kind: key.kind, ID: key.id, Record: record})
+		if err != nil {
+			return err
+		}
+		s.seq++
+		lines = append(append(lines, line...), '\n')
+	}
+	if _, err := s.log.Write(lines); err != nil {
+		return err
+	}
+	s.logged += len(keys)
+	if s.logged >= compactAfter {
+		return s.compact()
+	}
+	return nil
+}
+
+// changeRecord runs fn and logs the one record it changes
+func (s *FileStore) changeRecord(kind, id string, fn func() error) error {
+	return s.change(func() ([]logKey, error) {
+		return []logKey{{kind, id}}, fn()
+	})
+}
+
+// compact writes the records to a new snapshot and empties the log, callers hold writeMu. Should the
+// log outlive the new snapshot, the sequence numbers keep its changes from being applied twice.
+func (s *FileStore) compact() error {
+	s.mu.RLock()
+	snapshot := fileSnapshot{memoryData: s.data, Seq: s.seq}
+	snapshot.Audit = nil
+	data, err := json.Marshal(snapshot)
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err := replaceFile(s.path, data); err != nil {
+		return err
+	}
+	if err := s.log.Truncate(0); err != nil {
+		return err
+	}
+	s.logged = 0
+	return nil
+}
+
+// replaceFile writes data to path through a temporary file, so path holds either the old or the new data
+func replaceFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// openAudit loads the audit trail and opens its file for appending, moving the entries of a legacy
+// snapshot into it when there is no file yet
+func (s *FileStore) openAudit(legacy []AuditEntry) error {
+	path := s.path + ".audit"
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.data.Audit = legacy
+		return s.rewriteAudit()
+	}
+	if err != nil {
+		return err
+	}
+	entries := []AuditEntry{}
+	for len(data) > 0 {
+		line, rest, complete := bytes.Cut(data, []byte("\n"))
+		data = rest
+		if !complete {
+			break
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		entries = append(entries, entry)
+		if seq, _ := strconv.ParseInt(entry.ID, 10, 64); seq > s.data.AuditSeq {
+			s.data.AuditSeq = seq
+		}
+	}
+	s.data.Audit = entries
+	s.audit, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// rewriteAudit replaces the audit file with the entries in memory and reopens it for appending
+func (s *FileStore) rewriteAudit() error {
+	var data []byte
+	s.mu.RLock()
+	for _, entry := range s.data.Audit {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			s.mu.RUnlock()
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	s.mu.RUnlock()
+	path := s.path + ".audit"
+	if err := replaceFile(path, data); err != nil {
+		return err
+	}
+	if s.audit != nil {
+		s.audit.Close()
+	}
+	var err error
+	s.audit, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+func (s *FileStore) CreateUser(ctx context.Context, user User) error {
+	return s.changeRecord(KindUser, user.Email, func() error { return s.MemoryStore.CreateUser(ctx, user) })
+}
+
+func (s *FileStore) AddAgent(ctx context.Context, email string, agent Agent) error {
+	return s.changeRecord(KindUser, email, func() error { return s.MemoryStore.AddAgent(ctx, email, agent) })
+}
+
+func (s *FileStore) RemoveAgent(ctx context.Context, email, name string) error {
+	return s.changeRecord(KindUser, email, func() error { return s.MemoryStore.RemoveAgent(ctx, email, name) })
+}
+
+func (s *FileStore) UpdateAgent(ctx context.Context, email string, agent Agent) error {
+	return s.changeRecord(KindUser, email, func() error { return s.MemoryStore.UpdateAgent(ctx, email, agent) })
+}
+
+func (s *FileStore) SwapAgent(ctx context.Context, email string, current, agent Agent) error {
+	return s.changeRecord(KindUser, email, func() error { return s.MemoryStore.SwapAgent(ctx, email, current, agent) })
+}
+
+func (s *FileStore) SetPassword(ctx context.Context, email, hash string) error {
+	return s.changeRecord(KindUser, email, func() error { return s.MemoryStore.SetPassword(ctx, email, hash) })
+}
+
+func (s *FileStore) ConsumeResetToken(ctx context.Context, email, digest string) error {
+	return s.changeRecord(KindUser, email, func() error { return s.MemoryStore.ConsumeResetToken(ctx, email, digest) })
+}
+
+func (s *FileStore) SetResetToken(ctx context.Context, email, digest, expiresAt string) error {
+	return s.changeRecord(KindUser, email, func() error { return s.MemoryStore.SetResetToken(ctx, email, digest, expiresAt) })
+}
+
+func (s *FileStore) PutVersion(ctx context.Context, file File, version FileVersion, expectParent string, limits *Limits) (*File, *FileVersion, error) {
+	var putFile *File
+	var putVersion *FileVersion
+	err := s.change(func() ([]logKey, error) {
+		var err error
+		putFile, putVersion, err = s.MemoryStore.PutVersion(ctx, file, version, expectParent, limits)
+		if err != nil {
+			return nil, err
+		}
+		return []logKey{{KindFile, putFile.ID}, {KindVersion, putVersion.ID}}, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return putFile, putVersion, nil
+}
+
+func (s *FileStore) AddVersionStorage(ctx context.Context, versionId, storageId string) error {
+	return s.changeRecord(KindVersion, versionId, func() error { return s.MemoryStore.AddVersionStorage(ctx, versionId, storageId) })
+}
+
+func (s *FileStore) SetFileTags(ctx context.Context, fileId string, tags map[string]string, labels []string) error {
+	return s.changeRecord(KindFile, fileId, func() error { return s.MemoryStore.SetFileTags(ctx, fileId, tags, labels) })
+}
+
+func (s *FileStore) SetVersionTags(ctx context.Context, versionId string, tags map[string]string, labels []string) error {
+	return s.changeRecord(KindVersion, versionId, func() error { return s.MemoryStore.SetVersionTags(ctx, versionId, tags, labels) })
+}
+
+func (s *FileStore) DeleteVersion(ctx context.Context, versionId string) error {
+	return s.changeRecord(KindVersion, versionId, func() error { return s.MemoryStore.DeleteVersion(ctx, versionId) })
+}
+
+func (s *FileStore) SetVersionStorages(ctx context.Context, versionId string, storageIds []string) error {
+	return s.changeRecord(KindVersion, versionId, func() error { return s.MemoryStore.SetVersionStorages(ctx, versionId, storageIds) })
+}
+
+func (s *FileStore) ReplaceVersionStorages(ctx context.Context, versionId string, remove, add []string) error {
+	return s.changeRecord(KindVersion, versionId, func() error { return s.MemoryStore.ReplaceVersionStorages(ctx, versionId, remove, add) })
+}
+
+func (s *FileStore) PutRecord(ctx context.Context, kind, id string, record map[string]any) error {
+	return s.changeRecord(kind, id, func() error { return s.MemoryStore.PutRecord(ctx, kind, id, record) })
+}
+
+func (s *FileStore) DeleteRecord(ctx context.Context, kind, id string) error {
+	return s.changeRecord(kind, id, func() error { return s.MemoryStore.DeleteRecord(ctx, kind, id) })
+}
+
+func (s *FileStore) SetStoredSchemaVersion(ctx context.Context, version int) error {
+	return s.changeRecord(kindSchema, "", func() error { return s.MemoryStore.SetStoredSchemaVersion(ctx, version) })
+}
+
+func (s *FileStore) SaveMigrationRun(ctx context.Context, run *MigrationRun) error {
+	return s.changeRecord(kindMigrationRun, "", func() error { return s.MemoryStore.SaveMigrationRun(ctx, run) })
+}
+
+// AppendAudit appends the entry to the audit file, the rest of the store is not written
+func (s *FileStore) AppendAudit(ctx context.Context, entry AuditEntry) error {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	if err := s.MemoryStore.AppendAudit(ctx, entry); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	line, err := json.Marshal(s.data.Audit[len(s.data.Audit)-1])
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	_, err = s.audit.Write(append(line, '\n'))
+	return err
+}
+
+func (s *FileStore) TrimAudit(ctx context.Context, before time.Time) (int64, error) {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	trimmed, err := s.MemoryStore.TrimAudit(ctx, before)
+	if err != nil || trimmed == 0 {
+		return trimmed, err
+	}
+	return trimmed, s.rewriteAudit()
+}
+
+func (s *FileStore) TrashFile(ctx context.Context, fileId string, at time.Time) error {
+	return s.changeRecord(KindFile, fileId, func() error { return s.MemoryStore.TrashFile(ctx, fileId, at) })
+}
+
+func (s *FileStore) RestoreFile(ctx context.Context, fileId string) error {
+	return s.changeRecord(KindFile, fileId, func() error { return s.MemoryStore.RestoreFile(ctx, fileId) })
+}
+
+// DeleteFile logs the file and every version it had as deleted
+func (s *FileStore) DeleteFile(ctx context.Context, fileId string) error {
+	return s.change(func() ([]logKey, error) {
+		versions, err := s.MemoryStore.ListVersions(ctx, fileId)
+		if err != nil {
+			return nil, err
+		}
+		keys := []logKey{}
+		for _, version := range versions {
+			keys = append(keys, logKey{KindVersion, version.ID})
+		}
+		return append(keys, logKey{KindFile, fileId}), s.MemoryStore.DeleteFile(ctx, fileId)
+	})
+}
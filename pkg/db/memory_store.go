@@ -0,0 +1,696 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memoryData is the part of a MemoryStore that is kept, the rest are indexes rebuilt from it
+type memoryData struct {
+	Users        map[string]*User        `json:"users"`
+	Files        map[string]*File        `json:"files"`
+	Versions     map[string]*FileVersion `json:"versions"`
+	UserFiles    map[string][]string     `json:"user_files"`
+	FileVersions map[string][]string     `json:"file_versions"`
+	Schema       int                     `json:"schema"`
+	MigrationRun *MigrationRun           `json:"migration_run,omitempty"`
+	Audit        []AuditEntry            `json:"audit"` // oldest first
+	AuditSeq     int64                   `json:"audit_seq"`
+}
+
+// MemoryStore keeps metadata in process, for tests and throwaway deployments
+type MemoryStore struct {
+	mu              sync.RWMutex
+	data            memoryData
+	paths           map[string]map[string]string // owner to path key to file id
+	digests         map[string]map[string]bool   // checksum to version ids
+	storageVersions map[string]map[string]bool   // storage id to version ids
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{data: memoryData{
+		Users:        make(map[string]*User),
+		Files:        make(map[string]*File),
+		Versions:     make(map[string]*FileVersion),
+		UserFiles:    make(map[string][]string),
+		FileVersions: make(map[string][]string),
+	}}
+	s.reindex()
+	return s
+}
+
+// reindex rebuilds the secondary indexes from the records
+func (s *MemoryStore) reindex() {
+	s.paths = make(map[string]map[string]string)
+	s.digests = make(map[string]map[string]bool)
+	s.storageVersions = make(map[string]map[string]bool)
+	for _, file := range s.data.Files {
+		s.indexFile(file)
+	}
+	for _, version := range s.data.Versions {
+		s.indexVersion(version)
+	}
+}
+
+func (s *MemoryStore) indexFile(file *File) {
+	if file.DeletedAt != "" {
+		return
+	}
+	if s.paths[file.Owner] == nil {
+		s.paths[file.Owner] = make(map[string]string)
+	}
+	s.paths[file.Owner][PathKey(file.Path, file.Name)] = file.ID
+}
+
+// unindexFile frees the path of a file unless another file holds it
+func (s *MemoryStore) unindexFile(file *File) {
+	if s.paths[file.Owner][PathKey(file.Path, file.Name)] == file.ID {
+		delete(s.paths[file.Owner], PathKey(file.Path, file.Name))
+	}
+}
+
+func (s *MemoryStore) indexVersion(version *FileVersion) {
+	if version.Checksum != "" {
+		addMember(s.digests, version.Checksum, version.ID)
+	}
+	for _, storageId := range version.Storages {
+		addMember(s.storageVersions, storageId, version.ID)
+	}
+}
+
+func (s *MemoryStore) unindexVersion(version *FileVersion) {
+	delete(s.digests[version.Checksum], version.ID)
+	for _, storageId := range version.Storages {
+		delete(s.storageVersions[storageId], version.ID)
+	}
+}
+
+func addMember(set map[string]map[string]bool, key, member string) {
+	if set[key] == nil {
+		set[key] = make(map[string]bool)
+	}
+	set[key][member] = true
+}
+
+// clone deep copies a record so callers never share slices with the store
+func clone[T any](record *T) *T {
+	data, _ := json.Marshal(record)
+	var copied T
+	json.Unmarshal(data, &copied)
+	return &copied
+}
+
+func (s *MemoryStore) CreateUser(ctx context.Context, user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.data.Users[user.Email]; exists {
+		return errors.New("email already exists")
+	}
+	user.SchemaVersion = SchemaVersion
+	s.data.Users[user.Email] = clone(&user)
+	return nil
+}
+
+func (s *MemoryStore) GetUser(ctx context.Context, email string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, exists := s.data.Users[email]
+	if !exists {
+		return nil, nil
+	}
+	return clone(user), nil
+}
+
+func (s *MemoryStore) ListUserEmails(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	emails := make([]string, 0, len(s.data.Users))
+	for email := range s.data.Users {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	return emails, nil
+}
+
+// updateUser runs fn on the stored user under the write lock
+func (s *MemoryStore) updateUser(email string, fn func(user *User) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, exists := s.data.Users[email]
+	if !exists {
+		return fmt.Errorf("user %s: %w", email, ErrNotFound)
+	}
+	return fn(user)
+}
+
+func (s *MemoryStore) AddAgent(ctx context.Context, email string, agent Agent) error {
+	return s.updateUser(email, func(user *User) error {
+		user.Agents = append(user.Agents, agent)
+		return nil
+	})
+}
+
+func (s *MemoryStore) RemoveAgent(ctx context.Context, email, name string) error {
+	return s.updateUser(email, func(user *User) error {
+		index := slices.IndexFunc(user.Agents, func(agent Agent) bool { return agent.Name == name })
+		if index == -1 {
+			return fmt.Errorf("agent %s: %w", name, ErrNotFound)
+		}
+		user.Agents = slices.Delete(user.Agents, index, index+1)
+		return nil
+	})
+}
+
+func (s *MemoryStore) UpdateAgent(ctx context.Context, email string, agent Agent) error {
+	return s.updateUser(email, func(user *User) error {
+		index := slices.IndexFunc(user.Agents, func(other Agent) bool { return other.Name == agent.Name })
+		if index == -1 {
+			return fmt.Errorf("agent %s: %w", agent.Name, ErrNotFound)
+		}
+		user.Agents[index] = agent
+		return nil
+	})
+}
+
+func (s *MemoryStore) SwapAgent(ctx context.Context, email string, current, agent Agent) error {
+	return s.updateUser(email, func(user *User) error {
+		index := slices.IndexFunc(user.Agents, func(other Agent) bool { return other.Name == agent.Name })
+		if index == -1 {
+			return fmt.Errorf("agent %s: %w", agent.Name, ErrNotFound)
+		}
+		if err := agentChanged(user.Agents[index], current); err != nil {
+			return err
+		}
+		user.Agents[index] = agent
+		return nil
+	})
+}
+
+func (s *MemoryStore) SetPassword(ctx context.Context, email, hash string) error {
+	return s.updateUser(email, func(user *User) error {
+		user.Password, user.ResetToken, user.ResetExpiresAt = hash, "", ""
+		return nil
+	})
+}
+
+func (s *MemoryStore) ConsumeResetToken(ctx context.Context, email, digest string) error {
+	return s.updateUser(email, func(user *User) error {
+		if err := resetTokenChanged(user, digest); err != nil {
+			return err
+		}
+		user.ResetToken, user.ResetExpiresAt = "", ""
+		return nil
+	})
+}
+
+func (s *MemoryStore) SetResetToken(ctx context.Context, email, digest, expiresAt string) error {
+	return s.updateUser(email, func(user *User) error {
+		user.ResetToken, user.ResetExpiresAt = digest, expiresAt
+		return nil
+	})
+}
+
+func (s *MemoryStore) GetFile(ctx context.Context, id string) (*File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	file, exists := s.data.Files[id]
+	if !exists {
+		return nil, nil
+	}
+	return clone(file), nil
+}
+
+func (s *MemoryStore) FindFile(ctx context.Context, owner, dir, name string) (*File, error) {
+	s.mu.RLock()
+	id, exists := s.paths[owner][PathKey(dir, name)]
+	s.mu.RUnlock()
+	if !exists {
+		return nil, nil
+	}
+	return s.GetFile(ctx, id)
+}
+
+func (s *MemoryStore) ListFiles(ctx context.Context, owner string) ([]File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	files := []File{}
+	for _, id := range s.data.UserFiles[owner] {
+		files = append(files, *clone(s.data.Files[id]))
+	}
+	return files, nil
+}
+
+func (s *MemoryStore) PutVersion(ctx context.Context, file File, version FileVersion, expectParent string, limits *Limits) (*File, *FileVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.data.Users[file.Owner]; !exists {
+		return nil, nil, fmt.Errorf("user %s: %w", file.Owner, ErrNotFound)
+	}
+	tags, labels := file.Tags, file.Labels
+	file.SchemaVersion, version.SchemaVersion = SchemaVersion, SchemaVersion
+	fileId, exists := s.paths[file.Owner][PathKey(file.Path, file.Name)]
+	if exists {
+		file = *s.data.Files[fileId]
+	}
+	parent := ""
+	if history := s.data.FileVersions[file.ID]; len(history) > 0 {
+		parent = history[len(history)-1]
+	}
+	if expectParent != "" && parent != expectParent {
+		return nil, nil, fmt.Errorf("latest version is %q not %q: %w", parent, expectParent, ErrConflict)
+	}
+	if limits != nil {
+		if err := limits.Check(s.usage(file.Owner), !exists, version.Size); err != nil {
+			return nil, nil, err
+		}
+	}
+	if exists {
+		addTags(s.data.Files[fileId], tags, labels)
+		file = *s.data.Files[fileId]
+	} else {
+		s.data.Files[file.ID] = clone(&file)
+		s.data.UserFiles[file.Owner] = append(s.data.UserFiles[file.Owner], file.ID)
+		s.indexFile(&file)
+	}
+	version.FileID, version.Parent = file.ID, parent
+	s.data.Versions[version.ID] = clone(&version)
+	s.data.FileVersions[file.ID] = append(s.data.FileVersions[file.ID], version.ID)
+	s.indexVersion(&version)
+	return clone(&file), clone(&version), nil
+}
+
+func (s *MemoryStore) GetVersion(ctx context.Context, id string) (*FileVersion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	version, exists := s.data.Versions[id]
+	if !exists {
+		return nil, nil
+	}
+	return clone(version), nil
+}
+
+func (s *MemoryStore) ListVersions(ctx context.Context, fileId string) ([]FileVersion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.versions(s.data.FileVersions[fileId]), nil
+}
+
+func (s *MemoryStore) versions(ids []string) []FileVersion {
+	versions := []FileVersion{}
+	for _, id := range ids {
+		versions = append(versions, *clone(s.data.Versions[id]))
+	}
+	return versions
+}
+
+func members(set map[string]bool) []string {
+	ids := make([]string, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *MemoryStore) VersionsByDigest(ctx context.Context, checksum string) ([]FileVersion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.versions(members(s.digests[checksum])), nil
+}
+
+func (s *MemoryStore) VersionsByStorage(ctx context.Context, storageId string) ([]FileVersion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.versions(members(s.storageVersions[storageId])), nil
+}
+
+func (s *MemoryStore) SearchVersions(ctx context.Context, owner string, query VersionQuery) (*SearchResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	matches := []VersionMatch{}
+	for _, fileId := range s.data.UserFiles[owner] {
+		file := s.data.Files[fileId]
+		for _, versionId := range s.data.FileVersions[fileId] {
+			version := s.data.Versions[versionId]
+			if query.Matches(*file, *version) {
+				matches = append(matches, VersionMatch{File: *clone(file), Version: *clone(version)})
+			}
+		}
+	}
+	return query.page(matches), nil
+}
+
+func (s *MemoryStore) DeleteVersion(ctx context.Context, versionId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.data.Versions[versionId]; !exists {
+		return fmt.Errorf("version %s: %w", versionId, ErrNotFound)
+	}
+	s.deleteVersion(versionId)
+	return nil
+}
+
+func (s *MemoryStore) deleteVersion(versionId string) {
+	version := s.data.Versions[versionId]
+	delete(s.data.Versions, versionId)
+	history := s.data.FileVersions[version.FileID]
+	s.data.FileVersions[version.FileID] = slices.DeleteFunc(history, func(id string) bool { return id == versionId })
+	s.unindexVersion(version)
+}
+
+func (s *MemoryStore) TrashFile(ctx context.Context, fileId string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, exists := s.data.Files[fileId]
+	if !exists {
+		return fmt.Errorf("file %s: %w", fileId, ErrNotFound)
+	}
+	s.unindexFile(file)
+	file.DeletedAt = at.Format(time.RFC3339)
+	return nil
+}
+
+func (s *MemoryStore) RestoreFile(ctx context.Context, fileId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, exists := s.data.Files[fileId]
+	if !exists {
+		return fmt.Errorf("file %s: %w", fileId, ErrNotFound)
+	}
+	if other, taken := s.paths[file.Owner][PathKey(file.Path, file.Name)]; taken && other != fileId {
+		return fmt.Errorf("path of file %s is taken by file %s: %w", fileId, other, ErrConflict)
+	}
+	file.DeletedAt = ""
+	s.indexFile(file)
+	return nil
+}
+
+func (s *MemoryStore) DeleteFile(ctx context.Context, fileId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, exists := s.data.Files[fileId]
+	if !exists {
+		return fmt.Errorf("file %s: %w", fileId, ErrNotFound)
+	}
+	for _, versionId := range slices.Clone(s.data.FileVersions[fileId]) {
+		s.deleteVersion(versionId)
+	}
+	delete(s.data.FileVersions, fileId)
+	s.unindexFile(file)
+	s.data.UserFiles[file.Owner] = slices.DeleteFunc(s.data.UserFiles[file.Owner], func(id string) bool { return id == fileId })
+	delete(s.data.Files, fileId)
+	return nil
+}
+
+// GetUsage counts the owner's records, the memory store has no counters to keep
+func (s *MemoryStore) GetUsage(ctx context.Context, owner string) (*Usage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	usage := s.usage(owner)
+	return &usage, nil
+}
+
+func (s *MemoryStore) usage(owner string) Usage {
+	usage := Usage{Files: int64(len(s.data.UserFiles[owner]))}
+	for _, fileId := range s.data.UserFiles[owner] {
+		for _, versionId := range s.data.FileVersions[fileId] {
+			usage.Versions++
+			usage.Bytes += s.data.Versions[versionId].Size
+		}
+	}
+	return usage
+}
+
+func (s *MemoryStore) SetFileTags(ctx context.Context, fileId string, tags map[string]string, labels []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, exists := s.data.Files[fileId]
+	if !exists {
+		return fmt.Errorf("file %s: %w", fileId, ErrNotFound)
+	}
+	file.Tags, file.Labels = maps.Clone(tags), slices.Clone(labels)
+	return nil
+}
+
+func (s *MemoryStore) SetVersionTags(ctx context.Context, versionId string, tags map[string]string, labels []string) error {
+	return s.updateVersion(versionId, func(version *FileVersion) {
+		version.Tags, version.Labels = maps.Clone(tags), slices.Clone(labels)
+	})
+}
+
+// updateVersion runs fn on the stored version under the write lock, keeping the storage index current
+func (s *MemoryStore) updateVersion(versionId string, fn func(version *FileVersion)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	version, exists := s.data.Versions[versionId]
+	if !exists {
+		return fmt.Errorf("version %s: %w", versionId, ErrNotFound)
+	}
+	s.unindexVersion(version)
+	fn(version)
+	s.indexVersion(version)
+	return nil
+}
+
+func (s *MemoryStore) AddVersionStorage(ctx context.Context, versionId, storageId string) error {
+	return s.updateVersion(versionId, func(version *FileVersion) {
+		version.Storages = append(version.Storages, storageId)
+	})
+}
+
+func (s *MemoryStore) SetVersionStorages(ctx context.Context, versionId string, storageIds []string) error {
+	return s.updateVersion(versionId, func(version *FileVersion) {
+		version.Storages = slices.Clone(storageIds)
+	})
+}
+
+func (s *MemoryStore) ReplaceVersionStorages(ctx context.Context, versionId string, remove, add []string) error {
+	return s.updateVersion(versionId, func(version *FileVersion) {
+		version.Storages = replaceStorages(version.Storages, remove, add)
+	})
+}
+
+// toRecord and fromRecord convert between typed records and the raw documents migrations work on
+func toRecord(value any) map[string]any {
+	data, _ := json.Marshal(value)
+	var record map[string]any
+	json.Unmarshal(data, &record)
+	return record
+}
+
+func fromRecord[T any](record map[string]any) (*T, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	var value T
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+func (s *MemoryStore) RecordIDs(ctx context.Context, kind string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	switch kind {
+	case KindUser:
+		return slices.Sorted(maps.Keys(s.data.Users)), nil
+	case KindFile:
+		return slices.Sorted(maps.Keys(s.data.Files)), nil
+	case KindVersion:
+		return slices.Sorted(maps.Keys(s.data.Versions)), nil
+	}
+	return nil, fmt.Errorf("unknown record kind %q", kind)
+}
+
+// GetRecord returns the typed record as a document, the memory store keeps no fields its types do not know
+func (s *MemoryStore) GetRecord(ctx context.Context, kind, id string) (map[string]any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	switch kind {
+	case KindUser:
+		if user, exists := s.data.Users[id]; exists {
+			return toRecord(user), nil
+		}
+	case KindFile:
+		if file, exists := s.data.Files[id]; exists {
+			return toRecord(file), nil
+		}
+	case KindVersion:
+		if version, exists := s.data.Versions[id]; exists {
+			return toRecord(version), nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown record kind %q", kind)
+	}
+	return nil, nil
+}
+
+// readRecords copies every record under the read lock, so no write lands halfway through a dump
+func (s *MemoryStore) readRecords(ctx context.Context) (int, map[string]map[string]map[string]any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	records := map[string]map[string]map[string]any{KindUser: {}, KindFile: {}, KindVersion: {}}
+	for email, user := range s.data.Users {
+		records[KindUser][email] = toRecord(user)
+	}
+	for id, file := range s.data.Files {
+		records[KindFile][id] = toRecord(file)
+	}
+	for id, version := range s.data.Versions {
+		records[KindVersion][id] = toRecord(version)
+	}
+	return s.data.Schema, records, nil
+}
+
+func (s *MemoryStore) PutRecord(ctx context.Context, kind, id string, record map[string]any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch kind {
+	case KindUser:
+		user, err := fromRecord[User](record)
+		if err != nil {
+			return err
+		}
+		s.data.Users[id] = user
+	case KindFile:
+		file, err := fromRecord[File](record)
+		if err != nil {
+			return err
+		}
+		if previous, exists := s.data.Files[id]; exists {
+			s.unindexFile(previous)
+			if previous.Owner != file.Owner {
+				s.data.UserFiles[previous.Owner] = slices.DeleteFunc(s.data.UserFiles[previous.Owner], func(fileId string) bool { return fileId == id })
+			}
+		}
+		s.data.Files[id] = file
+		if !slices.Contains(s.data.UserFiles[file.Owner], id) {
+			s.data.UserFiles[file.Owner] = append(s.data.UserFiles[file.Owner], id)
+		}
+		s.indexFile(file)
+	case KindVersion:
+		version, err := fromRecord[FileVersion](record)
+		if err != nil {
+			return err
+		}
+		// a version rewritten under the same file keeps its place in the history
+		if previous, exists := s.data.Versions[id]; exists && previous.FileID == version.FileID {
+			s.unindexVersion(previous)
+			s.data.Versions[id] = version
+			s.indexVersion(version)
+			return nil
+		} else if exists {
+			s.deleteVersion(id)
+		}
+		history := s.versions(s.data.FileVersions[version.FileID])
+		position := versionPosition(history, *version)
+		s.data.Versions[id] = version
+		s.data.FileVersions[version.FileID] = slices.Insert(s.data.FileVersions[version.FileID], position, id)
+		s.indexVersion(version)
+	default:
+		return fmt.Errorf("unknown record kind %q", kind)
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteRecord(ctx context.Context, kind, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch kind {
+	case KindUser:
+		delete(s.data.Users, id)
+	case KindFile:
+		if file, exists := s.data.Files[id]; exists {
+			s.unindexFile(file)
+			s.data.UserFiles[file.Owner] = slices.DeleteFunc(s.data.UserFiles[file.Owner], func(fileId string) bool { return fileId == id })
+			delete(s.data.Files, id)
+			if len(s.data.FileVersions[id]) == 0 {
+				delete(s.data.FileVersions, id)
+			}
+		}
+	case KindVersion:
+		if _, exists := s.data.Versions[id]; exists {
+			s.deleteVersion(id)
+		}
+	default:
+		return fmt.Errorf("unknown record kind %q", kind)
+	}
+	return nil
+}
+
+func (s *MemoryStore) StoredSchemaVersion(ctx context.Context) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.data.Schema, nil
+}
+
+func (s *MemoryStore) SetStoredSchemaVersion(ctx context.Context, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Schema = version
+	return nil
+}
+
+func (s *MemoryStore) LoadMigrationRun(ctx context.Context) (*MigrationRun, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.data.MigrationRun == nil {
+		return nil, nil
+	}
+	return clone(s.data.MigrationRun), nil
+}
+
+func (s *MemoryStore) SaveMigrationRun(ctx context.Context, run *MigrationRun) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if run == nil {
+		s.data.MigrationRun = nil
+		return nil
+	}
+	s.data.MigrationRun = clone(run)
+	return nil
+}
+
+func (s *MemoryStore) AppendAudit(ctx context.Context, entry AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.AuditSeq++
+	entry.ID = strconv.FormatInt(s.data.AuditSeq, 10)
+	entry.Time = time.Now()
+	s.data.Audit = append(s.data.Audit, entry)
+	return nil
+}
+
+func (s *MemoryStore) QueryAudit(ctx context.Context, query AuditQuery) ([]AuditEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := []AuditEntry{}
+	for i := len(s.data.Audit) - 1; i >= 0; i-- {
+		if query.Limit > 0 && len(entries) == query.Limit {
+			break
+		}
+		if query.Matches(s.data.Audit[i]) {
+			entries = append(entries, s.data.Audit[i])
+		}
+	}
+	return entries, nil
+}
+
+func (s *MemoryStore) TrimAudit(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := slices.DeleteFunc(s.data.Audit, func(entry AuditEntry) bool { return entry.Time.Before(before) })
+	trimmed := len(s.data.Audit) - len(kept)
+	s.data.Audit = kept
+	return int64(trimmed), nil
+}
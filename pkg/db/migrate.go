@@ -0,0 +1,244 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// SchemaVersion is the schema version of the records this code writes, the version of the last migration
+const SchemaVersion = 3
+
+// Record kinds migrations work on
+const (
+	KindUser    = "user"
+	KindFile    = "file"
+	KindVersion = "version"
+)
+
+// Records gives migrations raw access to stored documents, fields the current types do not know
+// included. Putting or deleting a file or a version keeps the store's indexes in step with it.
+type Records interface {
+	RecordIDs(ctx context.Context, kind string) ([]string, error)
+	// GetRecord returns nil without an error when the record does not exist
+	GetRecord(ctx context.Context, kind, id string) (map[string]any, error)
+	PutRecord(ctx context.Context, kind, id string, record map[string]any) error
+	DeleteRecord(ctx context.Context, kind, id string) error
+
+	// StoredSchemaVersion is the version of the last migration the store went through
+	StoredSchemaVersion(ctx context.Context) (int, error)
+	SetStoredSchemaVersion(ctx context.Context, version int) error
+	// LoadMigrationRun returns the journal of the last run that changed the store, nil when there is none
+	LoadMigrationRun(ctx context.Context) (*MigrationRun, error)
+	// SaveMigrationRun keeps the journal of a run, a nil run removes it
+	SaveMigrationRun(ctx context.Context, run *MigrationRun) error
+}
+
+// Migration upgrades records from the previous schema version to Version
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, m *Migrator) error
+}
+
+// RecordChange is a record as it was before and after a migration changed it, nil when it did not exist
+type RecordChange struct {
+	Kind   string         `json:"kind"`
+	ID     string         `json:"id"`
+	Before map[string]any `json:"before"`
+	After  map[string]any `json:"after"`
+}
+
+// MigrationRun is the journal of one migration run, enough to roll it back
+type MigrationRun struct {
+	From       int            `json:"from"`
+	To         int            `json:"to"`
+	DryRun     bool           `json:"dry_run"`
+	Applied    []string       `json:"applied"`
+	Changes    []RecordChange `json:"changes"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+}
+
+// Migrator is what migrations read and change records through. It journals every change, and in
+// a dry run it only journals them while later reads still see them.
+type Migrator struct {
+	records Records
+	run     *MigrationRun
+	pending map[string]map[string]any // changes of a dry run by kind and id, nil for deleted records
+}
+
+func pendingKey(kind, id string) string {
+	return PathKey(kind, id)
+}
+
+func copyRecord(record map[string]any) map[string]any {
+	if record == nil {
+		return nil
+	}
+	data, _ := json.Marshal(record)
+	var copied map[string]any
+	json.Unmarshal(data, &copied)
+	return copied
+}
+
+// IDs lists the records of a kind
+func (m *Migrator) IDs(ctx context.Context, kind string) ([]string, error) {
+	ids, err := m.records.RecordIDs(ctx, kind)
+	if err != nil || !m.run.DryRun {
+		return ids, err
+	}
+	for _, change := range m.run.Changes {
+		if change.Kind != kind {
+			continue
+		}
+		exists := m.pending[pendingKey(kind, change.ID)] != nil
+		listed := slices.Contains(ids, change.ID)
+		if exists && !listed {
+			ids = append(ids, change.ID)
+		} else if !exists && listed {
+			ids = slices.DeleteFunc(ids, func(id string) bool { return id == change.ID })
+		}
+	}
+	return ids, nil
+}
+
+func (m *Migrator) Get(ctx context.Context, kind, id string) (map[string]any, error) {
+	if record, changed := m.pending[pendingKey(kind, id)]; changed {
+		return copyRecord(record), nil
+	}
+	return m.records.GetRecord(ctx, kind, id)
+}
+
+func (m *Migrator) change(ctx context.Context, kind, id string, after map[string]any) error {
+	before, err := m.Get(ctx, kind, id)
+	if err != nil {
+		return err
+	}
+	m.run.Changes = append(m.run.Changes, RecordChange{Kind: kind, ID: id, Before: before, After: copyRecord(after)})
+	if m.run.DryRun {
+		m.pending[pendingKey(kind, id)] = copyRecord(after)
+		return nil
+	}
+	if after == nil {
+		return m.records.DeleteRecord(ctx, kind, id)
+	}
+	return m.records.PutRecord(ctx, kind, id, after)
+}
+
+// Put stores record as the record of a kind with id, files before their versions
+func (m *Migrator) Put(ctx context.Context, kind, id string, record map[string]any) error {
+	return m.change(ctx, kind, id, record)
+}
+
+func (m *Migrator) Delete(ctx context.Context, kind, id string) error {
+	return m.change(ctx, kind, id, nil)
+}
+
+// versionPosition is where version belongs in a history ordered oldest first, after every version not created later
+func versionPosition(history []FileVersion, version FileVersion) int {
+	for i, other := range history {
+		if createdScore(other) > createdScore(version) {
+			return i
+		}
+	}
+	return len(history)
+}
+
+// RecordSchemaVersion is the schema version a record was last written with
+func RecordSchemaVersion(record map[string]any) int {
+	version, _ := record["schema_version"].(float64)
+	return int(version)
+}
+
+// Each passes every record of a kind written before version to fn and stores it stamped with version
+func (m *Migrator) Each(ctx context.Context, kind string, version int, fn func(id string, record map[string]any) error) error {
+	ids, err := m.IDs(ctx, kind)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		record, err := m.Get(ctx, kind, id)
+		if err != nil {
+			return err
+		}
+		if record == nil || RecordSchemaVersion(record) >= version {
+			continue
+		}
+		if err := fn(id, record); err != nil {
+			return fmt.Errorf("%s %s: %w", kind, id, err)
+		}
+		record["schema_version"] = version
+		if err := m.Put(ctx, kind, id, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Migrate runs the migrations newer than the store's schema version in order. Every migration only
+// changes records written before its version, so running it again after an interruption is safe.
+// A run that changed the store replaces the journal of the previous one.
+func Migrate(ctx context.Context, records Records, migrations []Migration, dryRun bool) (*MigrationRun, error) {
+	current, err := records.StoredSchemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	run := &MigrationRun{From: current, To: current, DryRun: dryRun, Applied: []string{}, Changes: []RecordChange{}, StartedAt: time.Now()}
+	m := &Migrator{records: records, run: run, pending: make(map[string]map[string]any)}
+	for _, migration := range migrations {
+		if migration.Version <= current {
+			continue
+		}
+		err := migration.Up(ctx, m)
+		if !dryRun {
+			if saveErr := records.SaveMigrationRun(ctx, run); saveErr != nil {
+				return run, errors.Join(err, saveErr)
+			}
+		}
+		if err != nil {
+			return run, fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Description, err)
+		}
+		run.To = migration.Version
+		run.Applied = append(run.Applied, migration.Description)
+		if !dryRun {
+			if err := records.SetStoredSchemaVersion(ctx, migration.Version); err != nil {
+				return run, err
+			}
+		}
+	}
+	run.FinishedAt = time.Now()
+	if !dryRun && len(run.Applied) > 0 {
+		return run, records.SaveMigrationRun(ctx, run)
+	}
+	return run, nil
+}
+
+// Rollback restores every record the last migration run changed and the schema version it started from
+func Rollback(ctx context.Context, records Records) (*MigrationRun, error) {
+	run, err := records.LoadMigrationRun(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if run == nil {
+		return nil, errors.New("no migration run to roll back")
+	}
+	for i := len(run.Changes) - 1; i >= 0; i-- {
+		change := run.Changes[i]
+		if change.Before == nil {
+			err = records.DeleteRecord(ctx, change.Kind, change.ID)
+		} else {
+			err = records.PutRecord(ctx, change.Kind, change.ID, change.Before)
+		}
+		if err != nil {
+			return run, fmt.Errorf("restoring %s %s: %w", change.Kind, change.ID, err)
+		}
+	}
+	if err := records.SetStoredSchemaVersion(ctx, run.From); err != nil {
+		return run, err
+	}
+	return run, records.SaveMigrationRun(ctx, nil)
+}
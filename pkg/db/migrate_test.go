@@ -0,0 +1,126 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testMigrations = []Migration{
+	{Version: 1, Description: "name agents", Up: func(ctx context.Context, m *Migrator) error {
+		return m.Each(ctx, KindUser, 1, func(id string, record map[string]any) error {
+			record["agents"] = []any{map[string]any{"name": "migrated"}}
+			return nil
+		})
+	}},
+	{Version: 2, Description: "split notes", Up: func(ctx context.Context, m *Migrator) error {
+		if err := m.Put(ctx, KindFile, "split", map[string]any{"id": "split", "owner": "migrate@gmail.com", "name": "split.txt"}); err != nil {
+			return err
+		}
+		for _, version := range []map[string]any{
+			{"id": "late", "file_id": "split", "created_at": "2024-03-02T00:00:00Z"},
+			{"id": "early", "file_id": "split", "created_at": "2024-03-01T00:00:00Z"},
+		} {
+			if err := m.Put(ctx, KindVersion, version["id"].(string), version); err != nil {
+				return err
+			}
+		}
+		return m.Each(ctx, KindFile, 2, func(id string, record map[string]any) error { return nil })
+	}},
+}
+
+func exerciseMigrations(t *testing.T, store MetadataStore) {
+	ctx := context.Background()
+	assert.Nil(t, store.CreateUser(ctx, User{Email: "migrate@gmail.com"}))
+	assert.Nil(t, store.PutRecord(ctx, KindUser, "migrate@gmail.com", map[string]any{"email": "migrate@gmail.com"}))
+
+	run, err := Migrate(ctx, store, testMigrations, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, run.To)
+	assert.Len(t, run.Changes, 5)
+	version, _ := store.StoredSchemaVersion(ctx)
+	assert.Equal(t, 0, version, "a dry run changes nothing")
+	split, _ := store.GetFile(ctx, "split")
+	assert.Nil(t, split)
+	saved, _ := store.LoadMigrationRun(ctx)
+	assert.Nil(t, saved)
+
+	run, err = Migrate(ctx, store, testMigrations, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"name agents", "split notes"}, run.Applied)
+	user, _ := store.GetUser(ctx, "migrate@gmail.com")
+	assert.Equal(t, []Agent{{Name: "migrated"}}, user.Agents)
+	assert.Equal(t, 1, user.SchemaVersion)
+	split, _ = store.FindFile(ctx, "migrate@gmail.com", "", "split.txt")
+	assert.Equal(t, 2, split.SchemaVersion)
+	versions, _ := store.ListVersions(ctx, "split")
+	assert.Equal(t, "early", versions[0].ID, "versions are placed in their history by creation time")
+	again, err := Migrate(ctx, store, testMigrations, false)
+	assert.Nil(t, err)
+	assert.Empty(t, again.Applied)
+
+	_, err = Rollback(ctx, store)
+	assert.Nil(t, err)
+	version, _ = store.StoredSchemaVersion(ctx)
+	assert.Equal(t, 0, version)
+	user, _ = store.GetUser(ctx, "migrate@gmail.com")
+	assert.Empty(t, user.Agents)
+	split, _ = store.GetFile(ctx, "split")
+	assert.Nil(t, split)
+	versions, _ = store.ListVersions(ctx, "split")
+	assert.Empty(t, versions)
+	_, err = Rollback(ctx, store)
+	assert.NotNil(t, err)
+
+	failing := append(testMigrations, Migration{Version: 3, Description: "fail", Up: func(ctx context.Context, m *Migrator) error {
+		return errors.New("broken")
+	}})
+	run, err = Migrate(ctx, store, failing, false)
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, run.To)
+	version, _ = store.StoredSchemaVersion(ctx)
+	assert.Equal(t, 2, version, "migrations before the failing one stay applied")
+}
+
+func TestMigrations(t *testing.T) {
+	exerciseMigrations(t, NewMemoryStore())
+	store, err := OpenFileStore(filepath.Join(t.TempDir(), "metadata.json"))
+	assert.Nil(t, err)
+	exerciseMigrations(t, store)
+}
+
+func TestRedisMigrations(t *testing.T) {
+	client := NewRedisClient("")
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		t.Skip("redis is not available:", err.Error())
+	}
+	defer FlushRedis(context.Background(), client)
+	exerciseMigrations(t, NewRedisStore(client))
+}
+
+func TestRedisUnindexedUsers(t *testing.T) {
+	client := NewRedisClient("")
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		t.Skip("redis is not available:", err.Error())
+	}
+	ctx := context.Background()
+	defer FlushRedis(ctx, client)
+	store := NewRedisStore(client)
+	assert.Nil(t, store.CreateUser(ctx, User{Email: "indexed@gmail.com"}))
+	baseline := map[string]any{"id": "1", "email": "legacy@gmail.com", "agents": []any{}, "files": []any{}}
+	assert.Nil(t, client.JSONSet(ctx, "legacy@gmail.com", "$", baseline).Err())
+	assert.Nil(t, client.JSONSet(ctx, "not-a-user", "$", map[string]any{"email": "legacy@gmail.com"}).Err())
+
+	ids, err := store.RecordIDs(ctx, KindUser)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"indexed@gmail.com", "legacy@gmail.com"}, ids, "users from before the users set are found")
+	_, err = Migrate(ctx, store, testMigrations[:1], false)
+	assert.Nil(t, err)
+	emails, _ := store.ListUserEmails(ctx)
+	assert.ElementsMatch(t, []string{"indexed@gmail.com", "legacy@gmail.com"}, emails, "migrating users indexes them")
+	user, _ := store.GetUser(ctx, "legacy@gmail.com")
+	assert.Equal(t, 1, user.SchemaVersion)
+}
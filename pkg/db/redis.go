@@ -11,10 +11,13 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
-func NewRedisClient() *redis.Client {
-	addr := "localhost:6379"
-	if os.Getenv("MODE") == "test" {
-		addr = "localhost:6380"
+// NewRedisClient connects to addr, or to the local default for the current MODE when addr is empty
+func NewRedisClient(addr string) *redis.Client {
+	if addr == "" {
+		addr = "localhost:6379"
+		if os.Getenv("MODE") == "test" {
+			addr = "localhost:6380"
+		}
 	}
 	return redis.NewClient(&redis.Options{
 		Addr:     addr,
@@ -63,6 +66,9 @@ func Consume(ctx context.Context, client *redis.Client, stream, group, consumer
 			}).Result()
 
 			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
 				if err == redis.Nil {
 					continue
 				}
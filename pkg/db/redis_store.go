@@ -0,0 +1,1123 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	usersKey       = "users"
+	auditActorsKey = "audit-actors"
+	auditBatch     = 100
+)
+
+func fileKey(id string) string             { return "file:" + id }
+func versionKey(id string) string          { return "version:" + id }
+func userFilesKey(owner string) string     { return "user-files:" + owner }
+func userPathsKey(owner string) string     { return "user-paths:" + owner }
+func fileVersionsKey(id string) string     { return "file-versions:" + id }
+func digestKey(checksum string) string     { return "digest-versions:" + checksum }
+func storageVersionsKey(id string) string  { return "storage-versions:" + id }
+func ownerVersionsKey(owner string) string { return "owner-versions:" + owner }
+func ownerSizesKey(owner string) string    { return "owner-sizes:" + owner }
+func auditKey(actor string) string         { return "audit:" + actor }
+func usageKey(owner string) string         { return "usage:" + owner }
+func agentVersionsKey(owner, agent string) string {
+	return "agent-versions:" + PathKey(owner, agent)
+}
+
+// RedisStore keeps users, files and versions as separate RedisJSON documents. Files are indexed
+// by owner in a list and by path in a hash, versions by file in a list and by digest and storage in sets.
+// For searches the versions of an owner are also indexed by creation time and size in sorted sets
+// and by uploading agent in sets. Usage is counted per owner in a hash, and the audit trail of every actor is a stream.
+type RedisStore struct {
+	client *redis.Client
+}
+
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+const txRetries = 10
+
+// transaction runs fn optimistically, watching keys, and retries it when another client changed them first
+func (s *RedisStore) transaction(ctx context.Context, fn func(tx *redis.Tx) error, keys ...string) error {
+	for attempt := 0; attempt < txRetries; attempt++ {
+		err := s.client.Watch(ctx, fn, keys...)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return fmt.Errorf("giving up after %d concurrent changes to %v", txRetries, keys)
+}
+
+// getRecords loads the documents at keys, skipping the ones that do not exist
+func getRecords[T any](ctx context.Context, client redis.Cmdable, keys []string) ([]T, error) {
+	records := []T{}
+	if len(keys) == 0 {
+		return records, nil
+	}
+	results, err := client.JSONMGet(ctx, "$", keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range results {
+		encoded, ok := result.(string)
+		if !ok {
+			continue
+		}
+		var found []T
+		if err := json.Unmarshal([]byte(encoded), &found); err != nil {
+			return nil, err
+		}
+		records = append(records, found...)
+	}
+	return records, nil
+}
+
+func getRecord[T any](ctx context.Context, client redis.Cmdable, key string) (*T, error) {
+	records, err := getRecords[T](ctx, client, []string{key})
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return &records[0], nil
+}
+
+func (s *RedisStore) CreateUser(ctx context.Context, user User) error {
+	user.SchemaVersion = SchemaVersion
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.JSONSetMode(ctx, user.Email, "$", user, "NX")
+		pipe.SAdd(ctx, usersKey, user.Email)
+		return nil
+	})
+	if err == redis.Nil {
+		return errors.New("email already exists")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to insert key %s: %w", user.Email, err)
+	}
+	return nil
+}
+
+func (s *RedisStore) GetUser(ctx context.Context, email string) (*User, error) {
+	return getRecord[User](ctx, s.client, email)
+}
+
+func (s *RedisStore) ListUserEmails(ctx context.Context) ([]string, error) {
+	return s.client.SMembers(ctx, usersKey).Result()
+}
+
+func (s *RedisStore) AddAgent(ctx context.Context, email string, agent Agent) error {
+	newAgent, _ := json.Marshal(agent)
+	return AppendArray(ctx, s.client, email, string(newAgent), "$.agents")
+}
+
+func (s *RedisStore) RemoveAgent(ctx context.Context, email, name string) error {
+	return s.transaction(ctx, func(tx *redis.Tx) error {
+		user, err := getRecord[User](ctx, tx, email)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("user %s: %w", email, ErrNotFound)
+		}
+		index := slices.IndexFunc(user.Agents, func(agent Agent) bool { return agent.Name == name })
+		if index == -1 {
+			return errors.New("invalid agent to remove")
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.JSONArrPop(ctx, email, "$.agents", index)
+			return nil
+		})
+		return err
+	}, email)
+}
+
+func (s *RedisStore) UpdateAgent(ctx context.Context, email string, agent Agent) error {
+	return s.transaction(ctx, func(tx *redis.Tx) error {
+		user, err := getRecord[User](ctx, tx, email)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("user %s: %w", email, ErrNotFound)
+		}
+		index := slices.IndexFunc(user.Agents, func(other Agent) bool { return other.Name == agent.Name })
+		if index == -1 {
+			return fmt.Errorf("agent %s: %w", agent.Name, ErrNotFound)
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.JSONSet(ctx, email, fmt.Sprintf("$.agents[%d]", index), agent)
+			return nil
+		})
+		return err
+	}, email)
+}
+
+func (s *RedisStore) SwapAgent(ctx context.Context, email string, current, agent Agent) error {
+	return s.transaction(ctx, func(tx *redis.Tx) error {
+		user, err := getRecord[User](ctx, tx, email)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("user %s: %w", email, ErrNotFound)
+		}
+		index := slices.IndexFunc(user.Agents, func(other Agent) bool { return other.Name == agent.Name })
+		if index == -1 {
+			return fmt.Errorf("agent %s: %w", agent.Name, ErrNotFound)
+		}
+		if err := agentChanged(user.Agents[index], current); err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.JSONSet(ctx, email, fmt.Sprintf("$.agents[%d]", index), agent)
+			return nil
+		})
+		return err
+	}, email)
+}
+
+// setUserFields sets top level fields of a user's document, failing with ErrNotFound when there is no user
+func (s *RedisStore) setUserFields(ctx context.Context, email string, fields map[string]string) error {
+	return s.transaction(ctx, func(tx *redis.Tx) error {
+		exists, err := tx.Exists(ctx, email).Result()
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			return fmt.Errorf("user %s: %w", email, ErrNotFound)
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for field, value := range fields {
+				encoded, _ := json.Marshal(value)
+				pipe.JSONSet(ctx, email, "$."+field, string(encoded))
+			}
+			return nil
+		})
+		return err
+	}, email)
+}
+
+func (s *RedisStore) SetPassword(ctx context.Context, email, hash string) error {
+	return s.setUserFields(ctx, email, map[string]string{"password": hash, "reset_token": "", "reset_expires_at": ""})
+}
+
+func (s *RedisStore) SetResetToken(ctx context.Context, email, digest, expiresAt string) error {
+	return s.setUserFields(ctx, email, map[string]string{"reset_token": digest, "reset_expires_at": expiresAt})
+}
+
+func (s *RedisStore) ConsumeResetToken(ctx context.Context, email, digest string) error {
+	return s.transaction(ctx, func(tx *redis.Tx) error {
+		user, err := getRecord[User](ctx, tx, email)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("user %s: %w", email, ErrNotFound)
+		}
+		if err := resetTokenChanged(user, digest); err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.JSONSet(ctx, email, "$.reset_token", `""`)
+			pipe.JSONSet(ctx, email, "$.reset_expires_at", `""`)
+			return nil
+		})
+		return err
+	}, email)
+}
+
+func (s *RedisStore) GetFile(ctx context.Context, id string) (*File, error) {
+	return getRecord[File](ctx, s.client, fileKey(id))
+}
+
+func (s *RedisStore) FindFile(ctx context.Context, owner, dir, name string) (*File, error) {
+	id, err := s.client.HGet(ctx, userPathsKey(owner), PathKey(dir, name)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.GetFile(ctx, id)
+}
+
+func (s *RedisStore) ListFiles(ctx context.Context, owner string) ([]File, error) {
+	ids, err := s.client.LRange(ctx, userFilesKey(owner), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return getRecords[File](ctx, s.client, mapKeys(ids, fileKey))
+}
+
+// PutVersion watches the owner's path index, the file and its version list, so two uploads of the same
+// path can neither create two files nor both claim the same parent. With limits it watches the owner's
+// usage too, so uploads racing each other cannot together go over them.
+func (s *RedisStore) PutVersion(ctx context.Context, file File, version FileVersion, expectParent string, limits *Limits) (*File, *FileVersion, error) {
+	pathsKey, key := userPathsKey(file.Owner), PathKey(file.Path, file.Name)
+	file.SchemaVersion, version.SchemaVersion = SchemaVersion, SchemaVersion
+	var putFile File
+	var putVersion FileVersion
+	err := s.transaction(ctx, func(tx *redis.Tx) error {
+		putFile, putVersion = file, version
+		fileId, err := tx.HGet(ctx, pathsKey, key).Result()
+		created := err == redis.Nil
+		if err != nil && !created {
+			return err
+		}
+		if created {
+			exists, err := tx.Exists(ctx, file.Owner).Result()
+			if err != nil {
+				return err
+			}
+			if exists == 0 {
+				return fmt.Errorf("user %s: %w", file.Owner, ErrNotFound)
+			}
+		} else {
+			if err := tx.Watch(ctx, fileKey(fileId)).Err(); err != nil {
+				return err
+			}
+			existing, err := getRecord[File](ctx, tx, fileKey(fileId))
+			if err != nil {
+				return err
+			}
+			if existing == nil {
+				return fmt.Errorf("file %s: %w", fileId, ErrNotFound)
+			}
+			putFile = *existing
+			addTags(&putFile, file.Tags, file.Labels)
+		}
+		if err := tx.Watch(ctx, fileVersionsKey(putFile.ID)).Err(); err != nil {
+			return err
+		}
+		parent, err := tx.LIndex(ctx, fileVersionsKey(putFile.ID), -1).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if expectParent != "" && parent != expectParent {
+			return fmt.Errorf("latest version is %q not %q: %w", parent, expectParent, ErrConflict)
+		}
+		if limits != nil {
+			if err := tx.Watch(ctx, usageKey(file.Owner)).Err(); err != nil {
+				return err
+			}
+			usage, _, err := readUsage(ctx, tx, file.Owner)
+			if err != nil {
+				return err
+			}
+			if err := limits.Check(*usage, created, putVersion.Size); err != nil {
+				return err
+			}
+		}
+		putVersion.FileID, putVersion.Parent = putFile.ID, parent
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if created {
+				pipe.HSet(ctx, pathsKey, key, putFile.ID)
+				pipe.JSONSet(ctx, fileKey(putFile.ID), "$", putFile)
+				pipe.RPush(ctx, userFilesKey(putFile.Owner), putFile.ID)
+				pipe.HIncrBy(ctx, usageKey(putFile.Owner), "files", 1)
+			}
+			pipe.JSONSet(ctx, versionKey(putVersion.ID), "$", putVersion)
+			pipe.RPush(ctx, fileVersionsKey(putFile.ID), putVersion.ID)
+			if putVersion.Checksum != "" {
+				pipe.SAdd(ctx, digestKey(putVersion.Checksum), putVersion.ID)
+			}
+			for _, storageId := range putVersion.Storages {
+				pipe.SAdd(ctx, storageVersionsKey(storageId), putVersion.ID)
+			}
+			indexOwnerVersion(ctx, pipe, putFile.Owner, putVersion)
+			return nil
+		})
+		return err
+	}, pathsKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &putFile, &putVersion, nil
+}
+
+// unindexFile frees the path of a file unless another file holds it
+func unindexFile(ctx context.Context, tx *redis.Tx, pipe redis.Pipeliner, file *File) error {
+	pathsKey, key := userPathsKey(file.Owner), PathKey(file.Path, file.Name)
+	holder, err := tx.HGet(ctx, pathsKey, key).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if holder == file.ID {
+		pipe.HDel(ctx, pathsKey, key)
+	}
+	return nil
+}
+
+// TrashFile watches the file and the owner's path index, so an upload to the path either comes
+// before the file leaves it or creates a new file
+func (s *RedisStore) TrashFile(ctx context.Context, fileId string, at time.Time) error {
+	key := fileKey(fileId)
+	return s.transaction(ctx, func(tx *redis.Tx) error {
+		file, err := getRecord[File](ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if file == nil {
+			return fmt.Errorf("file %s: %w", fileId, ErrNotFound)
+		}
+		if err := tx.Watch(ctx, userPathsKey(file.Owner)).Err(); err != nil {
+			return err
+		}
+		deletedAt, _ := json.Marshal(at.Format(time.RFC3339))
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.JSONSet(ctx, key, "$.deleted_at", string(deletedAt))
+			return unindexFile(ctx, tx, pipe, file)
+		})
+		return err
+	}, key)
+}
+
+func (s *RedisStore) RestoreFile(ctx context.Context, fileId string) error {
+	key := fileKey(fileId)
+	return s.transaction(ctx, func(tx *redis.Tx) error {
+		file, err := getRecord[File](ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if file == nil {
+			return fmt.Errorf("file %s: %w", fileId, ErrNotFound)
+		}
+		pathsKey, pathKey := userPathsKey(file.Owner), PathKey(file.Path, file.Name)
+		if err := tx.Watch(ctx, pathsKey).Err(); err != nil {
+			return err
+		}
+		holder, err := tx.HGet(ctx, pathsKey, pathKey).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if holder != "" && holder != fileId {
+			return fmt.Errorf("path of file %s is taken by file %s: %w", fileId, holder, ErrConflict)
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.JSONDel(ctx, key, "$.deleted_at")
+			pipe.HSet(ctx, pathsKey, pathKey, fileId)
+			return nil
+		})
+		return err
+	}, key)
+}
+
+func (s *RedisStore) DeleteFile(ctx context.Context, fileId string) error {
+	key, historyKey := fileKey(fileId), fileVersionsKey(fileId)
+	return s.transaction(ctx, func(tx *redis.Tx) error {
+		file, err := getRecord[File](ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if file == nil {
+			return fmt.Errorf("file %s: %w", fileId, ErrNotFound)
+		}
+		if err := tx.Watch(ctx, userPathsKey(file.Owner)).Err(); err != nil {
+			return err
+		}
+		ids, err := tx.LRange(ctx, historyKey, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			if err := tx.Watch(ctx, mapKeys(ids, versionKey)...).Err(); err != nil {
+				return err
+			}
+		}
+		versions, err := getRecords[FileVersion](ctx, tx, mapKeys(ids, versionKey))
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, version := range versions {
+				pipe.Del(ctx, versionKey(version.ID))
+				unindexVersion(ctx, pipe, file, version)
+			}
+			pipe.Del(ctx, historyKey, key)
+			pipe.LRem(ctx, userFilesKey(file.Owner), 0, fileId)
+			pipe.HIncrBy(ctx, usageKey(file.Owner), "files", -1)
+			return unindexFile(ctx, tx, pipe, file)
+		})
+		return err
+	}, key, historyKey)
+}
+
+func (s *RedisStore) GetVersion(ctx context.Context, id string) (*FileVersion, error) {
+	return getRecord[FileVersion](ctx, s.client, versionKey(id))
+}
+
+func (s *RedisStore) ListVersions(ctx context.Context, fileId string) ([]FileVersion, error) {
+	ids, err := s.client.LRange(ctx, fileVersionsKey(fileId), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return getRecords[FileVersion](ctx, s.client, mapKeys(ids, versionKey))
+}
+
+func (s *RedisStore) versionsInSet(ctx context.Context, key string) ([]FileVersion, error) {
+	ids, err := s.client.SMembers(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(ids)
+	return getRecords[FileVersion](ctx, s.client, mapKeys(ids, versionKey))
+}
+
+func (s *RedisStore) VersionsByDigest(ctx context.Context, checksum string) ([]FileVersion, error) {
+	return s.versionsInSet(ctx, digestKey(checksum))
+}
+
+func (s *RedisStore) VersionsByStorage(ctx context.Context, storageId string) ([]FileVersion, error) {
+	return s.versionsInSet(ctx, storageVersionsKey(storageId))
+}
+
+func (s *RedisStore) AddVersionStorage(ctx context.Context, versionId, storageId string) error {
+	return s.updateVersion(ctx, versionId, func(version *FileVersion) {
+		version.Storages = append(version.Storages, storageId)
+	})
+}
+
+func (s *RedisStore) SetVersionStorages(ctx context.Context, versionId string, storageIds []string) error {
+	return s.updateVersion(ctx, versionId, func(version *FileVersion) {
+		version.Storages = slices.Clone(storageIds)
+	})
+}
+
+func (s *RedisStore) ReplaceVersionStorages(ctx context.Context, versionId string, remove, add []string) error {
+	return s.updateVersion(ctx, versionId, func(version *FileVersion) {
+		version.Storages = replaceStorages(version.Storages, remove, add)
+	})
+}
+
+func (s *RedisStore) SetFileTags(ctx context.Context, fileId string, tags map[string]string, labels []string) error {
+	return s.setTags(ctx, fileKey(fileId), tags, labels)
+}
+
+func (s *RedisStore) SetVersionTags(ctx context.Context, versionId string, tags map[string]string, labels []string) error {
+	return s.setTags(ctx, versionKey(versionId), tags, labels)
+}
+
+// setTags replaces the tags and labels of the record at key, failing when it does not exist
+func (s *RedisStore) setTags(ctx context.Context, key string, tags map[string]string, labels []string) error {
+	encodedTags, _ := json.Marshal(tags)
+	encodedLabels, _ := json.Marshal(labels)
+	return s.transaction(ctx, func(tx *redis.Tx) error {
+		exists, err := tx.Exists(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			return fmt.Errorf("%s: %w", key, ErrNotFound)
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.JSONSet(ctx, key, "$.tags", string(encodedTags))
+			pipe.JSONSet(ctx, key, "$.labels", string(encodedLabels))
+			return nil
+		})
+		return err
+	}, key)
+}
+
+func (s *RedisStore) DeleteVersion(ctx context.Context, versionId string) error {
+	key := versionKey(versionId)
+	return s.transaction(ctx, func(tx *redis.Tx) error {
+		version, err := getRecord[FileVersion](ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if version == nil {
+			return fmt.Errorf("version %s: %w", versionId, ErrNotFound)
+		}
+		file, err := getRecord[File](ctx, tx, fileKey(version.FileID))
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.LRem(ctx, fileVersionsKey(version.FileID), 0, versionId)
+			unindexVersion(ctx, pipe, file, *version)
+			return nil
+		})
+		return err
+	}, key)
+}
+
+// GetUsage reads the owner's counters. Owners whose counters predate them are counted from their
+// records once, an upload meanwhile changes the counters and makes the count start over.
+func (s *RedisStore) GetUsage(ctx context.Context, owner string) (*Usage, error) {
+	key := usageKey(owner)
+	var usage *Usage
+	err := s.transaction(ctx, func(tx *redis.Tx) error {
+		var counted bool
+		var err error
+		if usage, counted, err = readUsage(ctx, tx, owner); err != nil || counted {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, "files", usage.Files, "versions", usage.Versions, "bytes", usage.Bytes, "counted", 1)
+			return nil
+		})
+		return err
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// readUsage reads the owner's counters, or counts the owner's records when the counters predate
+// them. counted tells whether the counters were there.
+func readUsage(ctx context.Context, tx *redis.Tx, owner string) (*Usage, bool, error) {
+	usage := &Usage{}
+	counters := tx.HGetAll(ctx, usageKey(owner))
+	if counters.Err() != nil {
+		return nil, false, counters.Err()
+	}
+	if counters.Val()["counted"] != "" {
+		return usage, true, counters.Scan(usage)
+	}
+	fileIds, err := tx.LRange(ctx, userFilesKey(owner), 0, -1).Result()
+	if err != nil {
+		return nil, false, err
+	}
+	usage.Files = int64(len(fileIds))
+	for _, fileId := range fileIds {
+		versionIds, err := tx.LRange(ctx, fileVersionsKey(fileId), 0, -1).Result()
+		if err != nil {
+			return nil, false, err
+		}
+		versions, err := getRecords[FileVersion](ctx, tx, mapKeys(versionIds, versionKey))
+		if err != nil {
+			return nil, false, err
+		}
+		for _, version := range versions {
+			usage.Versions++
+			usage.Bytes += version.Size
+		}
+	}
+	return usage, false, nil
+}
+
+// updateVersion changes the storages of a version with fn and moves it between the storage indexes accordingly
+func (s *RedisStore) updateVersion(ctx context.Context, versionId string, fn func(version *FileVersion)) error {
+	key := versionKey(versionId)
+	return s.transaction(ctx, func(tx *redis.Tx) error {
+		version, err := getRecord[FileVersion](ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if version == nil {
+			return fmt.Errorf("version %s: %w", versionId, ErrNotFound)
+		}
+		previous := version.Storages
+		fn(version)
+		ids, _ := json.Marshal(version.Storages)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.JSONSet(ctx, key, "$.storages", string(ids))
+			for _, storageId := range previous {
+				pipe.SRem(ctx, storageVersionsKey(storageId), versionId)
+			}
+			for _, storageId := range version.Storages {
+				pipe.SAdd(ctx, storageVersionsKey(storageId), versionId)
+			}
+			return nil
+		})
+		return err
+	}, key)
+}
+
+// unindexVersion removes a version from the digest, storage and search indexes, file is nil when it is gone
+func unindexVersion(ctx context.Context, pipe redis.Pipeliner, file *File, version FileVersion) {
+	if version.Checksum != "" {
+		pipe.SRem(ctx, digestKey(version.Checksum), version.ID)
+	}
+	for _, storageId := range version.Storages {
+		pipe.SRem(ctx, storageVersionsKey(storageId), version.ID)
+	}
+	if file != nil {
+		pipe.ZRem(ctx, ownerVersionsKey(file.Owner), version.ID)
+		pipe.ZRem(ctx, ownerSizesKey(file.Owner), version.ID)
+		pipe.SRem(ctx, agentVersionsKey(file.Owner, version.UploadedBy), version.ID)
+		pipe.HIncrBy(ctx, usageKey(file.Owner), "versions", -1)
+		pipe.HIncrBy(ctx, usageKey(file.Owner), "bytes", -version.Size)
+	}
+}
+
+// indexOwnerVersion adds a version to the search indexes and the usage of its owner
+func indexOwnerVersion(ctx context.Context, pipe redis.Pipeliner, owner string, version FileVersion) {
+	pipe.ZAdd(ctx, ownerVersionsKey(owner), redis.Z{Score: createdScore(version), Member: version.ID})
+	pipe.ZAdd(ctx, ownerSizesKey(owner), redis.Z{Score: float64(version.Size), Member: version.ID})
+	pipe.HIncrBy(ctx, usageKey(owner), "versions", 1)
+	pipe.HIncrBy(ctx, usageKey(owner), "bytes", version.Size)
+	if version.UploadedBy != "" {
+		pipe.SAdd(ctx, agentVersionsKey(owner, version.UploadedBy), version.ID)
+	}
+}
+
+// SearchVersions narrows the candidates with the owner's indexes and checks the rest of the query on the records
+func (s *RedisStore) SearchVersions(ctx context.Context, owner string, query VersionQuery) (*SearchResult, error) {
+	created := &redis.ZRangeBy{Min: "-inf", Max: "+inf"}
+	if !query.CreatedFrom.IsZero() {
+		created.Min = strconv.FormatInt(query.CreatedFrom.Unix(), 10)
+	}
+	if !query.CreatedTo.IsZero() {
+		created.Max = "(" + strconv.FormatInt(query.CreatedTo.Unix(), 10)
+	}
+	ids, err := s.client.ZRangeByScore(ctx, ownerVersionsKey(owner), created).Result()
+	if err != nil {
+		return nil, err
+	}
+	if query.MinSize > 0 || query.MaxSize > 0 {
+		sizes := &redis.ZRangeBy{Min: strconv.FormatInt(query.MinSize, 10), Max: "+inf"}
+		if query.MaxSize > 0 {
+			sizes.Max = strconv.FormatInt(query.MaxSize, 10)
+		}
+		sized, err := s.client.ZRangeByScore(ctx, ownerSizesKey(owner), sizes).Result()
+		if err != nil {
+			return nil, err
+		}
+		ids = intersect(ids, sized)
+	}
+	if query.Agent != "" {
+		uploaded, err := s.client.SMembers(ctx, agentVersionsKey(owner, query.Agent)).Result()
+		if err != nil {
+			return nil, err
+		}
+		ids = intersect(ids, uploaded)
+	}
+	versions, err := getRecords[FileVersion](ctx, s.client, mapKeys(ids, versionKey))
+	if err != nil {
+		return nil, err
+	}
+	fileIds := []string{}
+	for _, version := range versions {
+		if !slices.Contains(fileIds, version.FileID) {
+			fileIds = append(fileIds, version.FileID)
+		}
+	}
+	files, err := getRecords[File](ctx, s.client, mapKeys(fileIds, fileKey))
+	if err != nil {
+		return nil, err
+	}
+	filesById := make(map[string]File, len(files))
+	for _, file := range files {
+		filesById[file.ID] = file
+	}
+	matches := []VersionMatch{}
+	for _, version := range versions {
+		file, exists := filesById[version.FileID]
+		if exists && file.Owner == owner && query.Matches(file, version) {
+			matches = append(matches, VersionMatch{File: file, Version: version})
+		}
+	}
+	return query.page(matches), nil
+}
+
+// intersect keeps the ids that are also in others, in their order
+func intersect(ids, others []string) []string {
+	keep := make(map[string]bool, len(others))
+	for _, id := range others {
+		keep[id] = true
+	}
+	return slices.DeleteFunc(ids, func(id string) bool { return !keep[id] })
+}
+
+func mapKeys(ids []string, key func(string) string) []string {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = key(id)
+	}
+	return keys
+}
+
+const (
+	schemaVersionKey = "schema-version"
+	migrationRunKey  = "migration-run"
+)
+
+func recordKey(kind, id string) (string, error) {
+	switch kind {
+	case KindUser:
+		return id, nil
+	case KindFile:
+		return fileKey(id), nil
+	case KindVersion:
+		return versionKey(id), nil
+	}
+	return "", fmt.Errorf("unknown record kind %q", kind)
+}
+
+// unindexedUsers finds user documents missing from the users set. Servers from before the set kept
+// users only as documents keyed by their email, so they are told apart by their email matching their key.
+func (s *RedisStore) unindexedUsers(ctx context.Context, indexed []string) ([]string, error) {
+	emails := []string{}
+	var cursor uint64
+	for {
+		keys, next, err := s.client.ScanType(ctx, cursor, "*", 1000, "ReJSON-RL").Result()
+		if err != nil {
+			return nil, err
+		}
+		keys = slices.DeleteFunc(keys, func(key string) bool { return slices.Contains(indexed, key) })
+		if len(keys) > 0 {
+			results, err := s.client.JSONMGet(ctx, "$.email", keys...).Result()
+			if err != nil {
+				return nil, err
+			}
+			for i, result := range results {
+				encoded, _ := result.(string)
+				var found []string
+				if json.Unmarshal([]byte(encoded), &found) == nil && len(found) == 1 && found[0] == keys[i] {
+					emails = append(emails, keys[i])
+				}
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return emails, nil
+		}
+	}
+}
+
+// RecordIDs lists users from the users set and the documents of users missing from it, which
+// putting them adds to the set
+func (s *RedisStore) RecordIDs(ctx context.Context, kind string) ([]string, error) {
+	if kind == KindUser {
+		emails, err := s.client.SMembers(ctx, usersKey).Result()
+		if err != nil {
+			return nil, err
+		}
+		unindexed, err := s.unindexedUsers(ctx, emails)
+		emails = append(emails, unindexed...)
+		slices.Sort(emails)
+		return emails, err
+	}
+	prefix, err := recordKey(kind, "")
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	iter := s.client.Scan(ctx, 0, prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		ids = append(ids, strings.TrimPrefix(iter.Val(), prefix))
+	}
+	slices.Sort(ids)
+	return ids, iter.Err()
+}
+
+// readRecords reads every record while watching the records and the lists new ones are added to, and
+// reads them again when a write changed any of them before the reads were done
+func (s *RedisStore) readRecords(ctx context.Context) (int, map[string]map[string]map[string]any, error) {
+	var schema int
+	var records map[string]map[string]map[string]any
+	err := s.transaction(ctx, func(tx *redis.Tx) error {
+		for _, kind := range recordKinds {
+			ids, err := s.RecordIDs(ctx, kind)
+			if err != nil {
+				return err
+			}
+			keys := []string{}
+			for _, id := range ids {
+				key, _ := recordKey(kind, id)
+				keys = append(keys, key)
+				switch kind {
+				case KindUser:
+					keys = append(keys, userFilesKey(id))
+				case KindFile:
+					keys = append(keys, fileVersionsKey(id))
+				}
+			}
+			if len(keys) > 0 {
+				if err := tx.Watch(ctx, keys...).Err(); err != nil {
+					return err
+				}
+			}
+		}
+		var err error
+		if schema, records, err = readRecords(ctx, s); err != nil {
+			return err
+		}
+		// the transaction changes nothing, it fails when a watched key changed since it was watched
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Ping(ctx)
+			return nil
+		})
+		return err
+	}, usersKey, schemaVersionKey)
+	return schema, records, err
+}
+
+func (s *RedisStore) GetRecord(ctx context.Context, kind, id string) (map[string]any, error) {
+	key, err := recordKey(kind, id)
+	if err != nil {
+		return nil, err
+	}
+	record, err := getRecord[map[string]any](ctx, s.client, key)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	return *record, nil
+}
+
+// PutRecord stores a document as is and moves the file or version between indexes as it changed.
+// A version new to its file is placed in the file's history by creation time.
+func (s *RedisStore) PutRecord(ctx context.Context, kind, id string, record map[string]any) error {
+	key, err := recordKey(kind, id)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case KindFile:
+		return s.putFileRecord(ctx, key, id, record)
+	case KindVersion:
+		return s.putVersionRecord(ctx, key, id, record)
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.JSONSet(ctx, key, "$", record)
+		pipe.SAdd(ctx, usersKey, id)
+		return nil
+	})
+	return err
+}
+
+func (s *RedisStore) putFileRecord(ctx context.Context, key, id string, record map[string]any) error {
+	file, err := fromRecord[File](record)
+	if err != nil {
+		return err
+	}
+	return s.transaction(ctx, func(tx *redis.Tx) error {
+		previous, err := getRecord[File](ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if previous != nil {
+				if err := unindexFile(ctx, tx, pipe, previous); err != nil {
+					return err
+				}
+				if previous.Owner != file.Owner {
+					pipe.LRem(ctx, userFilesKey(previous.Owner), 0, id)
+					pipe.HIncrBy(ctx, usageKey(previous.Owner), "files", -1)
+				}
+			}
+			pipe.JSONSet(ctx, key, "$", record)
+			if file.DeletedAt == "" {
+				pipe.HSet(ctx, userPathsKey(file.Owner), PathKey(file.Path, file.Name), id)
+			}
+			if previous == nil || previous.Owner != file.Owner {
+				pipe.RPush(ctx, userFilesKey(file.Owner), id)
+				pipe.HIncrBy(ctx, usageKey(file.Owner), "files", 1)
+			}
+			return nil
+		})
+		return err
+	}, key)
+}
+
+func (s *RedisStore) putVersionRecord(ctx context.Context, key, id string, record map[string]any) error {
+	version, err := fromRecord[FileVersion](record)
+	if err != nil {
+		return err
+	}
+	historyKey := fileVersionsKey(version.FileID)
+	return s.transaction(ctx, func(tx *redis.Tx) error {
+		previous, err := getRecord[FileVersion](ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		var previousFile *File
+		if previous != nil {
+			if previousFile, err = getRecord[File](ctx, tx, fileKey(previous.FileID)); err != nil {
+				return err
+			}
+		}
+		file, err := getRecord[File](ctx, tx, fileKey(version.FileID))
+		if err != nil {
+			return err
+		}
+		ids, err := tx.LRange(ctx, historyKey, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		pivot := ""
+		if !slices.Contains(ids, id) {
+			history, err := getRecords[FileVersion](ctx, tx, mapKeys(ids, versionKey))
+			if err != nil {
+				return err
+			}
+			if position := versionPosition(history, *version); position < len(history) {
+				pivot = history[position].ID
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if previous != nil {
+				unindexVersion(ctx, pipe, previousFile, *previous)
+				if previous.FileID != version.FileID {
+					pipe.LRem(ctx, fileVersionsKey(previous.FileID), 0, id)
+				}
+			}
+			pipe.JSONSet(ctx, key, "$", record)
+			if !slices.Contains(ids, id) {
+				if pivot != "" {
+					pipe.LInsertBefore(ctx, historyKey, pivot, id)
+				} else {
+					pipe.RPush(ctx, historyKey, id)
+				}
+			}
+			if version.Checksum != "" {
+				pipe.SAdd(ctx, digestKey(version.Checksum), id)
+			}
+			for _, storageId := range version.Storages {
+				pipe.SAdd(ctx, storageVersionsKey(storageId), id)
+			}
+			if file != nil {
+				indexOwnerVersion(ctx, pipe, file.Owner, *version)
+			}
+			return nil
+		})
+		return err
+	}, key, historyKey)
+}
+
+// DeleteRecord removes a document and its index entries, records that do not exist are ignored
+func (s *RedisStore) DeleteRecord(ctx context.Context, kind, id string) error {
+	key, err := recordKey(kind, id)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case KindUser:
+		if err := s.client.Del(ctx, key).Err(); err != nil {
+			return err
+		}
+		return s.client.SRem(ctx, usersKey, id).Err()
+	case KindVersion:
+		if err := s.DeleteVersion(ctx, id); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+	return s.transaction(ctx, func(tx *redis.Tx) error {
+		file, err := getRecord[File](ctx, tx, key)
+		if err != nil || file == nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.LRem(ctx, userFilesKey(file.Owner), 0, id)
+			pipe.HIncrBy(ctx, usageKey(file.Owner), "files", -1)
+			return unindexFile(ctx, tx, pipe, file)
+		})
+		return err
+	}, key)
+}
+
+func (s *RedisStore) StoredSchemaVersion(ctx context.Context) (int, error) {
+	version, err := s.client.Get(ctx, schemaVersionKey).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return version, err
+}
+
+func (s *RedisStore) SetStoredSchemaVersion(ctx context.Context, version int) error {
+	return s.client.Set(ctx, schemaVersionKey, version, 0).Err()
+}
+
+func (s *RedisStore) LoadMigrationRun(ctx context.Context) (*MigrationRun, error) {
+	entry, err := s.client.Get(ctx, migrationRunKey).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var run MigrationRun
+	return &run, json.Unmarshal(entry, &run)
+}
+
+func (s *RedisStore) SaveMigrationRun(ctx context.Context, run *MigrationRun) error {
+	if run == nil {
+		return s.client.Del(ctx, migrationRunKey).Err()
+	}
+	entry, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, migrationRunKey, entry, 0).Err()
+}
+
+func (s *RedisStore) AppendAudit(ctx context.Context, entry AuditEntry) error {
+	entry.Time = time.Now()
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	pipe := s.client.TxPipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{Stream: auditKey(entry.Actor), Values: map[string]any{"entry": encoded}})
+	pipe.SAdd(ctx, auditActorsKey, entry.Actor)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// QueryAudit walks the actor's stream back from query.To in batches, stream ids start with the
+// millisecond they were added at
+func (s *RedisStore) QueryAudit(ctx context.Context, query AuditQuery) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	end, start := "+", "-"
+	if !query.To.IsZero() {
+		end = "(" + strconv.FormatInt(query.To.UnixMilli(), 10)
+	}
+	if !query.From.IsZero() {
+		start = strconv.FormatInt(query.From.UnixMilli(), 10)
+	}
+	for {
+		messages, err := s.client.XRevRangeN(ctx, auditKey(query.Actor), end, start, auditBatch).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, message := range messages {
+			var entry AuditEntry
+			encoded, _ := message.Values["entry"].(string)
+			if err := json.Unmarshal([]byte(encoded), &entry); err != nil {
+				return nil, err
+			}
+			entry.ID = message.ID
+			if !query.Matches(entry) {
+				continue
+			}
+			entries = append(entries, entry)
+			if query.Limit > 0 && len(entries) == query.Limit {
+				return entries, nil
+			}
+		}
+		if len(messages) < auditBatch {
+			return entries, nil
+		}
+		end = "(" + messages[len(messages)-1].ID
+	}
+}
+
+func (s *RedisStore) TrimAudit(ctx context.Context, before time.Time) (int64, error) {
+	actors, err := s.client.SMembers(ctx, auditActorsKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	var trimmed int64
+	for _, actor := range actors {
+		removed, err := s.client.XTrimMinID(ctx, auditKey(actor), strconv.FormatInt(before.UnixMilli(), 10)).Result()
+		if err != nil {
+			return trimmed, err
+		}
+		trimmed += removed
+	}
+	return trimmed, nil
+}
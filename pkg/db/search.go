@@ -0,0 +1,150 @@
+package db
+
+import (
+	"cmp"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	SortCreated  = "created"
+	SortUploaded = "uploaded"
+	SortName     = "name"
+	SortDir      = "dir"
+	SortSize     = "size"
+)
+
+// VersionQuery selects versions of one owner, a zero field matches every version. Name and Dir
+// are globs when they hold *, ? or [ and case insensitive substrings otherwise. Time ranges include
+// their start and exclude their end, tags with an empty value match any value of their key.
+type VersionQuery struct {
+	Name         string
+	Dir          string
+	UploadedFrom time.Time // when the file was first uploaded
+	UploadedTo   time.Time
+	CreatedFrom  time.Time // when the version was created
+	CreatedTo    time.Time
+	Agent        string
+	MinSize      int64
+	MaxSize      int64
+	Tags         map[string]string // matched against the version's tags over its file's
+	Labels       []string          // matched against the labels of the version and its file
+	Sort         string            // one of the Sort constants, SortCreated when empty
+	Desc         bool
+	Offset       int
+	Limit        int // every match when zero
+}
+
+// VersionMatch is a version found by a search together with its file
+type VersionMatch struct {
+	File    File
+	Version FileVersion
+}
+
+type SearchResult struct {
+	Total   int // matches before paging
+	Matches []VersionMatch
+}
+
+func matchesText(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		matched, _ := path.Match(pattern, value)
+		return matched
+	}
+	return strings.Contains(strings.ToLower(value), strings.ToLower(pattern))
+}
+
+func inRange(value string, from, to time.Time) bool {
+	if from.IsZero() && to.IsZero() {
+		return true
+	}
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return false
+	}
+	return (from.IsZero() || !at.Before(from)) && (to.IsZero() || at.Before(to))
+}
+
+// createdScore orders versions by creation time in sorted set indexes
+func createdScore(version FileVersion) float64 {
+	created, err := time.Parse(time.RFC3339, version.CreatedAt)
+	if err != nil {
+		return 0
+	}
+	return float64(created.Unix())
+}
+
+// Matches checks a version and its file against every condition of the query
+func (q VersionQuery) Matches(file File, version FileVersion) bool {
+	if file.DeletedAt != "" {
+		return false
+	}
+	if !matchesText(q.Name, file.Name) || !matchesText(q.Dir, file.Path) {
+		return false
+	}
+	if !inRange(file.UploadedAt, q.UploadedFrom, q.UploadedTo) || !inRange(version.CreatedAt, q.CreatedFrom, q.CreatedTo) {
+		return false
+	}
+	if q.Agent != "" && version.UploadedBy != q.Agent {
+		return false
+	}
+	if version.Size < q.MinSize || (q.MaxSize > 0 && version.Size > q.MaxSize) {
+		return false
+	}
+	for key, want := range q.Tags {
+		value, exists := version.Tags[key]
+		if !exists {
+			value, exists = file.Tags[key]
+		}
+		if !exists || (want != "" && value != want) {
+			return false
+		}
+	}
+	for _, label := range q.Labels {
+		if !slices.Contains(version.Labels, label) && !slices.Contains(file.Labels, label) {
+			return false
+		}
+	}
+	return true
+}
+
+// page sorts matches as the query asks and cuts out the requested page
+func (q VersionQuery) page(matches []VersionMatch) *SearchResult {
+	slices.SortStableFunc(matches, func(a, b VersionMatch) int {
+		var order int
+		switch q.Sort {
+		case SortName:
+			order = cmp.Compare(a.File.Name, b.File.Name)
+		case SortDir:
+			order = cmp.Compare(a.File.Path, b.File.Path)
+		case SortSize:
+			order = cmp.Compare(a.Version.Size, b.Version.Size)
+		case SortUploaded:
+			order = cmp.Compare(a.File.UploadedAt, b.File.UploadedAt)
+		default:
+			order = cmp.Compare(a.Version.CreatedAt, b.Version.CreatedAt)
+		}
+		if order == 0 {
+			order = cmp.Compare(a.Version.ID, b.Version.ID)
+		}
+		if q.Desc {
+			return -order
+		}
+		return order
+	})
+	result := &SearchResult{Total: len(matches), Matches: []VersionMatch{}}
+	if q.Offset >= len(matches) {
+		return result
+	}
+	end := len(matches)
+	if q.Limit > 0 {
+		end = min(end, q.Offset+q.Limit)
+	}
+	result.Matches = matches[q.Offset:end]
+	return result
+}
@@ -0,0 +1,179 @@
+package db
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrConflict means the latest version of a file is not the one the change expected
+	ErrConflict = errors.New("conflicting version")
+	// ErrQuotaExceeded means a new version would take its owner over their limits
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// Limits caps what an owner stores, a limit of 0 is no limit
+type Limits struct {
+	MaxBytes    int64
+	MaxFiles    int64
+	MaxVersions int64
+}
+
+// Check refuses a version of size bytes, of a new file when newFile is set, that would take an owner
+// using usage over the limits
+func (l Limits) Check(usage Usage, newFile bool, size int64) error {
+	if l.MaxBytes > 0 && usage.Bytes+size > l.MaxBytes {
+		return fmt.Errorf("%w: %d of %d bytes used, the upload needs %d more", ErrQuotaExceeded, usage.Bytes, l.MaxBytes, size)
+	}
+	if l.MaxVersions > 0 && usage.Versions >= l.MaxVersions {
+		return fmt.Errorf("%w: %d of %d versions used", ErrQuotaExceeded, usage.Versions, l.MaxVersions)
+	}
+	if l.MaxFiles > 0 && newFile && usage.Files >= l.MaxFiles {
+		return fmt.Errorf("%w: %d of %d files used", ErrQuotaExceeded, usage.Files, l.MaxFiles)
+	}
+	return nil
+}
+
+const (
+	StoreRedis    = "redis"
+	StoreEmbedded = "embedded"
+	StoreMemory   = "memory"
+)
+
+// MetadataStore keeps users with their agents, and files and versions as separate records
+// indexed by owner, by path, by content digest and by the storages holding them. Files in the
+// trash keep their records but not their path.
+// Lookups of a single record return nil without an error when it does not exist.
+type MetadataStore interface {
+	CreateUser(ctx context.Context, user User) error
+	GetUser(ctx context.Context, email string) (*User, error)
+	ListUserEmails(ctx context.Context) ([]string, error)
+	AddAgent(ctx context.Context, email string, agent Agent) error
+	RemoveAgent(ctx context.Context, email, name string) error
+	// UpdateAgent replaces the agent of the user named like agent, failing with ErrNotFound when there is none
+	UpdateAgent(ctx context.Context, email string, agent Agent) error
+	// SwapAgent replaces the agent of the user named like agent while its refresh token and generation
+	// are still those of current, failing with ErrConflict when they changed meanwhile
+	SwapAgent(ctx context.Context, email string, current, agent Agent) error
+	// SetPassword replaces the password hash of a user and drops their reset token
+	SetPassword(ctx context.Context, email, hash string) error
+	SetResetToken(ctx context.Context, email, digest, expiresAt string) error
+	// ConsumeResetToken drops the reset token of a user while it is still digest, failing with
+	// ErrConflict when the user holds another one or none, so each reset token is used once
+	ConsumeResetToken(ctx context.Context, email, digest string) error
+
+	GetFile(ctx context.Context, id string) (*File, error)
+	FindFile(ctx context.Context, owner, dir, name string) (*File, error)
+	// ListFiles returns the owner's files, the ones in the trash included
+	ListFiles(ctx context.Context, owner string) ([]File, error)
+	// TrashFile marks a file deleted at a time and frees its path for a new file, its versions stay
+	TrashFile(ctx context.Context, fileId string, at time.Time) error
+	// RestoreFile takes a file out of the trash, failing with ErrConflict when another file took its path meanwhile
+	RestoreFile(ctx context.Context, fileId string) error
+	// DeleteFile removes a file with all its versions and their index entries, the blobs are left to the caller
+	DeleteFile(ctx context.Context, fileId string) error
+
+	// PutVersion atomically adds version to the file of file.Owner at file.Path and file.Name, creating
+	// the file from file when there is none yet, or else adding the tags and labels of file to it. The version is given the file's id and the latest version
+	// as its parent. When expectParent is set and the latest version is another one nothing changes and
+	// ErrConflict is returned. When limits are given and the version does not fit them nothing changes
+	// and ErrQuotaExceeded is returned, checked against the usage in the same step as the version is added.
+	PutVersion(ctx context.Context, file File, version FileVersion, expectParent string, limits *Limits) (*File, *FileVersion, error)
+	GetVersion(ctx context.Context, id string) (*FileVersion, error)
+	// ListVersions returns the versions of a file oldest first
+	ListVersions(ctx context.Context, fileId string) ([]FileVersion, error)
+	VersionsByDigest(ctx context.Context, checksum string) ([]FileVersion, error)
+	VersionsByStorage(ctx context.Context, storageId string) ([]FileVersion, error)
+	// SearchVersions finds the versions of owner's files matching query, sorted and paged as it asks
+	SearchVersions(ctx context.Context, owner string, query VersionQuery) (*SearchResult, error)
+	AddVersionStorage(ctx context.Context, versionId, storageId string) error
+	SetVersionStorages(ctx context.Context, versionId string, storageIds []string) error
+	// ReplaceVersionStorages drops remove from the storages of a version and adds add in one atomic
+	// update, so storages recorded meanwhile are kept
+	ReplaceVersionStorages(ctx context.Context, versionId string, remove, add []string) error
+	// SetFileTags and SetVersionTags replace the tags and labels of a file or a version
+	SetFileTags(ctx context.Context, fileId string, tags map[string]string, labels []string) error
+	SetVersionTags(ctx context.Context, versionId string, tags map[string]string, labels []string) error
+	// DeleteVersion removes a version and its index entries, its blobs are left to the caller
+	DeleteVersion(ctx context.Context, versionId string) error
+	// GetUsage tells how much owner stores, kept up to date as versions come and go
+	GetUsage(ctx context.Context, owner string) (*Usage, error)
+
+	Records
+	AuditLog
+}
+
+// StoreOptions selects and configures a MetadataStore
+type StoreOptions struct {
+	Kind      string
+	Path      string // file the embedded store persists to
+	RedisAddr string
+}
+
+func NewMetadataStore(opts StoreOptions) (MetadataStore, error) {
+	switch opts.Kind {
+	case "", StoreRedis:
+		return NewRedisStore(NewRedisClient(opts.RedisAddr)), nil
+	case StoreEmbedded:
+		return OpenFileStore(opts.Path)
+	case StoreMemory:
+		return NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown metadata store %q", opts.Kind)
+}
+
+// PathKey identifies a file by directory and name, encoded so that no two pairs share a key
+// whatever characters they contain
+func PathKey(dir, name string) string {
+	key, _ := json.Marshal([]string{dir, name})
+	return string(key)
+}
+
+// agentChanged tells whether agent no longer has the refresh token and generation of current
+func agentChanged(agent, current Agent) error {
+	if agent.RefreshToken != current.RefreshToken || agent.Generation != current.Generation {
+		return fmt.Errorf("agent %s: %w", agent.Name, ErrConflict)
+	}
+	return nil
+}
+
+// resetTokenChanged tells whether user no longer holds the reset token digest
+func resetTokenChanged(user *User, digest string) error {
+	if user.ResetToken == "" || subtle.ConstantTimeCompare([]byte(user.ResetToken), []byte(digest)) != 1 {
+		return fmt.Errorf("reset token of %s: %w", user.Email, ErrConflict)
+	}
+	return nil
+}
+
+// replaceStorages drops remove from storages and appends add, listing every storage once
+func replaceStorages(storages, remove, add []string) []string {
+	kept := []string{}
+	for _, id := range storages {
+		if !slices.Contains(remove, id) && !slices.Contains(add, id) {
+			kept = append(kept, id)
+		}
+	}
+	return append(kept, add...)
+}
+
+// addTags merges tags and labels into the ones a file already has, the new value of a tag wins
+func addTags(file *File, tags map[string]string, labels []string) {
+	if len(tags) > 0 {
+		if file.Tags == nil {
+			file.Tags = make(map[string]string)
+		}
+		maps.Copy(file.Tags, tags)
+	}
+	for _, label := range labels {
+		if !slices.Contains(file.Labels, label) {
+			file.Labels = append(file.Labels, label)
+		}
+	}
+}
@@ -0,0 +1,470 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func exerciseStore(t *testing.T, store MetadataStore) {
+	ctx := context.Background()
+	user := User{ID: "user1", Email: "test@gmail.com", Agents: []Agent{{Name: "agent"}}}
+	assert.Nil(t, store.CreateUser(ctx, user))
+	assert.NotNil(t, store.CreateUser(ctx, user))
+
+	missing, err := store.GetUser(ctx, "missing@gmail.com")
+	assert.Nil(t, err)
+	assert.Nil(t, missing)
+	emails, err := store.ListUserEmails(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"test@gmail.com"}, emails)
+
+	assert.Nil(t, store.AddAgent(ctx, user.Email, Agent{Name: "second"}))
+	assert.Nil(t, store.RemoveAgent(ctx, user.Email, "agent"))
+	assert.NotNil(t, store.RemoveAgent(ctx, user.Email, "agent"))
+	found, err := store.GetUser(ctx, user.Email)
+	assert.Nil(t, err)
+	assert.Equal(t, []Agent{{Name: "second"}}, found.Agents)
+	assert.Nil(t, store.UpdateAgent(ctx, user.Email, Agent{Name: "second", RefreshToken: "digest"}))
+	assert.ErrorIs(t, store.UpdateAgent(ctx, user.Email, Agent{Name: "agent"}), ErrNotFound)
+	found, _ = store.GetUser(ctx, user.Email)
+	assert.Equal(t, []Agent{{Name: "second", RefreshToken: "digest"}}, found.Agents)
+	assert.ErrorIs(t, store.SwapAgent(ctx, user.Email, Agent{Name: "second", RefreshToken: "stale"}, Agent{Name: "second"}), ErrConflict)
+	assert.Nil(t, store.SwapAgent(ctx, user.Email, found.Agents[0], Agent{Name: "second", RefreshToken: "rotated"}))
+	assert.ErrorIs(t, store.SwapAgent(ctx, user.Email, found.Agents[0], Agent{Name: "second"}), ErrConflict, "an agent is swapped once")
+	found, _ = store.GetUser(ctx, user.Email)
+	assert.Equal(t, "rotated", found.Agents[0].RefreshToken)
+	assert.Nil(t, store.SetResetToken(ctx, user.Email, "reset", "2024-03-01T00:00:00Z"))
+	found, _ = store.GetUser(ctx, user.Email)
+	assert.Equal(t, "reset", found.ResetToken)
+	assert.ErrorIs(t, store.ConsumeResetToken(ctx, user.Email, "forged"), ErrConflict)
+	assert.Nil(t, store.ConsumeResetToken(ctx, user.Email, "reset"))
+	assert.ErrorIs(t, store.ConsumeResetToken(ctx, user.Email, "reset"), ErrConflict, "a reset token is consumed once")
+	found, _ = store.GetUser(ctx, user.Email)
+	assert.Equal(t, "", found.ResetToken)
+	assert.Equal(t, "", found.ResetExpiresAt)
+	assert.Nil(t, store.SetResetToken(ctx, user.Email, "reset", "2024-03-01T00:00:00Z"))
+	assert.Nil(t, store.SetPassword(ctx, user.Email, "hash"))
+	assert.ErrorIs(t, store.SetPassword(ctx, "missing@gmail.com", "hash"), ErrNotFound)
+	found, _ = store.GetUser(ctx, user.Email)
+	assert.Equal(t, "hash", found.Password)
+	assert.Equal(t, "", found.ResetToken, "a new password uses up the reset token")
+
+	file := File{ID: "file1", Owner: user.Email, Name: "notes.txt", Path: "docs", SchemaVersion: SchemaVersion}
+	putFile, v1, err := store.PutVersion(ctx, file, FileVersion{ID: "v1", Hash: "h1", Checksum: "sum", Storages: []string{}}, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, &file, putFile)
+	assert.Equal(t, "file1", v1.FileID)
+	assert.Equal(t, "", v1.Parent)
+	_, _, err = store.PutVersion(ctx, File{ID: "file3", Owner: "missing@gmail.com"}, FileVersion{ID: "v0"}, "", nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+	putFile, v2, err := store.PutVersion(ctx, File{ID: "file2", Owner: user.Email, Name: "notes.txt", Path: "docs"},
+		FileVersion{ID: "v2", Hash: "h2", Checksum: "sum", Storages: []string{"s1"}}, "v1", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "file1", putFile.ID, "the existing file must be reused")
+	assert.Equal(t, "v1", v2.Parent)
+	_, _, err = store.PutVersion(ctx, file, FileVersion{ID: "v3", Hash: "h3"}, "v1", nil)
+	assert.ErrorIs(t, err, ErrConflict)
+	_, _, err = store.PutVersion(ctx, File{ID: "file4", Owner: user.Email, Name: "docs", Path: "notes.txt"}, FileVersion{ID: "v4"}, "", nil)
+	assert.Nil(t, err)
+
+	byPath, err := store.FindFile(ctx, user.Email, "docs", "notes.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, &file, byPath)
+	byPath, err = store.FindFile(ctx, user.Email, "docs", "other")
+	assert.Nil(t, err)
+	assert.Nil(t, byPath)
+	files, err := store.ListFiles(ctx, user.Email)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"file1", "file4"}, []string{files[0].ID, files[1].ID})
+
+	assert.Nil(t, store.AddVersionStorage(ctx, "v1", "s1"))
+	assert.Nil(t, store.AddVersionStorage(ctx, "v1", "s2"))
+	assert.Nil(t, store.SetVersionStorages(ctx, "v2", []string{"s3"}))
+	assert.ErrorIs(t, store.SetVersionStorages(ctx, "v9", nil), ErrNotFound)
+	assert.Nil(t, store.AddVersionStorage(ctx, "v2", "s4"))
+	assert.Nil(t, store.ReplaceVersionStorages(ctx, "v2", []string{"s4", "s5"}, []string{"s5", "s3"}))
+	assert.ErrorIs(t, store.ReplaceVersionStorages(ctx, "v9", nil, nil), ErrNotFound)
+
+	versions, err := store.ListVersions(ctx, "file1")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, []string{"s1", "s2"}, versions[0].Storages)
+	assert.Equal(t, []string{"s5", "s3"}, versions[1].Storages)
+	byDigest, err := store.VersionsByDigest(ctx, "sum")
+	assert.Nil(t, err)
+	assert.Len(t, byDigest, 2)
+	onS1, err := store.VersionsByStorage(ctx, "s1")
+	assert.Nil(t, err)
+	assert.Len(t, onS1, 1)
+	assert.Equal(t, "v1", onS1[0].ID)
+	onS3, err := store.VersionsByStorage(ctx, "s3")
+	assert.Nil(t, err)
+	assert.Len(t, onS3, 1)
+	onS4, err := store.VersionsByStorage(ctx, "s4")
+	assert.Nil(t, err)
+	assert.Empty(t, onS4, "replaced storages leave the index")
+
+	version, err := store.GetVersion(ctx, "v1")
+	assert.Nil(t, err)
+	version.Storages[0] = "changed"
+	again, _ := store.GetVersion(ctx, "v1")
+	assert.Equal(t, "s1", again.Storages[0], "callers must not share state with the store")
+
+	assert.Nil(t, store.DeleteVersion(ctx, "v1"))
+	assert.ErrorIs(t, store.DeleteVersion(ctx, "v1"), ErrNotFound)
+	deleted, err := store.GetVersion(ctx, "v1")
+	assert.Nil(t, err)
+	assert.Nil(t, deleted)
+	versions, err = store.ListVersions(ctx, "file1")
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", versions[0].ID)
+	onS2, err := store.VersionsByStorage(ctx, "s2")
+	assert.Nil(t, err)
+	assert.Len(t, onS2, 0)
+	byDigest, err = store.VersionsByDigest(ctx, "sum")
+	assert.Nil(t, err)
+	assert.Len(t, byDigest, 1)
+
+	tagged, _, err := store.PutVersion(ctx, File{ID: "file5", Owner: user.Email, Name: "notes.txt", Path: "docs",
+		Tags: map[string]string{"host": "laptop"}, Labels: []string{"work"}}, FileVersion{ID: "v5"}, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "file1", tagged.ID)
+	assert.Equal(t, map[string]string{"host": "laptop"}, tagged.Tags, "tags given with a new version are added to the file")
+	assert.Equal(t, []string{"work"}, tagged.Labels)
+	assert.Nil(t, store.SetFileTags(ctx, "file1", map[string]string{"os": "linux"}, nil))
+	assert.Nil(t, store.SetVersionTags(ctx, "v5", nil, []string{"release"}))
+	assert.ErrorIs(t, store.SetFileTags(ctx, "file9", nil, nil), ErrNotFound)
+	assert.ErrorIs(t, store.SetVersionTags(ctx, "v9", nil, nil), ErrNotFound)
+	tagged, err = store.GetFile(ctx, "file1")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"os": "linux"}, tagged.Tags)
+	assert.Empty(t, tagged.Labels)
+	taggedVersion, err := store.GetVersion(ctx, "v5")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"release"}, taggedVersion.Labels)
+}
+
+func exerciseSearch(t *testing.T, store MetadataStore) {
+	ctx := context.Background()
+	owner := "search@gmail.com"
+	assert.Nil(t, store.CreateUser(ctx, User{Email: owner}))
+	assert.Nil(t, store.CreateUser(ctx, User{Email: "stranger@gmail.com"}))
+	day := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	put := func(owner, dir, name, versionId, agent string, size int64, created time.Time) {
+		_, _, err := store.PutVersion(ctx, File{ID: "f-" + versionId, Owner: owner, Name: name, Path: dir, UploadedAt: day.Format(time.RFC3339)},
+			FileVersion{ID: versionId, Size: size, UploadedBy: agent, CreatedAt: created.Format(time.RFC3339)}, "", nil)
+		assert.Nil(t, err)
+	}
+	put(owner, "home/", ".bashrc", "s1", "laptop", 100, day)
+	put(owner, "home/", ".bashrc", "s2", "desktop", 300, day.AddDate(0, 0, 1))
+	put(owner, "home/.config/", "init.vim", "s3", "laptop", 2000, day.AddDate(0, 0, 2))
+	put(owner, "etc/", "hosts", "s4", "desktop", 50, day.AddDate(0, 0, 3))
+	put("stranger@gmail.com", "home/", ".bashrc", "s5", "laptop", 100, day)
+	assert.Nil(t, store.SetVersionTags(ctx, "s3", map[string]string{"editor": "vim"}, nil))
+
+	ids := func(query VersionQuery) []string {
+		result, err := store.SearchVersions(ctx, owner, query)
+		assert.Nil(t, err)
+		found := []string{}
+		for _, match := range result.Matches {
+			found = append(found, match.Version.ID)
+		}
+		return found
+	}
+	assert.Equal(t, []string{"s1", "s2", "s3", "s4"}, ids(VersionQuery{}))
+	assert.Equal(t, []string{"s1", "s2"}, ids(VersionQuery{Name: "BASH"}))
+	assert.Equal(t, []string{"s3"}, ids(VersionQuery{Name: "*.vim"}))
+	assert.Equal(t, []string{"s1", "s2"}, ids(VersionQuery{Dir: "home/*"}), "globs do not cross directories")
+	assert.Equal(t, []string{"s3"}, ids(VersionQuery{Dir: "config"}))
+	assert.Equal(t, []string{"s2", "s3"}, ids(VersionQuery{CreatedFrom: day.AddDate(0, 0, 1), CreatedTo: day.AddDate(0, 0, 3)}))
+	assert.Equal(t, []string{"s1", "s3"}, ids(VersionQuery{Agent: "laptop"}))
+	assert.Equal(t, []string{"s1", "s2"}, ids(VersionQuery{MinSize: 100, MaxSize: 1000}))
+	assert.Equal(t, []string{"s3"}, ids(VersionQuery{Tags: map[string]string{"editor": ""}}))
+	assert.Equal(t, []string{}, ids(VersionQuery{UploadedTo: day}))
+	assert.Equal(t, []string{"s3", "s2", "s1", "s4"}, ids(VersionQuery{Sort: SortSize, Desc: true}))
+	assert.Equal(t, []string{"s2", "s4"}, ids(VersionQuery{Sort: SortName, Offset: 1, Limit: 2}))
+
+	result, err := store.SearchVersions(ctx, owner, VersionQuery{Limit: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, result.Total)
+	assert.Equal(t, ".bashrc", result.Matches[0].File.Name)
+	usage, err := store.GetUsage(ctx, owner)
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{Files: 3, Versions: 4, Bytes: 2450}, *usage)
+	assert.Nil(t, store.DeleteVersion(ctx, "s3"))
+	assert.Equal(t, []string{"s1"}, ids(VersionQuery{Agent: "laptop"}))
+	usage, _ = store.GetUsage(ctx, owner)
+	assert.Equal(t, Usage{Files: 3, Versions: 3, Bytes: 450}, *usage, "usage follows deleted versions")
+	usage, _ = store.GetUsage(ctx, "stranger@gmail.com")
+	assert.Equal(t, Usage{Files: 1, Versions: 1, Bytes: 100}, *usage)
+}
+
+// exerciseConcurrentPuts races uploads of one path that all expect the same parent
+func exerciseConcurrentPuts(t *testing.T, store MetadataStore) {
+	ctx := context.Background()
+	assert.Nil(t, store.CreateUser(ctx, User{Email: "race@gmail.com"}))
+	_, first, err := store.PutVersion(ctx, File{ID: "base", Owner: "race@gmail.com", Name: "rc"}, FileVersion{ID: "first"}, "", nil)
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	var conflicts atomic.Int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			file := File{ID: fmt.Sprintf("file%d", i), Owner: "race@gmail.com", Name: "rc"}
+			_, _, err := store.PutVersion(ctx, file, FileVersion{ID: fmt.Sprintf("v%d", i)}, first.ID, nil)
+			if errors.Is(err, ErrConflict) {
+				conflicts.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(19), conflicts.Load(), "only one upload may build on the same parent")
+
+	files, err := store.ListFiles(ctx, "race@gmail.com")
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+	versions, err := store.ListVersions(ctx, "base")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, "first", versions[1].Parent)
+}
+
+// exerciseConcurrentQuota races uploads of new files against limits only some of them fit
+func exerciseConcurrentQuota(t *testing.T, store MetadataStore) {
+	ctx := context.Background()
+	assert.Nil(t, store.CreateUser(ctx, User{Email: "quota@gmail.com"}))
+	limits := &Limits{MaxFiles: 5, MaxBytes: 1000}
+
+	var wg sync.WaitGroup
+	var stored atomic.Int64
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			file := File{ID: fmt.Sprintf("quota-file%d", i), Owner: "quota@gmail.com", Name: fmt.Sprintf("rc%d", i)}
+			_, _, err := store.PutVersion(ctx, file, FileVersion{ID: fmt.Sprintf("quota-v%d", i), Size: 100}, "", limits)
+			if err == nil {
+				stored.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, stored.Load(), int64(5), "uploads racing each other stay within the limits together")
+	usage, err := store.GetUsage(ctx, "quota@gmail.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{Files: stored.Load(), Versions: stored.Load(), Bytes: 100 * stored.Load()}, *usage)
+
+	_, _, err = store.PutVersion(ctx, File{ID: "quota-big", Owner: "quota@gmail.com", Name: "rc0"}, FileVersion{ID: "quota-big", Size: 1001}, "", limits)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+}
+
+func exerciseTrash(t *testing.T, store MetadataStore) {
+	ctx := context.Background()
+	owner := "trash@gmail.com"
+	assert.Nil(t, store.CreateUser(ctx, User{Email: owner}))
+	put := func(fileId, versionId string) *File {
+		file, _, err := store.PutVersion(ctx, File{ID: fileId, Owner: owner, Name: ".bashrc", Path: "home/"},
+			FileVersion{ID: versionId, Checksum: "sum-" + versionId, Size: 10, CreatedAt: time.Now().Format(time.RFC3339)}, "", nil)
+		assert.Nil(t, err)
+		return file
+	}
+	put("trashed", "t1")
+	put("trashed", "t2")
+	deletedAt := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	assert.Nil(t, store.TrashFile(ctx, "trashed", deletedAt))
+	found, _ := store.FindFile(ctx, owner, "home/", ".bashrc")
+	assert.Nil(t, found, "a trashed file leaves its path")
+	files, _ := store.ListFiles(ctx, owner)
+	assert.Len(t, files, 1)
+	assert.Equal(t, deletedAt.Format(time.RFC3339), files[0].DeletedAt)
+	result, _ := store.SearchVersions(ctx, owner, VersionQuery{})
+	assert.Equal(t, 0, result.Total)
+	usage, _ := store.GetUsage(ctx, owner)
+	assert.Equal(t, Usage{Files: 1, Versions: 2, Bytes: 20}, *usage, "the trash counts until it is emptied")
+
+	assert.Equal(t, "replacement", put("replacement", "r1").ID)
+	assert.True(t, errors.Is(store.RestoreFile(ctx, "trashed"), ErrConflict))
+	assert.Nil(t, store.DeleteFile(ctx, "replacement"))
+	assert.Nil(t, store.RestoreFile(ctx, "trashed"))
+	found, _ = store.FindFile(ctx, owner, "home/", ".bashrc")
+	assert.Equal(t, "trashed", found.ID)
+	assert.Empty(t, found.DeletedAt)
+
+	assert.Nil(t, store.DeleteFile(ctx, "trashed"))
+	files, _ = store.ListFiles(ctx, owner)
+	assert.Empty(t, files)
+	version, _ := store.GetVersion(ctx, "t1")
+	assert.Nil(t, version)
+	versions, _ := store.VersionsByDigest(ctx, "sum-t2")
+	assert.Empty(t, versions)
+	usage, _ = store.GetUsage(ctx, owner)
+	assert.Equal(t, Usage{}, *usage)
+	assert.True(t, errors.Is(store.DeleteFile(ctx, "trashed"), ErrNotFound))
+}
+
+func exerciseAudit(t *testing.T, store MetadataStore) {
+	ctx := context.Background()
+	started := time.Now().Add(-time.Second)
+	for _, entry := range []AuditEntry{
+		{Actor: "audit@gmail.com", Command: "tcp upload", FileID: "f1", Result: AuditOK},
+		{Actor: "audit@gmail.com", Command: "tcp download", FileID: "f1", Result: AuditOK},
+		{Actor: "other@gmail.com", Command: "tcp upload", FileID: "f2", Result: AuditOK},
+		{Actor: "audit@gmail.com", Command: "GET /api/search", Result: AuditDenied},
+	} {
+		assert.Nil(t, store.AppendAudit(ctx, entry))
+	}
+
+	entries, err := store.QueryAudit(ctx, AuditQuery{Actor: "audit@gmail.com"})
+	assert.Nil(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, "GET /api/search", entries[0].Command, "newest entries come first")
+	assert.NotEmpty(t, entries[0].ID)
+	assert.False(t, entries[0].Time.Before(started))
+	entries, _ = store.QueryAudit(ctx, AuditQuery{Actor: "audit@gmail.com", FileID: "f1", Limit: 1})
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "tcp download", entries[0].Command)
+	entries, _ = store.QueryAudit(ctx, AuditQuery{Actor: "audit@gmail.com", Command: "tcp upload", From: started, To: time.Now().Add(time.Second)})
+	assert.Len(t, entries, 1)
+	entries, _ = store.QueryAudit(ctx, AuditQuery{Actor: "audit@gmail.com", To: started})
+	assert.Empty(t, entries)
+
+	trimmed, err := store.TrimAudit(ctx, started)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), trimmed)
+	trimmed, err = store.TrimAudit(ctx, time.Now().Add(time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), trimmed)
+	entries, _ = store.QueryAudit(ctx, AuditQuery{Actor: "audit@gmail.com"})
+	assert.Empty(t, entries)
+}
+
+func TestMemoryStore(t *testing.T) {
+	exerciseStore(t, NewMemoryStore())
+	exerciseSearch(t, NewMemoryStore())
+	exerciseConcurrentPuts(t, NewMemoryStore())
+	exerciseConcurrentQuota(t, NewMemoryStore())
+	exerciseAudit(t, NewMemoryStore())
+	exerciseTrash(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	store, err := OpenFileStore(path)
+	assert.Nil(t, err)
+	exerciseStore(t, store)
+	raced, err := OpenFileStore(filepath.Join(t.TempDir(), "raced.json"))
+	assert.Nil(t, err)
+	exerciseConcurrentPuts(t, raced)
+	limited, err := OpenFileStore(filepath.Join(t.TempDir(), "limited.json"))
+	assert.Nil(t, err)
+	exerciseConcurrentQuota(t, limited)
+	searched, err := OpenFileStore(filepath.Join(t.TempDir(), "searched.json"))
+	assert.Nil(t, err)
+	exerciseSearch(t, searched)
+	audited, err := OpenFileStore(filepath.Join(t.TempDir(), "audited.json"))
+	assert.Nil(t, err)
+	exerciseAudit(t, audited)
+	trashed, err := OpenFileStore(filepath.Join(t.TempDir(), "trashed.json"))
+	assert.Nil(t, err)
+	exerciseTrash(t, trashed)
+
+	reopened, err := OpenFileStore(path)
+	assert.Nil(t, err)
+	file, err := reopened.FindFile(context.Background(), "test@gmail.com", "docs", "notes.txt")
+	assert.Nil(t, err)
+	assert.NotNil(t, file)
+	versions, err := reopened.VersionsByStorage(context.Background(), "s3")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 1)
+}
+
+func TestFileStoreLog(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	store, err := OpenFileStore(path)
+	assert.Nil(t, err)
+	assert.Nil(t, store.CreateUser(ctx, User{ID: "user1", Email: "log@gmail.com"}))
+	for i := range compactAfter {
+		_, _, err := store.PutVersion(ctx, File{ID: "file1", Owner: "log@gmail.com", Path: "docs", Name: "notes.txt"}, FileVersion{ID: fmt.Sprintf("v%d", i)}, "", nil)
+		assert.Nil(t, err)
+	}
+	log, err := os.ReadFile(path + ".log")
+	assert.Nil(t, err)
+	assert.Less(t, len(bytes.Split(log, []byte("\n"))), compactAfter, "the log is compacted into the snapshot")
+	assert.Nil(t, store.AddVersionStorage(ctx, "v0", "s3"))
+	assert.Nil(t, store.AppendAudit(ctx, AuditEntry{Actor: "log@gmail.com", Command: "tcp upload", Result: AuditOK}))
+	snapshot, err := os.ReadFile(path)
+	assert.Nil(t, err)
+
+	// a change cut short by a crash is dropped, the ones before it are kept
+	logFile, err := os.OpenFile(path+".log", os.O_WRONLY|os.O_APPEND, 0600)
+	assert.Nil(t, err)
+	_, err = logFile.WriteString(`{"seq":99999,"kind":"user"`)
+	assert.Nil(t, err)
+	logFile.Close()
+	reopened, err := OpenFileStore(path)
+	assert.Nil(t, err)
+	versions, err := reopened.ListVersions(ctx, "file1")
+	assert.Nil(t, err)
+	assert.Len(t, versions, compactAfter)
+	assert.Equal(t, "v0", versions[0].ID, "rewritten versions keep their place in the history")
+	assert.Equal(t, []string{"s3"}, versions[0].Storages)
+	entries, err := reopened.QueryAudit(ctx, AuditQuery{Actor: "log@gmail.com"})
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.NotContains(t, string(snapshot), "tcp upload", "audit entries stay out of the snapshot")
+
+	assert.Nil(t, reopened.AppendAudit(ctx, AuditEntry{Actor: "log@gmail.com", Command: "tcp download", Result: AuditOK}))
+	entries, _ = reopened.QueryAudit(ctx, AuditQuery{Actor: "log@gmail.com"})
+	assert.Equal(t, "2", entries[0].ID, "audit ids carry on after a reopen")
+}
+
+func TestFileStoreLegacySnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	legacy := NewMemoryStore()
+	assert.Nil(t, legacy.CreateUser(context.Background(), User{ID: "user1", Email: "old@gmail.com"}))
+	assert.Nil(t, legacy.AppendAudit(context.Background(), AuditEntry{Actor: "old@gmail.com", Command: "tcp upload", Result: AuditOK}))
+	data, err := json.Marshal(legacy.data)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(path, data, 0600))
+
+	store, err := OpenFileStore(path)
+	assert.Nil(t, err)
+	user, err := store.GetUser(context.Background(), "old@gmail.com")
+	assert.Nil(t, err)
+	assert.NotNil(t, user)
+	audit, err := os.ReadFile(path + ".audit")
+	assert.Nil(t, err)
+	assert.Contains(t, string(audit), "tcp upload", "the audit trail moves to its own file")
+	snapshot, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(snapshot), "tcp upload")
+}
+
+func TestRedisStore(t *testing.T) {
+	client := NewRedisClient("")
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		t.Skip("redis is not available:", err.Error())
+	}
+	defer FlushRedis(context.Background(), client)
+	store := NewRedisStore(client)
+	exerciseStore(t, store)
+	exerciseConcurrentPuts(t, store)
+	exerciseConcurrentQuota(t, store)
+	exerciseSearch(t, store)
+	exerciseAudit(t, store)
+	exerciseTrash(t, store)
+}
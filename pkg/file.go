@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
@@ -84,6 +85,7 @@ type SenderMeta struct {
 	Email       string
 	Agent       string
 	Application string
+	Token       string // access token of the sender, checked by the server
 }
 type TransferPacket struct {
 	Command      string
@@ -113,7 +115,7 @@ func CompressFile(filePath string, senderMeta SenderMeta) (*TransferPacket, erro
 	gzipWriter.Close()
 	meta := map[string]string{}
 	meta["FileName"] = info.Name()
-	meta["Dir"] = strings.Split(filePath, info.Name())[0]
+	meta["Dir"] = strings.TrimSuffix(filePath, info.Name())
 	packet := &TransferPacket{
 		OriginalSize: info.Size(),
 		Compressed:   buf.Bytes(),
@@ -251,6 +253,24 @@ func DecompressPacket(packet *TransferPacket) ([]byte, error) {
 	return decompressed.Bytes(), nil
 }
 
+// Checksum is the hex encoded sha256 digest of data, used to detect corrupt replicas
+func Checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidateFileName accepts any name a POSIX file can have, which is anything but empty names,
+// the . and .. entries and names holding a slash or a NUL byte
+func ValidateFileName(name string) error {
+	switch {
+	case name == "", name == ".", name == "..":
+		return fmt.Errorf("invalid file name %q", name)
+	case strings.ContainsAny(name, "/\x00"):
+		return fmt.Errorf("file name %q may not contain a slash or NUL", name)
+	}
+	return nil
+}
+
 type PathKey struct {
 	Pathname string
 	Filename string
@@ -0,0 +1,23 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressFileKeepsHostileNames(t *testing.T) {
+	for _, name := range []string{"rc", "it's \"rc\"", "new\nline", "ünïcødé"} {
+		dir := filepath.Join(t.TempDir(), name, "nested "+name)
+		assert.Nil(t, os.MkdirAll(dir, 0700))
+		filePath := filepath.Join(dir, name)
+		assert.Nil(t, os.WriteFile(filePath, []byte("data"), 0600))
+
+		packet, err := CompressFile(filePath, SenderMeta{})
+		assert.Nil(t, err)
+		assert.Equal(t, name, packet.Meta["FileName"])
+		assert.Equal(t, dir+string(filepath.Separator), packet.Meta["Dir"])
+	}
+}
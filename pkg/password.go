@@ -0,0 +1,39 @@
+package pkg
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+const (
+	MinPasswordLength = 10
+	// MaxPasswordLength is as much of a password as bcrypt hashes
+	MaxPasswordLength = 72
+)
+
+// ValidatePassword checks the strength rules of passwords: 10 to 72 bytes long, holding lower and
+// upper case letters and a digit or a symbol, and not containing the name part of the user's email
+func ValidatePassword(password, email string) error {
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return errors.New("password must be 10 to 72 characters long")
+	}
+	var lower, upper, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r), unicode.IsPunct(r), unicode.IsSymbol(r):
+			other = true
+		}
+	}
+	if !lower || !upper || !other {
+		return errors.New("password must mix lower and upper case letters with a digit or a symbol")
+	}
+	if name, _, _ := strings.Cut(email, "@"); len(name) >= 3 && strings.Contains(strings.ToLower(password), strings.ToLower(name)) {
+		return errors.New("password must not contain your email")
+	}
+	return nil
+}
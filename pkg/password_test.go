@@ -0,0 +1,23 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePassword(t *testing.T) {
+	assert.Nil(t, ValidatePassword("Correct-Horse-7", "user@gmail.com"))
+	assert.Nil(t, ValidatePassword("ünïcödé!ÄÖÜ", "user@gmail.com"))
+	for _, password := range []string{
+		"Sh0rt!",
+		"alllowercase1",
+		"ALLUPPERCASE1",
+		"NoDigitsOrSymbols",
+		strings.Repeat("Horse-7", 11),
+		"Mailbox-Reader-1",
+	} {
+		assert.NotNil(t, ValidatePassword(password, "reader@gmail.com"), password)
+	}
+}
@@ -2,30 +2,152 @@ package pkg
 
 import "time"
 
+const (
+	MemberAlive   = "alive"
+	MemberSuspect = "suspect"
+	MemberDead    = "dead"
+)
+
 type Storage struct {
 	Id         string
 	Index      int
 	LastUpdate time.Time
 	Port       int
+	Status     string // membership state as seen by the server
+	UsedBytes  int64
+	Labels     map[string]string
+	Draining   bool // draining storages keep serving reads but get no new replicas
+}
+
+// Heartbeat is sent periodically by every storage to keep its membership lease
+type Heartbeat struct {
+	Id        string
+	Port      int
+	Status    string // state reported by the storage itself
+	UsedBytes int64
+	Labels    map[string]string
+	SentAt    time.Time
 }
 
 type InvokeBody struct {
 	Email    string `json:"email" validate:"required,email"`
-	Password string `json:"password" validate:"required,min=8,max=16"`
+	Password string `json:"password" validate:"required,max=72"`
 	Agent    string `json:"agent"`
 }
+type PasswordChangeBody struct {
+	OldPassword string `json:"old_password" validate:"required"`
+	NewPassword string `json:"new_password" validate:"required"`
+}
+type PasswordResetBody struct {
+	Email       string `json:"email" validate:"required,email"`
+	Token       string `json:"token" validate:"required"`
+	NewPassword string `json:"new_password" validate:"required"`
+}
+type ResetTokenResponse struct {
+	Token     string `json:"token"`
+	ExpiresAt string `json:"expires_at"`
+}
 type InvokeResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresAt    string `json:"expires_at"` // when Token expires, refresh it before
+}
+type RefreshBody struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+type UploadTicketBody struct {
+	FileName  string `json:"file_name" validate:"required"`
+	Directory string `json:"directory"`
+	Checksum  string `json:"checksum" validate:"required"`
+	// ParentVersion is the version the client based its copy on, the upload conflicts when it is no longer the latest
+	ParentVersion string `json:"parent_version"`
+	// FileTags are added to the file's tags, VersionTags belong to the new version only
+	FileTags    Tags  `json:"file_tags"`
+	VersionTags Tags  `json:"version_tags"`
+	Size        int64 `json:"size"` // size of the file before compression
+}
+
+// TransferTicket lets the client reach one storage directly
+type TransferTicket struct {
+	StorageId string `json:"storage_id"`
+	Port      int    `json:"port"`
+	Ticket    string `json:"ticket"`
+}
+type TicketsResponse struct {
+	VersionId string           `json:"version_id"`
+	FileName  string           `json:"file_name"`
+	Checksum  string           `json:"checksum"`
+	Tickets   []TransferTicket `json:"tickets"`
 }
 
 type ListUploadsResult struct {
-	ID string
+	ID        string
 	FileName  string
 	Directory string
 	Versions  []UploadVersionResult
+	Tags      Tags
 	CreatedAt string
 }
 type UploadVersionResult struct {
 	ID        string
+	Parent    string
+	Tags      Tags
 	CreatedAt string
 }
+
+// SearchResult is one version found by a search
+type SearchResult struct {
+	FileID      string `json:"file_id"`
+	FileName    string `json:"file_name"`
+	Directory   string `json:"directory"`
+	VersionID   string `json:"version_id"`
+	Parent      string `json:"parent"`
+	Agent       string `json:"agent"`
+	Size        int64  `json:"size"`
+	FileTags    Tags   `json:"file_tags"`
+	VersionTags Tags   `json:"version_tags"`
+	UploadedAt  string `json:"uploaded_at"`
+	CreatedAt   string `json:"created_at"`
+}
+type SearchResponse struct {
+	Total   int            `json:"total"`
+	Offset  int            `json:"offset"`
+	Limit   int            `json:"limit"`
+	Results []SearchResult `json:"results"`
+}
+
+// UsageResponse is what a user stores against their quota, a limit of 0 is no limit
+type UsageResponse struct {
+	Files       int64 `json:"files"`
+	Versions    int64 `json:"versions"`
+	Bytes       int64 `json:"bytes"`
+	MaxFiles    int64 `json:"max_files"`
+	MaxVersions int64 `json:"max_versions"`
+	MaxBytes    int64 `json:"max_bytes"`
+}
+
+// TrashedFile is a deleted file that can still be restored
+type TrashedFile struct {
+	ID        string `json:"id"`
+	FileName  string `json:"file_name"`
+	Directory string `json:"directory"`
+	Versions  int    `json:"versions"`
+	Size      int64  `json:"size"`
+	DeletedAt string `json:"deleted_at"`
+	PurgeAt   string `json:"purge_at,omitempty"` // when the file is deleted for good, never when empty
+}
+
+// AuditEntry is one operation in a user's audit trail
+type AuditEntry struct {
+	ID      string `json:"id"`
+	Time    string `json:"time"`
+	Actor   string `json:"actor"`
+	Agent   string `json:"agent"`
+	Source  string `json:"source"`
+	Command string `json:"command"`
+	FileID  string `json:"file_id"`
+	Version string `json:"version"`
+	Result  string `json:"result"`
+	Error   string `json:"error,omitempty"`
+}
@@ -0,0 +1,108 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Tags are the key/value pairs and free-form labels users attach to files and versions
+type Tags struct {
+	Values map[string]string `json:"values,omitempty"`
+	Labels []string          `json:"labels,omitempty"`
+}
+
+// ParseTags reads key=value pairs and labels as given on the command line or in a query.
+// A pair without "=" has an empty value, which as a filter matches any value of the key.
+func ParseTags(pairs, labels []string) (Tags, error) {
+	tags := Tags{}
+	for _, pair := range pairs {
+		key, value, _ := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return tags, fmt.Errorf("invalid tag %q, expected key=value", pair)
+		}
+		if tags.Values == nil {
+			tags.Values = make(map[string]string)
+		}
+		tags.Values[key] = value
+	}
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			return tags, errors.New("labels can not be empty")
+		}
+		if !slices.Contains(tags.Labels, label) {
+			tags.Labels = append(tags.Labels, label)
+		}
+	}
+	return tags, nil
+}
+
+// Validate checks tags received from a client hold only what ParseTags accepts
+func (t Tags) Validate() error {
+	for key := range t.Values {
+		if strings.TrimSpace(key) != key || key == "" || strings.Contains(key, "=") {
+			return fmt.Errorf("invalid tag key %q", key)
+		}
+	}
+	for _, label := range t.Labels {
+		if strings.TrimSpace(label) != label || label == "" {
+			return fmt.Errorf("invalid label %q", label)
+		}
+	}
+	return nil
+}
+
+func (t Tags) Empty() bool {
+	return len(t.Values) == 0 && len(t.Labels) == 0
+}
+
+// Matches reports whether values and labels carry every tag and label of the filter t
+func (t Tags) Matches(values map[string]string, labels []string) bool {
+	for key, want := range t.Values {
+		value, exists := values[key]
+		if !exists || (want != "" && value != want) {
+			return false
+		}
+	}
+	for _, label := range t.Labels {
+		if !slices.Contains(labels, label) {
+			return false
+		}
+	}
+	return true
+}
+
+// Pairs formats the tag values back into the key=value form ParseTags reads
+func (t Tags) Pairs() []string {
+	pairs := make([]string, 0, len(t.Values))
+	for key, value := range t.Values {
+		pairs = append(pairs, key+"="+value)
+	}
+	slices.Sort(pairs)
+	return pairs
+}
+
+// EncodeTags stores tags in a packet's meta under key, leaving the meta alone when there are none
+func EncodeTags(meta map[string]string, key string, tags Tags) {
+	if tags.Empty() {
+		return
+	}
+	encoded, _ := json.Marshal(tags)
+	meta[key] = string(encoded)
+}
+
+// DecodeTags reads the tags EncodeTags stored under key
+func DecodeTags(meta map[string]string, key string) (Tags, error) {
+	var tags Tags
+	if meta[key] == "" {
+		return tags, nil
+	}
+	if err := json.Unmarshal([]byte(meta[key]), &tags); err != nil {
+		return tags, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return tags, tags.Validate()
+}
@@ -0,0 +1,33 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTags(t *testing.T) {
+	tags, err := ParseTags([]string{"host=laptop", "os", "note=a=b"}, []string{"work", "work"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"host": "laptop", "os": "", "note": "a=b"}, tags.Values)
+	assert.Equal(t, []string{"work"}, tags.Labels)
+	assert.Equal(t, []string{"host=laptop", "note=a=b", "os="}, tags.Pairs())
+
+	_, err = ParseTags([]string{"=laptop"}, nil)
+	assert.NotNil(t, err)
+	_, err = ParseTags(nil, []string{" "})
+	assert.NotNil(t, err)
+	assert.NotNil(t, Tags{Values: map[string]string{"a=b": "c"}}.Validate())
+	assert.Nil(t, tags.Validate())
+}
+
+func TestTagsMatches(t *testing.T) {
+	values := map[string]string{"host": "laptop", "os": "linux"}
+	labels := []string{"work"}
+	assert.True(t, Tags{}.Matches(nil, nil))
+	assert.True(t, Tags{Values: map[string]string{"host": "laptop"}, Labels: []string{"work"}}.Matches(values, labels))
+	assert.True(t, Tags{Values: map[string]string{"os": ""}}.Matches(values, labels))
+	assert.False(t, Tags{Values: map[string]string{"host": "desktop"}}.Matches(values, labels))
+	assert.False(t, Tags{Values: map[string]string{"zone": ""}}.Matches(values, labels))
+	assert.False(t, Tags{Labels: []string{"home"}}.Matches(values, labels))
+}
@@ -0,0 +1,38 @@
+package pkg
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTicket(t *testing.T) {
+	ticket := Ticket{Operation: TicketUpload, Email: "test@gmail.com", StorageId: "storage1", Hash: "hash"}
+	signed, err := IssueTicket(ticket, "ticket1", time.Minute)
+	assert.Nil(t, err)
+	verified, id, err := VerifyTicket(signed)
+	assert.Nil(t, err)
+	assert.Equal(t, "ticket1", id)
+	assert.Equal(t, ticket, *verified)
+
+	expired, err := IssueTicket(ticket, "ticket2", -time.Minute)
+	assert.Nil(t, err)
+	_, _, err = VerifyTicket(expired)
+	assert.NotNil(t, err)
+
+	apiKey, err := GenerateApiKey("test@gmail.com", "agent", 0, time.Minute)
+	assert.Nil(t, err)
+	_, _, err = VerifyTicket(apiKey)
+	assert.NotNil(t, err, "api keys must not pass as tickets")
+	_, err = DecodeToken(signed)
+	assert.NotNil(t, err, "tickets must not pass as api keys")
+
+	claims := ticketClaims{Ticket: ticket, Type: "ticket", RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))}}
+	withSecret, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(os.Getenv("JWT_SECRET")))
+	assert.Nil(t, err)
+	_, _, err = VerifyTicket(withSecret)
+	assert.NotNil(t, err, "tickets are not signed with the token secret")
+}
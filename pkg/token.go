@@ -1,17 +1,22 @@
 package pkg
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
-func GenerateApiKey(email, agent string) (string, error) {
-	claims := jwt.MapClaims{}
-	claims["email"] = email
-	claims["agent"] = agent
-	claims["iat"] = time.Now().Unix()
+// Types of tokens issued to users, a token of one type never passes as another
+const (
+	TokenAccess  = "access"
+	TokenRefresh = "refresh"
+)
+
+func signToken(claims jwt.MapClaims) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
 	if err != nil {
@@ -19,16 +24,84 @@ func GenerateApiKey(email, agent string) (string, error) {
 	}
 	return tokenString, nil
 }
-func DecodeToken(token string) (jwt.MapClaims, error) {
+
+// GenerateApiKey issues an access token for an agent of a user at the agent's token generation,
+// valid for ttl. Every access token gets an id of its own.
+func GenerateApiKey(email, agent string, generation int, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{}
+	claims["email"] = email
+	claims["agent"] = agent
+	claims["gen"] = generation
+	claims["typ"] = TokenAccess
+	claims["jti"] = uuid.New().String()
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(ttl).Unix()
+	return signToken(claims)
+}
+
+// GenerateRefreshToken issues the refresh token with id for an agent of a user at the agent's token
+// generation, valid for ttl. The server keeps the id, so a refresh token works only as long as the
+// server remembers it.
+func GenerateRefreshToken(email, agent, id string, generation int, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{}
+	claims["email"] = email
+	claims["agent"] = agent
+	claims["gen"] = generation
+	claims["typ"] = TokenRefresh
+	claims["jti"] = id
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(ttl).Unix()
+	return signToken(claims)
+}
+
+func decodeToken(token, typ string) (jwt.MapClaims, error) {
 	t, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
 		return []byte(os.Getenv("JWT_SECRET")), nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
 	if err != nil {
 		return nil, err
 	}
 	claims, ok := t.Claims.(jwt.MapClaims)
 	if !ok {
-		return nil, err
+		return nil, errors.New("invalid token claims")
+	}
+	if claims["typ"] != typ {
+		return nil, fmt.Errorf("not a token of type %s", typ)
 	}
 	return claims, nil
 }
+
+// DecodeToken checks the signature and expiry of an access token and returns its claims
+func DecodeToken(token string) (jwt.MapClaims, error) {
+	return decodeToken(token, TokenAccess)
+}
+
+// DecodeRefreshToken checks the signature and expiry of a refresh token and returns its claims
+func DecodeRefreshToken(token string) (jwt.MapClaims, error) {
+	return decodeToken(token, TokenRefresh)
+}
+
+// TokenGeneration is the token generation of the agent a token was issued at
+func TokenGeneration(claims jwt.MapClaims) int {
+	generation, _ := claims["gen"].(float64)
+	return int(generation)
+}
+
+// TokenExpiry reads when a token expires without checking its signature, for clients that
+// need to know when to refresh it
+func TokenExpiry(token string) (time.Time, error) {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		return time.Time{}, err
+	}
+	exp, err := claims.GetExpirationTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if exp == nil {
+		return time.Time{}, errors.New("token does not expire")
+	}
+	return exp.Time, nil
+}
@@ -0,0 +1,44 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokens(t *testing.T) {
+	access, err := GenerateApiKey("test@gmail.com", "agent", 3, time.Minute)
+	assert.Nil(t, err)
+	claims, err := DecodeToken(access)
+	assert.Nil(t, err)
+	assert.Equal(t, "test@gmail.com", claims["email"])
+	assert.Equal(t, "agent", claims["agent"])
+	assert.Equal(t, 3, TokenGeneration(claims))
+	assert.NotEmpty(t, claims["jti"])
+	other, _ := GenerateApiKey("test@gmail.com", "agent", 3, time.Minute)
+	otherClaims, _ := DecodeToken(other)
+	assert.NotEqual(t, claims["jti"], otherClaims["jti"], "every token has its own id")
+	expiry, err := TokenExpiry(access)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), expiry, 2*time.Second)
+	_, err = DecodeRefreshToken(access)
+	assert.NotNil(t, err, "access tokens do not refresh")
+
+	refresh, err := GenerateRefreshToken("test@gmail.com", "agent", "refresh1", 3, time.Hour)
+	assert.Nil(t, err)
+	claims, err = DecodeRefreshToken(refresh)
+	assert.Nil(t, err)
+	assert.Equal(t, "refresh1", claims["jti"])
+	_, err = DecodeToken(refresh)
+	assert.NotNil(t, err, "refresh tokens do not grant access")
+
+	expired, err := GenerateApiKey("test@gmail.com", "agent", 0, -time.Minute)
+	assert.Nil(t, err)
+	_, err = DecodeToken(expired)
+	assert.NotNil(t, err)
+	ticket, err := IssueTicket(Ticket{Operation: TicketUpload, Email: "test@gmail.com"}, "ticket1", time.Minute)
+	assert.Nil(t, err)
+	_, err = DecodeToken(ticket)
+	assert.NotNil(t, err, "tickets do not grant access")
+}
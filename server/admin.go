@@ -0,0 +1,170 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+)
+
+// adminGuard only lets through tokens issued to one of the configured admins
+func adminGuard(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		email, err := validateToken(c.Request().Header.Get("Authorization"))
+		if err != nil {
+			return c.JSON(401, map[string]interface{}{
+				"message": fmt.Sprintf("invalid token %s", err.Error()),
+			})
+		}
+		if !slices.Contains(cfg.Admins, email) {
+			return c.JSON(403, map[string]interface{}{
+				"message": "admin access required",
+			})
+		}
+		return next(c)
+	}
+}
+
+func clusterOverviewView(c echo.Context) error {
+	overview, err := clusterOverview(redisClient)
+	if err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(200, overview)
+}
+
+func clusterNodesView(c echo.Context) error {
+	return c.JSON(200, clusterNodes())
+}
+
+func clusterIndexesView(c echo.Context) error {
+	return c.JSON(200, clusterIndexes())
+}
+
+func clusterHealthView(c echo.Context) error {
+	return c.JSON(200, clusterHealth())
+}
+
+func clusterCapacityView(c echo.Context) error {
+	return c.JSON(200, clusterCapacity())
+}
+
+func clusterReplicationView(c echo.Context) error {
+	report, err := clusterReplication()
+	if err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(200, report)
+}
+
+func clusterJobsView(c echo.Context) error {
+	report, err := clusterJobs(redisClient)
+	if err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(200, report)
+}
+
+func startRepair(c echo.Context) error {
+	if err := redisClient.Publish(c.Request().Context(), repairRequestChan, "start").Err(); err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(202, map[string]string{"message": "repair requested"})
+}
+
+func startGC(c echo.Context) error {
+	if err := redisClient.Publish(c.Request().Context(), gcRequestChan, "start").Err(); err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(202, map[string]string{"message": "garbage collection requested"})
+}
+
+func repairList(c echo.Context) error {
+	progress, err := repairs.progress()
+	if err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(200, progress)
+}
+
+func rebalanceStatus(c echo.Context) error {
+	status, err := loadRebalanceStatus(redisClient)
+	if err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(200, status)
+}
+
+func startRebalance(c echo.Context) error {
+	if err := redisClient.Publish(c.Request().Context(), rebalanceRequestChan, "start").Err(); err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(202, map[string]string{"message": "rebalance requested"})
+}
+
+func pauseRebalancing(c echo.Context) error {
+	if err := pauseRebalance(redisClient, true); err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(200, map[string]string{"message": "rebalance paused"})
+}
+
+func resumeRebalancing(c echo.Context) error {
+	if err := pauseRebalance(redisClient, false); err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(200, map[string]string{"message": "rebalance resumed"})
+}
+
+func startDrain(c echo.Context) error {
+	storageId := c.Param("id")
+	mu.Lock()
+	_, exists := storages[storageId]
+	mu.Unlock()
+	if !exists {
+		return c.JSON(404, map[string]interface{}{
+			"message": "storage not found",
+		})
+	}
+	if err := redisClient.Publish(c.Request().Context(), drainRequestChan, storageId).Err(); err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(202, map[string]string{"message": "drain requested"})
+}
+
+func drainProgress(c echo.Context) error {
+	status, err := loadDrainStatus(redisClient, c.Param("id"))
+	if err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	if status == nil {
+		return c.JSON(404, map[string]interface{}{
+			"message": "storage is not draining",
+		})
+	}
+	return c.JSON(200, status)
+}
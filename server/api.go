@@ -3,12 +3,13 @@ package server
 import (
 	"errors"
 	"fmt"
+	"slices"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type CustomValidator struct {
@@ -23,21 +24,71 @@ func InitHttpServer() error {
 	server.Validator = &CustomValidator{validator: validator.New()}
 	server.Use(middleware.Logger())
 	server.Use(middleware.Recover())
-	api := server.Group("/api")
-	api.POST("/invoke-token", invokeToken)
+	api := server.Group("/api", auditRequests)
+	api.POST("/register", registerView)
+	api.POST("/login", loginView)
+	api.PUT("/password", changePasswordView)
+	api.POST("/password/reset", resetPasswordView)
+	api.POST("/refresh-token", refreshTokenView)
 	api.GET("/revoke-token", revokeToken)
 	api.GET("/upload-list", uploadList)
+	api.GET("/search", searchView)
+	api.GET("/audit", auditView)
+	api.GET("/usage", usageView)
+	api.GET("/trash", trashListView)
+	api.POST("/trash/:id/restore", restoreFileView)
+	api.DELETE("/trash", emptyTrashView)
+	api.DELETE("/files/:id", deleteFileView)
+	api.PUT("/files/:id/tags", setFileTags)
+	api.PUT("/files/:id/versions/:version/tags", setVersionTags)
+	api.POST("/tickets/upload", uploadTickets)
+	api.GET("/tickets/download", downloadTickets)
+	api.POST("/admin/users/:email/reset-token", resetTokenView, adminGuard)
+	cluster := api.Group("/admin/cluster", adminGuard)
+	cluster.GET("", clusterOverviewView)
+	cluster.GET("/nodes", clusterNodesView)
+	cluster.GET("/indexes", clusterIndexesView)
+	cluster.GET("/health", clusterHealthView)
+	cluster.GET("/capacity", clusterCapacityView)
+	cluster.GET("/replication", clusterReplicationView)
+	cluster.GET("/jobs", clusterJobsView)
+	cluster.GET("/repairs", repairList)
+	cluster.POST("/repair", startRepair)
+	cluster.GET("/rebalance", rebalanceStatus)
+	cluster.POST("/rebalance", startRebalance)
+	cluster.POST("/rebalance/pause", pauseRebalancing)
+	cluster.POST("/rebalance/resume", resumeRebalancing)
+	cluster.POST("/nodes/:id/drain", startDrain)
+	cluster.GET("/nodes/:id/drain", drainProgress)
+	cluster.POST("/gc", startGC)
+	cluster.GET("/migrations", migrationStatus)
+	cluster.POST("/migrations", runMigrations)
+	cluster.POST("/migrations/rollback", rollbackMigrations)
 	return server.Start(fmt.Sprintf(":%d", cfg.HttpPort))
 }
+
+// validateToken checks an access token and that it was not revoked since, and returns the email of its user
 func validateToken(token string) (string, error) {
 	claims, err := pkg.DecodeToken(token)
 	if err != nil {
 		return "", err
 	}
-	email := claims["email"].(string)
+	email, _ := claims["email"].(string)
+	agentName, _ := claims["agent"].(string)
 	if email == "" {
 		return "", errors.New("invalid token")
 	}
+	user, err := findUser(email)
+	if err != nil {
+		return "", err
+	}
+	if user == nil {
+		return "", errTokenRevoked
+	}
+	index := slices.IndexFunc(user.Agents, func(agent db.Agent) bool { return agent.Name == agentName })
+	if index == -1 || user.Agents[index].Generation != pkg.TokenGeneration(claims) {
+		return "", errTokenRevoked
+	}
 	return email, nil
 }
 func uploadList(c echo.Context) error {
@@ -48,91 +99,38 @@ func uploadList(c echo.Context) error {
 			"message": fmt.Sprintf("invalid token %s", err.Error()),
 		})
 	}
-	uploads, err := getUserUploads(email)
+	filter, err := pkg.ParseTags(c.QueryParams()["tag"], c.QueryParams()["label"])
 	if err != nil {
-		return c.JSON(500, map[string]interface{}{
-			"message": err.Error(),
-		})
-	}
-	return c.JSON(200, uploads)
-}
-func invokeToken(c echo.Context) error {
-	var body pkg.InvokeBody
-	if err := c.Bind(&body); err != nil {
-		return c.JSON(400, map[string]interface{}{
-			"message": "invalid request",
-		})
-	}
-	if err := c.Validate(&body); err != nil {
 		return c.JSON(400, map[string]interface{}{
-			"message": "invalid request",
-		})
-	}
-	aget := c.Request().Header.Get("User-Agent")
-	body.Agent = aget
-	existUser, err := findUser(body.Email)
-	if err != nil {
-		return c.JSON(500, map[string]interface{}{
-			"message": "internal server error",
+			"message": err.Error(),
 		})
 	}
-	if existUser == nil {
-		hashPass, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
-		if err != nil {
-			return c.JSON(500, map[string]interface{}{
-				"message": "internal server error",
-			})
-		}
-		if err := createUser(body.Email, body.Agent, string(hashPass)); err != nil {
-			return c.JSON(500, map[string]interface{}{
-				"message": "internal server error",
-			})
-		}
-	} else {
-		if err := updateAgents(existUser.Email, body.Agent); err != nil {
-			return c.JSON(500, map[string]interface{}{
-				"message": "internal server error",
-			})
-		}
-	}
-	token, err := pkg.GenerateApiKey(body.Email, body.Agent)
+	uploads, err := getUserUploads(email, filter)
 	if err != nil {
-		fmt.Errorf("generate tojen err %v", err)
 		return c.JSON(500, map[string]interface{}{
-			"message": "internal server error",
+			"message": err.Error(),
 		})
 	}
-	return c.JSON(200, map[string]string{"token": token})
+	return c.JSON(200, uploads)
 }
+
+// revokeToken signs out the agent the token was issued to, or every agent of its user with all=true
 func revokeToken(c echo.Context) error {
 	token := c.Request().Header.Get("Authorization")
-	if token == "" {
-		return c.JSON(400, map[string]interface{}{
-			"message": "invalid request",
-		})
-	}
-	claims, err := pkg.DecodeToken(token)
+	email, err := validateToken(token)
 	if err != nil {
-		return c.JSON(500, map[string]interface{}{
-			"message": "internal server error",
+		return c.JSON(401, map[string]interface{}{
+			"message": fmt.Sprintf("invalid token %s", err.Error()),
 		})
 	}
-	email := claims["email"].(string)
-	agent := claims["agent"].(string)
-	foundUser, err := findUser(email)
+	claims, _ := pkg.DecodeToken(token)
+	agentName, _ := claims["agent"].(string)
+	all := c.QueryParam("all") == "true"
+	revoked, err := revokeAgents(email, func(agent db.Agent) bool { return all || agent.Name == agentName })
 	if err != nil {
-		return err
-	}
-	if foundUser == nil {
-		return c.JSON(400, map[string]interface{}{
-			"message": "invalid request",
-		})
-	}
-	if err := deleteAgent(email, agent); err != nil {
 		return c.JSON(500, map[string]interface{}{
 			"message": "internal server error",
 		})
 	}
-
-	return c.JSON(200, map[string]string{"message": "token revoked"})
+	return c.JSON(200, map[string]interface{}{"message": "token revoked", "revoked": revoked})
 }
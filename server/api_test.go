@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/jafari-mohammad-reza/dotsync/pkg"
 	"github.com/stretchr/testify/assert"
@@ -23,7 +24,10 @@ func TestInvokeAndRevoke(t *testing.T) {
 	assert.True(t, agentExist)
 	delteAgentErr := deleteAgent(foundUser.Email, foundUser.Agents[0].Name)
 	assert.Nil(t, delteAgentErr)
-	token, err := pkg.GenerateApiKey(foundUser.Email, foundUser.Agents[0].Name)
+	agentExist, err = agentExists(foundUser.Email, "test-agent")
+	assert.Nil(t, err)
+	assert.False(t, agentExist)
+	token, err := pkg.GenerateApiKey(foundUser.Email, foundUser.Agents[0].Name, 0, time.Minute)
 	assert.Nil(t, err)
 	assert.NotNil(t, token)
 	decoded, err := pkg.DecodeToken(token)
@@ -35,6 +39,6 @@ func TestInvokeAndRevoke(t *testing.T) {
 	assert.Nil(t, err)
 	foundUser, err = findUser("testuser@gmail.com")
 	assert.Nil(t, err)
-	assert.Equal(t, foundUser.Agents[1].Name, "second-agent")
+	assert.Equal(t, foundUser.Agents[0].Name, "second-agent")
 	defer flushRedis()
 }
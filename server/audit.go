@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// auditActorKey names the user a request without a token acts as, handlers set it once they know
+	auditActorKey     = "audit_actor"
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// audit records an operation in the actor's trail, operations nobody can be held to are only logged
+func audit(entry db.AuditEntry) {
+	if entry.Actor == "" {
+		slog.Warn("anonymous operation", "command", entry.Command, "source", entry.Source, "result", entry.Result)
+		return
+	}
+	ctx := context.Background()
+	if entry.FileID == "" && entry.Version != "" {
+		if version, err := store.GetVersion(ctx, entry.Version); err == nil && version != nil {
+			entry.FileID = version.FileID
+		}
+	}
+	if err := store.AppendAudit(ctx, entry); err != nil {
+		slog.Error("error recording audit entry", "actor", entry.Actor, "command", entry.Command, "err", err.Error())
+	}
+}
+
+// auditResult tells how an operation that answered with status went
+func auditResult(status int) string {
+	switch {
+	case status == 401 || status == 403:
+		return db.AuditDenied
+	case status >= 400:
+		return db.AuditFailed
+	}
+	return db.AuditOK
+}
+
+// auditRequests records every API request once it was answered, as the user its token belongs to
+func auditRequests(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		entry := db.AuditEntry{
+			Agent:   c.Request().Header.Get("User-Agent"),
+			Source:  c.RealIP(),
+			Command: c.Request().Method + " " + c.Path(),
+			FileID:  c.Param("id"),
+			Version: c.Param("version"),
+		}
+		if claims, tokenErr := pkg.DecodeToken(c.Request().Header.Get("Authorization")); tokenErr == nil {
+			entry.Actor, _ = claims["email"].(string)
+			entry.Agent, _ = claims["agent"].(string)
+		} else if actor, ok := c.Get(auditActorKey).(string); ok {
+			entry.Actor = actor
+		}
+		if entry.FileID == "" {
+			entry.FileID = c.QueryParam("id")
+		}
+		if entry.Version == "" {
+			entry.Version = c.QueryParam("version")
+		}
+		status := c.Response().Status
+		if he, ok := err.(*echo.HTTPError); ok {
+			status = he.Code
+		} else if err != nil {
+			status = 500
+		}
+		entry.Result = auditResult(status)
+		if err != nil {
+			entry.Error = err.Error()
+		} else if entry.Result != db.AuditOK {
+			entry.Error = http.StatusText(status)
+		}
+		audit(entry)
+		return err
+	}
+}
+
+// auditPacket records a TCP command as the user the packet was sent by, err is what it failed with
+func auditPacket(source string, tr *pkg.TransferPacket, versionId string, err error) {
+	entry := db.AuditEntry{
+		Actor:   tr.Email,
+		Agent:   tr.Agent,
+		Source:  source,
+		Command: "tcp " + tr.Command,
+		FileID:  tr.Meta["FileID"],
+		Version: versionId,
+		Result:  db.AuditOK,
+	}
+	if errors.Is(err, errUnauthenticated) {
+		entry.Result, entry.Error = db.AuditDenied, err.Error()
+	} else if err != nil {
+		entry.Result, entry.Error = db.AuditFailed, err.Error()
+	}
+	audit(entry)
+}
+
+// runAuditTrimmer drops audit entries older than the retention on an interval while this server leads
+func runAuditTrimmer(ctx context.Context) {
+	if cfg.AuditRetention <= 0 {
+		return
+	}
+	retention := time.Duration(cfg.AuditRetention) * time.Second
+	ticker := time.NewTicker(min(retention, time.Hour))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			trimmed, err := store.TrimAudit(ctx, now.Add(-retention))
+			if err != nil {
+				slog.Error("error trimming audit log", "err", err.Error())
+				continue
+			}
+			if trimmed > 0 {
+				slog.Info("audit log trimmed", "entries", trimmed)
+			}
+		}
+	}
+}
+
+// parseAuditQuery reads the filters of an audit query, the actor is up to the caller
+func parseAuditQuery(params map[string][]string) (db.AuditQuery, error) {
+	get := func(key string) string {
+		if values := params[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	query := db.AuditQuery{Command: get("command"), FileID: get("file_id"), Limit: defaultAuditLimit}
+	var err error
+	if query.From, err = parseSearchTime(get("from"), false); err != nil {
+		return query, fmt.Errorf("from: %w", err)
+	}
+	if query.To, err = parseSearchTime(get("to"), true); err != nil {
+		return query, fmt.Errorf("to: %w", err)
+	}
+	if limit := get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 || query.Limit > maxAuditLimit {
+			return query, fmt.Errorf("invalid limit %q, expected 1 to %d", limit, maxAuditLimit)
+		}
+	}
+	return query, nil
+}
+
+func auditTrail(query db.AuditQuery) ([]pkg.AuditEntry, error) {
+	found, err := store.QueryAudit(context.Background(), query)
+	if err != nil {
+		return nil, err
+	}
+	entries := []pkg.AuditEntry{}
+	for _, entry := range found {
+		entries = append(entries, pkg.AuditEntry{
+			ID:      entry.ID,
+			Time:    entry.Time.Format(time.RFC3339),
+			Actor:   entry.Actor,
+			Agent:   entry.Agent,
+			Source:  entry.Source,
+			Command: entry.Command,
+			FileID:  entry.FileID,
+			Version: entry.Version,
+			Result:  entry.Result,
+			Error:   entry.Error,
+		})
+	}
+	return entries, nil
+}
+
+// auditView lists what the user did, newest first. Admins may ask for the trail of another user.
+func auditView(c echo.Context) error {
+	email, err := validateToken(c.Request().Header.Get("Authorization"))
+	if err != nil {
+		return c.JSON(401, map[string]interface{}{
+			"message": fmt.Sprintf("invalid token %s", err.Error()),
+		})
+	}
+	query, err := parseAuditQuery(c.QueryParams())
+	if err != nil {
+		return c.JSON(400, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	query.Actor = email
+	if actor := c.QueryParam("actor"); actor != "" && actor != email {
+		if !slices.Contains(cfg.Admins, email) {
+			return c.JSON(403, map[string]interface{}{
+				"message": "admin access required",
+			})
+		}
+		query.Actor = actor
+	}
+	entries, err := auditTrail(query)
+	if err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": "internal server error",
+		})
+	}
+	return c.JSON(200, entries)
+}
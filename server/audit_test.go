@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func auditedRequest(t *testing.T, method, target, token string, handler echo.HandlerFunc) {
+	e := echo.New()
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("Authorization", token)
+	c := e.NewContext(req, httptest.NewRecorder())
+	assert.Nil(t, auditRequests(handler)(c))
+}
+
+func TestAuditRequests(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{Admins: []string{"admin@gmail.com"}})
+	assert.Nil(t, createUser("audit@gmail.com", "laptop", "password"))
+	assert.Nil(t, createUser("admin@gmail.com", "laptop", "password"))
+	tokens, err := issueTokens("audit@gmail.com", "laptop")
+	assert.Nil(t, err)
+	token := tokens.Token
+
+	auditedRequest(t, "GET", "/api/tickets/download?id=f1&version=v1", token, func(c echo.Context) error {
+		return c.JSON(200, map[string]interface{}{})
+	})
+	auditedRequest(t, "GET", "/api/search", "forged", func(c echo.Context) error {
+		return c.JSON(401, map[string]interface{}{"message": "invalid token"})
+	})
+	auditedRequest(t, "POST", "/api/login", "", func(c echo.Context) error {
+		c.Set(auditActorKey, "audit@gmail.com")
+		return c.JSON(500, map[string]interface{}{"message": "internal server error"})
+	})
+	auditPacket("10.0.0.1:4000", &pkg.TransferPacket{Command: "download", Meta: map[string]string{"FileID": "f2"}, SenderMeta: pkg.SenderMeta{Email: "audit@gmail.com", Agent: "desktop"}}, "v2", errors.New("no such version"))
+
+	entries, err := auditTrail(db.AuditQuery{Actor: "audit@gmail.com"})
+	assert.Nil(t, err)
+	assert.Len(t, entries, 3, "requests without a known actor are not kept")
+	assert.Equal(t, "tcp download", entries[0].Command)
+	assert.Equal(t, db.AuditFailed, entries[0].Result)
+	assert.Equal(t, "no such version", entries[0].Error)
+	assert.Equal(t, "10.0.0.1:4000", entries[0].Source)
+	assert.Equal(t, "f2", entries[0].FileID)
+	assert.Equal(t, db.AuditFailed, entries[1].Result)
+	assert.Equal(t, "Internal Server Error", entries[1].Error)
+	assert.Equal(t, "laptop", entries[2].Agent)
+	assert.Equal(t, "f1", entries[2].FileID)
+	assert.Equal(t, "v1", entries[2].Version)
+	assert.Equal(t, db.AuditOK, entries[2].Result)
+
+	adminTokens, _ := issueTokens("admin@gmail.com", "laptop")
+	admin := adminTokens.Token
+	for _, check := range []struct {
+		token  string
+		status int
+	}{{token, 403}, {admin, 200}} {
+		req := httptest.NewRequest("GET", "/api/audit?actor=other@gmail.com", nil)
+		req.Header.Set("Authorization", check.token)
+		rec := httptest.NewRecorder()
+		assert.Nil(t, auditView(echo.New().NewContext(req, rec)))
+		assert.Equal(t, check.status, rec.Code)
+	}
+}
+
+func TestParseAuditQuery(t *testing.T) {
+	query, err := parseAuditQuery(url.Values{"command": {"tcp upload"}, "from": {"2024-03-01"}, "to": {"2024-03-01"}, "limit": {"5"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "tcp upload", query.Command)
+	assert.Equal(t, 24*60*60.0, query.To.Sub(query.From).Seconds())
+	assert.Equal(t, 5, query.Limit)
+	query, err = parseAuditQuery(url.Values{})
+	assert.Nil(t, err)
+	assert.Equal(t, defaultAuditLimit, query.Limit)
+	for _, params := range []url.Values{{"limit": {"0"}}, {"limit": {"5000"}}, {"from": {"last week"}}} {
+		_, err := parseAuditQuery(params)
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/redis/go-redis/v9"
+)
+
+type ClusterOverview struct {
+	ServerId    string            `json:"server_id"`
+	Leader      string            `json:"leader"`
+	Servers     []string          `json:"servers"`
+	Nodes       int               `json:"nodes"`
+	Alive       int               `json:"alive"`
+	Suspect     int               `json:"suspect"`
+	Draining    int               `json:"draining"`
+	UsedBytes   int64             `json:"used_bytes"`
+	Replication ReplicationReport `json:"replication"`
+}
+
+type NodeHealth struct {
+	Id             string    `json:"id"`
+	Status         string    `json:"status"`
+	Draining       bool      `json:"draining"`
+	LastHeartbeat  time.Time `json:"last_heartbeat"`
+	SinceHeartbeat string    `json:"since_heartbeat"`
+}
+
+type NodeCapacity struct {
+	Id        string            `json:"id"`
+	UsedBytes int64             `json:"used_bytes"`
+	Labels    map[string]string `json:"labels"`
+}
+
+type CapacityReport struct {
+	UsedBytes int64          `json:"used_bytes"`
+	Nodes     []NodeCapacity `json:"nodes"`
+}
+
+// ReplicationReport counts versions by how many live replicas they have
+type ReplicationReport struct {
+	Factor          int         `json:"factor"`
+	Versions        int         `json:"versions"`
+	Healthy         int         `json:"healthy"`
+	UnderReplicated int         `json:"under_replicated"`
+	Lost            int         `json:"lost"`
+	ByReplicas      map[int]int `json:"by_replicas"`
+}
+
+type JobsReport struct {
+	Repairs   RepairProgress  `json:"repairs"`
+	Rebalance RebalanceStatus `json:"rebalance"`
+	Drains    []DrainStatus   `json:"drains"`
+	GC        GCStatus        `json:"gc"`
+	Prune     PruneStatus     `json:"prune"`
+}
+
+// currentServerId identifies this server in the cluster, set by InitStorageService
+var currentServerId string
+
+// clusterNodes is a snapshot of the storages this server knows, ordered by index
+func clusterNodes() []pkg.Storage {
+	mu.Lock()
+	nodes := make([]pkg.Storage, 0, len(storages))
+	for _, storage := range storages {
+		nodes = append(nodes, storage)
+	}
+	mu.Unlock()
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Index < nodes[j].Index
+	})
+	return nodes
+}
+
+func clusterIndexes() map[int]string {
+	indexes := make(map[int]string)
+	for _, node := range clusterNodes() {
+		indexes[node.Index] = node.Id
+	}
+	return indexes
+}
+
+func clusterHealth() []NodeHealth {
+	health := []NodeHealth{}
+	for _, node := range clusterNodes() {
+		health = append(health, NodeHealth{
+			Id:             node.Id,
+			Status:         node.Status,
+			Draining:       node.Draining,
+			LastHeartbeat:  node.LastUpdate,
+			SinceHeartbeat: time.Since(node.LastUpdate).Round(time.Second).String(),
+		})
+	}
+	return health
+}
+
+func clusterCapacity() CapacityReport {
+	report := CapacityReport{Nodes: []NodeCapacity{}}
+	for _, node := range clusterNodes() {
+		report.UsedBytes += node.UsedBytes
+		report.Nodes = append(report.Nodes, NodeCapacity{Id: node.Id, UsedBytes: node.UsedBytes, Labels: node.Labels})
+	}
+	return report
+}
+
+func clusterReplication() (ReplicationReport, error) {
+	report := ReplicationReport{Factor: replicationFactor(), ByReplicas: make(map[int]int)}
+	err := forEachVersion(func(email string, file db.File, version db.FileVersion) {
+		replicas := len(rankReplicas(version.Storages))
+		report.Versions++
+		report.ByReplicas[replicas]++
+		switch {
+		case replicas == 0:
+			report.Lost++
+		case replicas < report.Factor:
+			report.UnderReplicated++
+		default:
+			report.Healthy++
+		}
+	})
+	return report, err
+}
+
+func clusterJobs(redisClient *redis.Client) (JobsReport, error) {
+	var report JobsReport
+	var err error
+	if report.Repairs, err = repairs.progress(); err != nil {
+		return report, err
+	}
+	if report.Rebalance, err = loadRebalanceStatus(redisClient); err != nil {
+		return report, err
+	}
+	if report.GC, err = loadGCStatus(redisClient); err != nil {
+		return report, err
+	}
+	if report.Prune, err = loadPruneStatus(redisClient); err != nil {
+		return report, err
+	}
+	entries, err := redisClient.HGetAll(context.Background(), drainJobsKey).Result()
+	if err != nil {
+		return report, err
+	}
+	report.Drains = []DrainStatus{}
+	for _, entry := range entries {
+		var status DrainStatus
+		if json.Unmarshal([]byte(entry), &status) == nil {
+			report.Drains = append(report.Drains, status)
+		}
+	}
+	return report, nil
+}
+
+func clusterOverview(redisClient *redis.Client) (ClusterOverview, error) {
+	overview := ClusterOverview{ServerId: currentServerId}
+	var err error
+	if overview.Leader, err = currentLeader(redisClient); err != nil {
+		return overview, err
+	}
+	if overview.Servers, err = activeServers(redisClient); err != nil {
+		return overview, err
+	}
+	for _, node := range clusterNodes() {
+		overview.Nodes++
+		overview.UsedBytes += node.UsedBytes
+		switch node.Status {
+		case pkg.MemberAlive:
+			overview.Alive++
+		case pkg.MemberSuspect:
+			overview.Suspect++
+		}
+		if node.Draining {
+			overview.Draining++
+		}
+	}
+	overview.Replication, err = clusterReplication()
+	return overview, err
+}
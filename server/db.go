@@ -2,9 +2,10 @@ package server
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
 	"time"
 
 	"github.com/google/uuid"
@@ -16,8 +17,12 @@ import (
 
 var redisClient *redis.Client
 
+// store holds users, agents, files and versions, redis backed unless configured otherwise
+var store db.MetadataStore
+
 func init() {
-	redisClient = db.NewRedisClient()
+	redisClient = db.NewRedisClient("")
+	store = db.NewRedisStore(redisClient)
 }
 
 func createUser(email, agent, password string) error {
@@ -31,23 +36,16 @@ func createUser(email, agent, password string) error {
 		Email:    email,
 		Agents:   agents,
 		Password: password,
-		Files:    []db.File{},
 	}
-	return db.Insert(context.Background(), redisClient, email, user)
+	return store.CreateUser(context.Background(), user)
 }
 
-func findUser(email string) (*db.User, error) {
+func listUserEmails() ([]string, error) {
+	return store.ListUserEmails(context.Background())
+}
 
-	var users []db.User
-	result, err := db.Get(context.Background(), redisClient, email)
-	if err != nil {
-		return nil, err
-	}
-	json.Unmarshal([]byte(result), &users)
-	if len(users) == 0 {
-		return nil, nil
-	}
-	return &users[0], nil
+func findUser(email string) (*db.User, error) {
+	return store.GetUser(context.Background(), email)
 }
 
 func agentExists(email, agent string) (bool, error) {
@@ -55,6 +53,9 @@ func agentExists(email, agent string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	if user == nil {
+		return false, errors.New("user not found")
+	}
 	for _, a := range user.Agents {
 		if a.Name == agent {
 			return true, nil
@@ -71,92 +72,241 @@ func updateAgents(email, agent string) error {
 	if exists {
 		return nil
 	}
-	newAgent, _ := json.Marshal(db.Agent{Name: agent, LastRequest: time.Now().Format(time.DateOnly)})
-	return db.AppendArray(context.Background(), redisClient, email, newAgent, "$.agents")
+	return store.AddAgent(context.Background(), email, db.Agent{Name: agent, LastRequest: time.Now().Format(time.DateOnly)})
 }
 
 func deleteAgent(email, agent string) error {
-	user, err := findUser(email)
+	return store.RemoveAgent(context.Background(), email, agent)
+}
+
+// uploadFile records a new version of the file described by tr and returns its id. When tr names the
+// version the client based its copy on and another version was uploaded since, it fails with db.ErrConflict,
+// and when the version does not fit the owner's quota with errQuotaExceeded.
+func uploadFile(tr *pkg.TransferPacket, uploadHash, checksum string) (string, error) {
+	file, version, err := newVersion(tr, uploadHash, checksum)
+	if err != nil {
+		return "", err
+	}
+	return recordVersion(file, version, tr.Meta["ParentVersion"])
+}
+
+// newVersion builds the records of a new version of the file described by tr without storing them
+func newVersion(tr *pkg.TransferPacket, uploadHash, checksum string) (db.File, db.FileVersion, error) {
+	meta := tr.Meta
+	fileTags, err := pkg.DecodeTags(meta, "FileTags")
+	if err != nil {
+		return db.File{}, db.FileVersion{}, err
+	}
+	versionTags, err := pkg.DecodeTags(meta, "VersionTags")
+	if err != nil {
+		return db.File{}, db.FileVersion{}, err
+	}
+	file := db.File{
+		ID:         uuid.New().String(),
+		Owner:      tr.Email,
+		Name:       meta["FileName"],
+		Path:       meta["Dir"],
+		UploadedAt: time.Now().Format(time.RFC3339),
+		UploadedBy: tr.Agent,
+		Tags:       fileTags.Values,
+		Labels:     fileTags.Labels,
+	}
+	version := db.FileVersion{
+		ID:         uuid.New().String(),
+		Hash:       uploadHash,
+		Checksum:   checksum,
+		Storages:   []string{},
+		BlobDir:    storagePath(tr.Email, meta["Dir"], meta["FileName"]),
+		CreatedAt:  time.Now().Format(time.RFC3339),
+		Size:       tr.OriginalSize,
+		UploadedBy: tr.Agent,
+		Tags:       versionTags.Values,
+		Labels:     versionTags.Labels,
+	}
+	return file, version, nil
+}
+
+// recordVersion stores a new version when it fits the owner's quota, failing with errQuotaExceeded
+// otherwise. When parent is set and another version was uploaded since, it fails with db.ErrConflict.
+func recordVersion(file db.File, version db.FileVersion, parent string) (string, error) {
+	_, created, err := store.PutVersion(context.Background(), file, version, parent, quotaLimits(file.Owner))
+	if err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// discardVersion rolls back a version no storage received, with its file when it was the file's only version
+func discardVersion(versionId string) error {
+	ctx := context.Background()
+	version, err := store.GetVersion(ctx, versionId)
+	if err != nil || version == nil {
+		return err
+	}
+	if err := store.DeleteVersion(ctx, versionId); err != nil {
+		return err
+	}
+	versions, err := store.ListVersions(ctx, version.FileID)
+	if err != nil || len(versions) > 0 {
+		return err
+	}
+	return store.DeleteFile(ctx, version.FileID)
+}
+
+// checkParent fails with db.ErrConflict when parent is set and is not the latest version of the file
+// at dir and name, the check PutVersion makes when the version is stored
+func checkParent(email, dir, name, parent string) error {
+	if parent == "" {
+		return nil
+	}
+	latest := ""
+	file, err := store.FindFile(context.Background(), email, dir, name)
 	if err != nil {
 		return err
 	}
-	index := -1
-	for i, ag := range user.Agents {
-		if ag.Name == agent {
-			index = i
+	if file != nil {
+		versions, err := store.ListVersions(context.Background(), file.ID)
+		if err != nil {
+			return err
+		}
+		if len(versions) > 0 {
+			latest = versions[len(versions)-1].ID
 		}
 	}
-	if index == -1 {
-		return errors.New("invalid agent to remove")
+	if latest != parent {
+		return fmt.Errorf("latest version is %q not %q: %w", latest, parent, db.ErrConflict)
 	}
-	return db.PopArray(context.Background(), redisClient, email, "$.agents[0]", agent, index)
+	return nil
+}
+func addVersionStorage(versionId, storageId string) error {
+	return store.AddVersionStorage(context.Background(), versionId, storageId)
 }
 
-func uploadFile(tr *pkg.TransferPacket, uploadHash string) error {
-	userFilesPath := "$.files[*]"
-	existingFiles, err := db.GetArray(context.Background(), redisClient, tr.Email, userFilesPath)
+// forEachVersion calls fn with every version of every user
+func forEachVersion(fn func(email string, file db.File, version db.FileVersion)) error {
+	emails, err := listUserEmails()
 	if err != nil {
 		return err
 	}
-	meta := tr.Meta
-	for _, file := range existingFiles {
-		filename := meta["FileName"]
-		dir := meta["Dir"]
-		if file["name"] == filename && file["path"] == dir {
-			version := db.FileVersion{
-				ID:        uuid.New().String(),
-				Hash:      uploadHash,
-				Storages:  []string{},
-				CreatedAt: time.Now().Format(time.RFC3339),
+	for _, email := range emails {
+		files, err := store.ListFiles(context.Background(), email)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			versions, err := store.ListVersions(context.Background(), file.ID)
+			if err != nil {
+				return err
 			}
+			for _, version := range versions {
+				fn(email, file, version)
+			}
+		}
+	}
+	return nil
+}
+
+// findFile returns a file owned by email
+func findFile(email, fileId string) (*db.File, error) {
+	file, err := store.GetFile(context.Background(), fileId)
+	if err != nil {
+		return nil, err
+	}
+	if file == nil || file.Owner != email {
+		return nil, fmt.Errorf("file %s not found", fileId)
+	}
+	return file, nil
+}
 
-			fileVersionPath := fmt.Sprintf("$.files[?(@.name=='%s' && @.path=='%s')].versions", filename, dir)
-			versionJson, _ := json.Marshal(version)
-			return db.AppendArray(context.Background(), redisClient, tr.Email, string(versionJson), fileVersionPath)
+// findFileVersion returns a file owned by email and not in the trash, and one of its versions, the latest when versionId is empty
+func findFileVersion(email, fileId, versionId string) (*db.File, *db.FileVersion, error) {
+	file, err := findFile(email, fileId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if file.DeletedAt != "" {
+		return nil, nil, fmt.Errorf("file %s is in the trash", fileId)
+	}
+	if versionId != "" {
+		version, err := store.GetVersion(context.Background(), versionId)
+		if err != nil {
+			return nil, nil, err
+		}
+		if version == nil || version.FileID != file.ID {
+			return nil, nil, fmt.Errorf("version %s not found", versionId)
 		}
+		return file, version, nil
 	}
-	uploadedIn, _ := time.Parse("2006-01-02T15:04:05.000Zs", tr.Meta["UploadedIn"])
-	upload := db.File{
-		ID:         uuid.New().String(),
-		Name:       meta["FileName"],
-		Path:       meta["Dir"],
-		UploadedAt: uploadedIn.Format(time.RFC3339),
-		UploadedBy: tr.Agent,
-		Versions: []db.FileVersion{
-			{
-				ID:        uuid.New().String(),
-				Hash:      uploadHash,
-				Storages:  []string{},
-				CreatedAt: time.Now().Format(time.RFC3339),
-			},
-		},
-	}
-	uploadJson, _ := json.Marshal(upload)
-	return db.AppendArray(context.Background(), redisClient, tr.Email, string(uploadJson), "$.files")
-}
-func updateFileStorages(tr *pkg.TransferPacket, uploadHash, storageId string) error {
-	path := fmt.Sprintf("$.files[*].versions[?(@.hash=='%s')].storages", uploadHash)
-	id, _ := json.Marshal(storageId)
-	return db.AppendArray(context.Background(), redisClient, tr.Email, string(id), path)
-}
-func getUserUploads(email string) ([]pkg.ListUploadsResult, error) {
-	user, err := findUser(email)
+	versions, err := store.ListVersions(context.Background(), file.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(versions) == 0 {
+		return nil, nil, fmt.Errorf("file %s has no versions", fileId)
+	}
+	return file, &versions[len(versions)-1], nil
+}
+
+// findVersion returns a version owned by email together with its file
+func findVersion(email, versionId string) (*db.File, *db.FileVersion, error) {
+	version, err := store.GetVersion(context.Background(), versionId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if version == nil {
+		return nil, nil, fmt.Errorf("version %s not found", versionId)
+	}
+	file, err := findFile(email, version.FileID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("version %s not found", versionId)
+	}
+	return file, version, nil
+}
+func replaceVersionStorages(versionId string, remove, add []string) error {
+	return store.ReplaceVersionStorages(context.Background(), versionId, remove, add)
+}
+
+// getUserUploads lists the files of email outside the trash with their versions. With a filter only the versions carrying
+// its tags and labels, on themselves or on their file, are listed, and files without such versions are left out.
+func getUserUploads(email string, filter pkg.Tags) ([]pkg.ListUploadsResult, error) {
+	files, err := store.ListFiles(context.Background(), email)
 	if err != nil {
 		return nil, err
 	}
 	var result []pkg.ListUploadsResult
-	for _, file := range user.Files {
+	for _, file := range files {
+		if file.DeletedAt != "" {
+			continue
+		}
+		fileVersions, err := store.ListVersions(context.Background(), file.ID)
+		if err != nil {
+			return nil, err
+		}
 		versions := []pkg.UploadVersionResult{}
-		for _, version := range file.Versions {
+		for _, version := range fileVersions {
+			tags := maps.Clone(file.Tags)
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			maps.Copy(tags, version.Tags)
+			if !filter.Matches(tags, append(slices.Clone(file.Labels), version.Labels...)) {
+				continue
+			}
 			versions = append(versions, pkg.UploadVersionResult{
 				ID:        version.ID,
+				Parent:    version.Parent,
+				Tags:      pkg.Tags{Values: version.Tags, Labels: version.Labels},
 				CreatedAt: version.CreatedAt,
 			})
 		}
+		if len(versions) == 0 && !filter.Empty() {
+			continue
+		}
 		item := pkg.ListUploadsResult{
 			ID:        file.ID,
 			FileName:  file.Name,
 			Directory: file.Path,
+			Tags:      pkg.Tags{Values: file.Tags, Labels: file.Labels},
 			CreatedAt: file.UploadedAt,
 			Versions:  versions,
 		}
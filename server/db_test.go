@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"path"
+	"testing"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func uploadPacket(email, dir, name string) *pkg.TransferPacket {
+	return &pkg.TransferPacket{
+		Meta:       map[string]string{"FileName": name, "Dir": dir},
+		SenderMeta: pkg.SenderMeta{Email: email, Agent: "agent"},
+	}
+}
+
+// useMemoryStore runs a test against an empty memory store and config, putting back the ones it replaced when the test ends
+func useMemoryStore(t *testing.T, config pkg.ServerConfig) {
+	previousStore, previousCfg := store, cfg
+	t.Cleanup(func() { store, cfg = previousStore, previousCfg })
+	store, cfg = db.NewMemoryStore(), &config
+}
+
+func TestUploadFileVersions(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{})
+	assert.Nil(t, createUser("owner@gmail.com", "agent", "password"))
+	assert.Nil(t, createUser("other@gmail.com", "agent", "password"))
+
+	first, err := uploadFile(uploadPacket("owner@gmail.com", "home", ".bashrc"), "hash1", "sum1")
+	assert.Nil(t, err)
+	second, err := uploadFile(uploadPacket("owner@gmail.com", "home", ".bashrc"), "hash2", "sum2")
+	assert.Nil(t, err)
+	_, err = uploadFile(uploadPacket("owner@gmail.com", "home", ".vimrc"), "hash3", "sum3")
+	assert.Nil(t, err)
+	stale := uploadPacket("owner@gmail.com", "home", ".bashrc")
+	stale.Meta["ParentVersion"] = first
+	_, err = uploadFile(stale, "hash4", "sum4")
+	assert.ErrorIs(t, err, db.ErrConflict)
+
+	uploads, err := getUserUploads("owner@gmail.com", pkg.Tags{})
+	assert.Nil(t, err)
+	assert.Len(t, uploads, 2)
+	assert.Len(t, uploads[0].Versions, 2)
+	fileId := uploads[0].ID
+
+	_, latest, err := findFileVersion("owner@gmail.com", fileId, "")
+	assert.Nil(t, err)
+	assert.Equal(t, second, latest.ID)
+	assert.Equal(t, first, latest.Parent)
+	_, specific, err := findFileVersion("owner@gmail.com", fileId, first)
+	assert.Nil(t, err)
+	assert.Equal(t, "hash1", specific.Hash)
+	_, _, err = findFileVersion("other@gmail.com", fileId, "")
+	assert.NotNil(t, err, "files must not be readable by other users")
+	_, _, err = findVersion("other@gmail.com", first)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, addVersionStorage(first, "storage1"))
+	held, err := versionsHeldBy("storage1")
+	assert.Nil(t, err)
+	assert.Len(t, held, 1)
+	assert.Equal(t, "owner@gmail.com", held[0].email)
+	assert.Equal(t, first, held[0].version.ID)
+}
+
+var hostileNames = []string{
+	"it's.rc",
+	`quote".rc`,
+	"x' || @.name=='y",
+	"with space",
+	"new\nline",
+	"tab\tand\rreturn",
+	"ünïcødé-设置",
+	"..hidden",
+	".bashrc",
+	".zshrc",
+	"bashrc",
+	"a.b.b",
+	"$.files[*]",
+	"*",
+}
+
+func TestHostileFileNames(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{})
+	assert.Nil(t, createUser("hostile@gmail.com", "agent", "password"))
+
+	dirs := []string{"home/", "home/it's/", "", "a\nb/"}
+	paths := make(map[string]string)
+	for _, dir := range dirs {
+		for _, name := range hostileNames {
+			versionId, err := uploadFile(uploadPacket("hostile@gmail.com", dir, name), blobHash(), "sum")
+			assert.Nil(t, err, "uploading %q in %q", name, dir)
+			file, err := store.FindFile(context.Background(), "hostile@gmail.com", dir, name)
+			assert.Nil(t, err)
+			if !assert.NotNil(t, file, "finding %q in %q", name, dir) {
+				continue
+			}
+			assert.Equal(t, name, file.Name)
+			assert.Equal(t, dir, file.Path)
+			_, version, err := findFileVersion("hostile@gmail.com", file.ID, "")
+			assert.Nil(t, err)
+			assert.Equal(t, versionId, version.ID)
+
+			blobDir := versionPath("hostile@gmail.com", *file, *version)
+			assert.Equal(t, blobDir, path.Clean(blobDir))
+			assert.Equal(t, "hostile@gmail.com", path.Dir(blobDir), "the name must not add path segments")
+			_, taken := paths[blobDir]
+			assert.False(t, taken, "%q in %q shares a directory with %q", name, dir, paths[blobDir])
+			paths[blobDir] = dir + name
+		}
+	}
+	uploads, err := getUserUploads("hostile@gmail.com", pkg.Tags{})
+	assert.Nil(t, err)
+	assert.Len(t, uploads, len(dirs)*len(hostileNames))
+}
+
+func TestRejectedFileNames(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "a/b", "../etc", "nul\x00byte"} {
+		assert.NotNil(t, pkg.ValidateFileName(name), "%q must be rejected", name)
+	}
+	for _, name := range hostileNames {
+		assert.Nil(t, pkg.ValidateFileName(name), "%q must be accepted", name)
+	}
+}
+
+func TestUploadTags(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{})
+	assert.Nil(t, createUser("tags@gmail.com", "agent", "password"))
+
+	laptop := uploadPacket("tags@gmail.com", "home", ".bashrc")
+	pkg.EncodeTags(laptop.Meta, "FileTags", pkg.Tags{Labels: []string{"shell"}})
+	pkg.EncodeTags(laptop.Meta, "VersionTags", pkg.Tags{Values: map[string]string{"host": "laptop"}})
+	fromLaptop, err := uploadFile(laptop, "hash1", "sum1")
+	assert.Nil(t, err)
+	desktop := uploadPacket("tags@gmail.com", "home", ".bashrc")
+	pkg.EncodeTags(desktop.Meta, "VersionTags", pkg.Tags{Values: map[string]string{"host": "desktop"}})
+	_, err = uploadFile(desktop, "hash2", "sum2")
+	assert.Nil(t, err)
+	_, err = uploadFile(uploadPacket("tags@gmail.com", "home", ".vimrc"), "hash3", "sum3")
+	assert.Nil(t, err)
+	invalid := uploadPacket("tags@gmail.com", "home", ".vimrc")
+	invalid.Meta["VersionTags"] = `{"values":{"":"empty"}}`
+	_, err = uploadFile(invalid, "hash4", "sum4")
+	assert.NotNil(t, err)
+
+	uploads, err := getUserUploads("tags@gmail.com", pkg.Tags{Values: map[string]string{"host": "laptop"}})
+	assert.Nil(t, err)
+	assert.Len(t, uploads, 1)
+	assert.Equal(t, []string{"shell"}, uploads[0].Tags.Labels)
+	assert.Len(t, uploads[0].Versions, 1)
+	assert.Equal(t, fromLaptop, uploads[0].Versions[0].ID)
+
+	uploads, err = getUserUploads("tags@gmail.com", pkg.Tags{Values: map[string]string{"host": ""}, Labels: []string{"shell"}})
+	assert.Nil(t, err)
+	assert.Len(t, uploads, 1)
+	assert.Len(t, uploads[0].Versions, 2, "a tag without a value matches any value")
+
+	assert.Nil(t, store.SetFileTags(context.Background(), uploads[0].ID, nil, nil))
+	uploads, err = getUserUploads("tags@gmail.com", pkg.Tags{Labels: []string{"shell"}})
+	assert.Nil(t, err)
+	assert.Len(t, uploads, 0)
+	uploads, err = getUserUploads("tags@gmail.com", pkg.Tags{})
+	assert.Nil(t, err)
+	assert.Len(t, uploads, 2)
+}
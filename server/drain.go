@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	drainJobsKey      = "drain-jobs"
+	drainRequestChan  = "drain-requests"
+	decommissionedKey = "decommissioned-storages"
+	DrainMigrating    = "migrating"
+	DrainDeregistered = "deregistered"
+	DrainFailed       = "failed"
+)
+
+// DrainStatus is the progress of retiring one storage, shared in redis so every server can report it
+type DrainStatus struct {
+	StorageId string    `json:"storage_id"`
+	State     string    `json:"state"`
+	Total     int       `json:"total"`
+	Migrated  int       `json:"migrated"`
+	Failed    int       `json:"failed"`
+	Error     string    `json:"error,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type heldVersion struct {
+	email   string
+	file    db.File
+	version db.FileVersion
+}
+
+func saveDrainStatus(redisClient *redis.Client, status DrainStatus) {
+	status.UpdatedAt = time.Now()
+	entry, _ := json.Marshal(status)
+	if err := redisClient.HSet(context.Background(), drainJobsKey, status.StorageId, entry).Err(); err != nil {
+		slog.Error("error saving drain status", "storage", status.StorageId, "err", err.Error())
+	}
+}
+
+func loadDrainStatus(redisClient *redis.Client, storageId string) (*DrainStatus, error) {
+	entry, err := redisClient.HGet(context.Background(), drainJobsKey, storageId).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var status DrainStatus
+	return &status, json.Unmarshal([]byte(entry), &status)
+}
+
+// markDraining stops new placements on a storage, every server picks the flag up from the shared registry
+func markDraining(redisClient *redis.Client, storageId string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	storage, exists := storages[storageId]
+	if !exists {
+		return fmt.Errorf("storage %s not found", storageId)
+	}
+	storage.Draining = true
+	storages[storageId] = storage
+	saveStorage(redisClient, storage)
+	return nil
+}
+
+// activeDrains holds the storages this server is draining
+var activeDrains sync.Map
+
+// drainOnce runs drain in the background unless a drain of the same storage is already running
+func drainOnce(storageId string, drain func()) bool {
+	if _, running := activeDrains.LoadOrStore(storageId, true); running {
+		return false
+	}
+	go func() {
+		defer activeDrains.Delete(storageId)
+		drain()
+	}()
+	return true
+}
+
+// watchDrainRequests lets any server ask the leader to drain a storage. Only the leader marks the
+// storage and migrates its versions, so its view of the registry is the one that is saved.
+func watchDrainRequests(ctx context.Context, redisClient *redis.Client) {
+	requests := db.Subscribe(ctx, redisClient, drainRequestChan)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-requests:
+			storageId := msg.Payload
+			if !drainOnce(storageId, func() { drainStorage(redisClient, storageId) }) {
+				slog.Info("storage is already draining", "storage", storageId)
+			}
+		}
+	}
+}
+
+// versionsHeldBy looks up the versions a storage holds through the storage index
+func versionsHeldBy(storageId string) ([]heldVersion, error) {
+	versions, err := store.VersionsByStorage(context.Background(), storageId)
+	if err != nil {
+		return nil, err
+	}
+	var held []heldVersion
+	for _, version := range versions {
+		file, err := store.GetFile(context.Background(), version.FileID)
+		if err != nil {
+			return nil, err
+		}
+		if file != nil {
+			held = append(held, heldVersion{email: file.Owner, file: *file, version: version})
+		}
+	}
+	return held, nil
+}
+
+// drainStorage moves every version off a storage, verifies the copies and finally deregisters it
+func drainStorage(redisClient *redis.Client, storageId string) {
+	status := DrainStatus{StorageId: storageId, State: DrainMigrating, StartedAt: time.Now()}
+	if err := markDraining(redisClient, storageId); err != nil {
+		status.State, status.Error = DrainFailed, err.Error()
+		saveDrainStatus(redisClient, status)
+		return
+	}
+	held, err := versionsHeldBy(storageId)
+	if err != nil {
+		status.State, status.Error = DrainFailed, err.Error()
+		saveDrainStatus(redisClient, status)
+		return
+	}
+	status.Total = len(held)
+	saveDrainStatus(redisClient, status)
+	for _, item := range held {
+		if err := migrateVersion(storageId, item); err != nil {
+			slog.Error("error migrating version off draining storage", "storage", storageId, "version", item.version.ID, "err", err.Error())
+			status.Failed++
+		} else {
+			status.Migrated++
+		}
+		saveDrainStatus(redisClient, status)
+	}
+	if status.Failed > 0 {
+		status.State, status.Error = DrainFailed, fmt.Sprintf("%d versions could not be migrated", status.Failed)
+		saveDrainStatus(redisClient, status)
+		return
+	}
+	deregisterStorage(redisClient, storageId)
+	status.State = DrainDeregistered
+	saveDrainStatus(redisClient, status)
+	slog.Info("storage decommissioned", "storage", storageId, "versions", status.Migrated)
+}
+
+// migrateVersion copies a version to a storage placement picks, reads the copy back to verify it
+// and swaps the draining storage for the new one in the version's replicas
+func migrateVersion(storageId string, item heldVersion) error {
+	holders := []string{}
+	for _, id := range item.version.Storages {
+		if id != storageId {
+			holders = append(holders, id)
+		}
+	}
+	if len(rankReplicas(holders)) >= replicationFactor() {
+		return replaceVersionStorage(item.email, item.version.ID, storageId, "")
+	}
+	targets, err := placeReplicas(item.version.Hash, 1, holders, []string{storageId})
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return errors.New("no storage can take the version")
+	}
+	uploadPath := versionPath(item.email, item.file, item.version)
+	data, err := readVersion(uploadPath, item.version)
+	if err != nil {
+		return err
+	}
+	if err := copyToStorage(targets[0], uploadPath, item.version.Hash, data); err != nil {
+		return err
+	}
+	return replaceVersionStorage(item.email, item.version.ID, storageId, targets[0].Id)
+}
+
+// deregisterStorage removes a drained storage for good and tells it to stop heartbeating
+func deregisterStorage(redisClient *redis.Client, storageId string) {
+	redisClient.SAdd(context.Background(), decommissionedKey, storageId)
+	mu.Lock()
+	storage, exists := storages[storageId]
+	if exists {
+		removeStorage(redisClient, storageId)
+	}
+	mu.Unlock()
+	if !exists {
+		return
+	}
+	if err := sendDecommission(storage); err != nil {
+		slog.Warn("error notifying decommissioned storage", "storage", storageId, "err", err.Error())
+	}
+	emitMembership(redisClient, MembershipEvent{StorageId: storageId, From: storage.Status, To: pkg.MemberDead, At: time.Now()})
+}
+
+// sendDecommission tells a storage to stop heartbeating, with a ticket proving a server sent it
+func sendDecommission(storage pkg.Storage) error {
+	ticket, err := storageTicket(storage, pkg.Ticket{Operation: pkg.TicketDecommission})
+	if err != nil {
+		return err
+	}
+	tr := pkg.TransferPacket{
+		Command:    "decommission",
+		Meta:       map[string]string{"Ticket": ticket},
+		SenderMeta: pkg.SenderMeta{Application: "server"},
+	}
+	serialized, err := pkg.SerializePacket(&tr)
+	if err != nil {
+		return err
+	}
+	conn, err := pkg.SendDataOverTcp(storage.Port, int64(len(serialized)), serialized)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func isDecommissioned(redisClient *redis.Client, storageId string) bool {
+	decommissioned, _ := redisClient.SIsMember(context.Background(), decommissionedKey, storageId).Result()
+	return decommissioned
+}
@@ -0,0 +1,20 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainOnce(t *testing.T) {
+	release := make(chan struct{})
+	assert.True(t, drainOnce("storage1", func() { <-release }))
+	assert.False(t, drainOnce("storage1", func() { t.Error("a second drain of the storage ran") }), "a storage is drained once at a time")
+	done := make(chan struct{})
+	assert.True(t, drainOnce("storage2", func() { close(done) }), "other storages drain alongside")
+	<-done
+
+	close(release)
+	assert.Eventually(t, func() bool { return drainOnce("storage1", func() {}) }, time.Second, 10*time.Millisecond, "a finished drain can be requested again")
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	gcStatusKey   = "gc-status"
+	gcRequestChan = "gc-requests"
+	// gcGrace is how old a blob has to be before garbage collection deletes it. Blobs reach storages
+	// before their version is recorded, and a version recorded after the referenced blobs were listed
+	// would make its blob look unreferenced.
+	gcGrace = time.Hour
+)
+
+// GCStatus is the outcome of the latest garbage collection of blobs no version refers to
+type GCStatus struct {
+	Running    bool      `json:"running"`
+	Scanned    int       `json:"scanned"`
+	Deleted    int       `json:"deleted"`
+	Failed     int       `json:"failed"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+var collecting sync.Mutex
+
+// watchGCRequests lets any server ask the leader for a garbage collection
+func watchGCRequests(ctx context.Context, redisClient *redis.Client) {
+	requests := db.Subscribe(ctx, redisClient, gcRequestChan)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-requests:
+			if collecting.TryLock() {
+				go func() {
+					defer collecting.Unlock()
+					collectGarbage(redisClient)
+				}()
+			}
+		}
+	}
+}
+
+// referencedBlobs lists the blobs any version refers to, keyed like storage inventories
+func referencedBlobs() (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	err := forEachVersion(func(email string, file db.File, version db.FileVersion) {
+		referenced[path.Join(versionPath(email, file, version), version.Hash)] = true
+	})
+	return referenced, err
+}
+
+func fetchInventory(storage pkg.Storage) ([]string, error) {
+	ticket, err := storageTicket(storage, pkg.Ticket{Operation: pkg.TicketInventory})
+	if err != nil {
+		return nil, err
+	}
+	packet, err := requestStorage(storage, pkg.TransferPacket{
+		Command:    "inventory",
+		Meta:       map[string]string{"Ticket": ticket},
+		SenderMeta: pkg.SenderMeta{Application: "server"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if packet.Meta["Error"] != "" {
+		return nil, errors.New(packet.Meta["Error"])
+	}
+	var blobs []string
+	return blobs, json.Unmarshal(packet.Compressed, &blobs)
+}
+
+// collectable tells whether garbage collection may delete a blob: nothing refers to it, and it was
+// named before cutoff so its upload cannot still be on the way to being recorded
+func collectable(blob string, referenced map[string]bool, cutoff time.Time) bool {
+	if referenced[blob] {
+		return false
+	}
+	createdAt, known := blobCreatedAt(blob)
+	return !known || createdAt.Before(cutoff)
+}
+
+// collectGarbage deletes blobs that no version or pending direct upload refers to from every
+// storage. Blobs newer than gcGrace are left for a later run, their versions may be recorded
+// after the references were listed.
+func collectGarbage(redisClient *redis.Client) {
+	status := GCStatus{Running: true, StartedAt: time.Now()}
+	cutoff := status.StartedAt.Add(-gcGrace)
+	saveGCStatus(redisClient, status)
+	referenced, err := referencedBlobs()
+	if err == nil {
+		err = pendingBlobs(redisClient, referenced)
+	}
+	if err != nil {
+		slog.Error("error listing referenced blobs", "err", err.Error())
+		status.Running = false
+		saveGCStatus(redisClient, status)
+		return
+	}
+	mu.Lock()
+	nodes := make([]pkg.Storage, 0, len(storages))
+	for _, storage := range storages {
+		nodes = append(nodes, storage)
+	}
+	mu.Unlock()
+	for _, storage := range nodes {
+		blobs, err := fetchInventory(storage)
+		if err != nil {
+			slog.Error("error fetching storage inventory", "storage", storage.Id, "err", err.Error())
+			status.Failed++
+			continue
+		}
+		for _, blob := range blobs {
+			status.Scanned++
+			if !collectable(blob, referenced, cutoff) {
+				continue
+			}
+			if err := deleteFromStorage(storage, path.Dir(blob), path.Base(blob)); err != nil {
+				slog.Error("error deleting unreferenced blob", "storage", storage.Id, "blob", blob, "err", err.Error())
+				status.Failed++
+				continue
+			}
+			status.Deleted++
+		}
+		saveGCStatus(redisClient, status)
+	}
+	status.Running = false
+	status.FinishedAt = time.Now()
+	saveGCStatus(redisClient, status)
+	slog.Info("garbage collection finished", "scanned", status.Scanned, "deleted", status.Deleted, "failed", status.Failed)
+}
+
+func saveGCStatus(redisClient *redis.Client, status GCStatus) {
+	entry, _ := json.Marshal(status)
+	if err := redisClient.Set(context.Background(), gcStatusKey, entry, 0).Err(); err != nil {
+		slog.Error("error saving gc status", "err", err.Error())
+	}
+}
+
+func loadGCStatus(redisClient *redis.Client) (GCStatus, error) {
+	var status GCStatus
+	entry, err := redisClient.Get(context.Background(), gcStatusKey).Result()
+	if err == redis.Nil {
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+	return status, json.Unmarshal([]byte(entry), &status)
+}
@@ -0,0 +1,19 @@
+package server
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectable(t *testing.T) {
+	referenced := map[string]bool{"owner/dir/20200101000000_ref": true}
+	cutoff := time.Now().Add(-gcGrace)
+
+	assert.False(t, collectable("owner/dir/20200101000000_ref", referenced, cutoff))
+	assert.True(t, collectable("owner/dir/20200101000000_old", referenced, cutoff))
+	assert.False(t, collectable(path.Join("owner/dir", blobHash()), referenced, cutoff), "blobs of uploads that may not be recorded yet are kept")
+	assert.True(t, collectable("owner/dir/legacyhash", referenced, cutoff), "blobs without a time are judged by references alone")
+}
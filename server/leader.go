@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	leaderKey  = "server-leader"
+	serversKey = "cluster-servers"
+)
+
+var leading atomic.Bool
+
+// renewLeadership extends the leader lease only while it is still held by this server
+var renewLeadership = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+func isLeader() bool {
+	return leading.Load()
+}
+
+func leaderLease() time.Duration {
+	if cfg.LeaderLeaseTimeout <= 0 {
+		return 15 * time.Second
+	}
+	return time.Duration(cfg.LeaderLeaseTimeout) * time.Second
+}
+
+// campaign competes for the leader lock in redis, every server serves clients but only the
+// leader runs leaderTasks, which get a context that is canceled as soon as leadership is lost
+func campaign(serverId string, redisClient *redis.Client, leaderTasks func(ctx context.Context)) {
+	lease := leaderLease()
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	var cancel context.CancelFunc
+	for {
+		redisClient.ZAdd(context.Background(), serversKey, redis.Z{Score: float64(time.Now().Unix()), Member: serverId})
+		held := false
+		if isLeader() {
+			renewed, err := renewLeadership.Run(context.Background(), redisClient, []string{leaderKey}, serverId, lease.Milliseconds()).Int()
+			held = err == nil && renewed == 1
+		} else {
+			acquired, err := redisClient.SetNX(context.Background(), leaderKey, serverId, lease).Result()
+			held = err == nil && acquired
+		}
+		if held && !isLeader() {
+			slog.Info("server became leader", "server", serverId)
+			leading.Store(true)
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			leaderTasks(ctx)
+		} else if !held && isLeader() {
+			slog.Warn("server lost leadership", "server", serverId)
+			leading.Store(false)
+			cancel()
+		}
+		<-ticker.C
+	}
+}
+
+// activeServers lists the servers that took part in the election within the last lease
+func activeServers(redisClient *redis.Client) ([]string, error) {
+	since := time.Now().Add(-leaderLease()).Unix()
+	return redisClient.ZRangeByScore(context.Background(), serversKey, &redis.ZRangeBy{
+		Min: strconv.FormatInt(since, 10),
+		Max: "+inf",
+	}).Result()
+}
+
+func currentLeader(redisClient *redis.Client) (string, error) {
+	leader, err := redisClient.Get(context.Background(), leaderKey).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return leader, err
+}
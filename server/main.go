@@ -1,6 +1,7 @@
 package server
 
 import (
+	"fmt"
 	"log/slog"
 
 	"github.com/google/uuid"
@@ -10,14 +11,33 @@ import (
 
 var cfg *pkg.ServerConfig
 
-func InitServer() {
+// openMetadata loads the server config and opens the metadata store it names
+func openMetadata() error {
 	config, err := pkg.GetServerConfig()
 	if err != nil {
-		slog.Error("Error getting server config", "err", err.Error())
+		return fmt.Errorf("getting server config: %w", err)
 	}
 	cfg = config
+	redisClient = db.NewRedisClient(cfg.RedisAddr)
+	metadata, err := db.NewMetadataStore(db.StoreOptions{Kind: cfg.MetadataStore, Path: cfg.MetadataPath, RedisAddr: cfg.RedisAddr})
+	if err != nil {
+		return fmt.Errorf("opening metadata store: %w", err)
+	}
+	store = metadata
+	return nil
+}
+
+func InitServer() {
+	if err := openMetadata(); err != nil {
+		slog.Error("Error starting server", "err", err.Error())
+		return
+	}
 	id, _ := uuid.NewUUID()
-	redisClient := db.NewRedisClient()
+	currentServerId = id.String()
+	if err := migrateMetadata(cfg.MigrationDryRun); err != nil {
+		slog.Error("Error migrating metadata", "err", err.Error())
+		return
+	}
 	go func() {
 		if err := InitStorageService(id.String(), redisClient); err != nil {
 			slog.Error("Error init storage controller", "err", err.Error())
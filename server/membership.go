@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	heartbeatChannel  = "storage-heartbeat"
+	membershipChannel = "membership-events"
+	storagesKey       = "cluster-storages"
+	storageIndexKey   = "storage-index"
+)
+
+// MembershipEvent describes a storage moving from one membership state to another,
+// From is empty when a storage joins and To is dead when it leaves
+type MembershipEvent struct {
+	StorageId string    `json:"storage_id"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	At        time.Time `json:"at"`
+}
+
+var membershipListeners []func(MembershipEvent)
+var listenersMu sync.Mutex
+
+// onMembershipChange registers a listener called for every membership transition
+func onMembershipChange(listener func(MembershipEvent)) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	membershipListeners = append(membershipListeners, listener)
+}
+
+func emitMembership(redisClient *redis.Client, event MembershipEvent) {
+	slog.Info("storage membership changed", "storage", event.StorageId, "from", event.From, "to", event.To)
+	listenersMu.Lock()
+	listeners := append([]func(MembershipEvent){}, membershipListeners...)
+	listenersMu.Unlock()
+	for _, listener := range listeners {
+		go listener(event)
+	}
+	payload, _ := json.Marshal(event)
+	if err := redisClient.Publish(context.Background(), membershipChannel, payload).Err(); err != nil {
+		slog.Error("error publishing membership event", "err", err.Error())
+	}
+}
+
+// memberState derives the membership state of a storage from the age of its last heartbeat
+func memberState(lastSeen, now time.Time) string {
+	since := now.Sub(lastSeen)
+	switch {
+	case since > time.Duration(cfg.DeadTimeout)*time.Second:
+		return pkg.MemberDead
+	case since > time.Duration(cfg.SuspectTimeout)*time.Second:
+		return pkg.MemberSuspect
+	default:
+		return pkg.MemberAlive
+	}
+}
+
+// registerStorage adds a storage to the membership with the next cluster wide index, callers must hold mu
+func registerStorage(redisClient *redis.Client, storageId string, port int, labels map[string]string) pkg.Storage {
+	index, err := redisClient.Incr(context.Background(), storageIndexKey).Result()
+	if err != nil {
+		slog.Error("error assigning storage index", "err", err.Error())
+		index = int64(len(storages) + 1)
+	}
+	storage := pkg.Storage{
+		Id:         storageId,
+		Index:      int(index),
+		LastUpdate: time.Now(),
+		Port:       port,
+		Status:     pkg.MemberAlive,
+		Labels:     labels,
+	}
+	storages[storageId] = storage
+	saveStorage(redisClient, storage)
+	return storage
+}
+
+func saveStorage(redisClient *redis.Client, storage pkg.Storage) {
+	entry, _ := json.Marshal(storage)
+	if err := redisClient.HSet(context.Background(), storagesKey, storage.Id, entry).Err(); err != nil {
+		slog.Error("error saving storage", "storage", storage.Id, "err", err.Error())
+	}
+}
+
+// removeStorage drops a storage from the membership, callers must hold mu
+func removeStorage(redisClient *redis.Client, storageId string) {
+	if err := redisClient.HDel(context.Background(), storagesKey, storageId).Err(); err != nil {
+		slog.Error("error removing storage", "err", err.Error())
+	}
+	delete(storages, storageId)
+}
+
+// syncStorages replaces the local registry with the shared one, keeping leases this server already tracks
+func syncStorages(redisClient *redis.Client) {
+	shared := loadStoragesFromRedis(redisClient)
+	mu.Lock()
+	defer mu.Unlock()
+	for id, storage := range shared {
+		if local, exists := storages[id]; exists {
+			storage.LastUpdate = local.LastUpdate
+			storage.UsedBytes = local.UsedBytes
+			shared[id] = storage
+		}
+	}
+	storages = shared
+}
+
+// followCluster keeps the registry of followers in line with the leader's decisions
+func followCluster(redisClient *redis.Client) {
+	ticker := time.NewTicker(time.Duration(cfg.MembershipSweepInterval) * time.Second)
+	defer ticker.Stop()
+	events := db.Subscribe(context.Background(), redisClient, membershipChannel)
+	for {
+		select {
+		case <-events:
+		case <-ticker.C:
+		}
+		if !isLeader() {
+			syncStorages(redisClient)
+		}
+	}
+}
+
+// receiveHeartbeats renews the lease of every storage that reports in, storages that were
+// already dropped rejoin the membership with their next heartbeat once the leader sees it
+func receiveHeartbeats(redisClient *redis.Client) {
+	for msg := range db.Subscribe(context.Background(), redisClient, heartbeatChannel) {
+		var heartbeat pkg.Heartbeat
+		if err := json.Unmarshal([]byte(msg.Payload), &heartbeat); err != nil {
+			slog.Error("invalid heartbeat", "err", err.Error())
+			continue
+		}
+		if event, changed := renewLease(redisClient, heartbeat, time.Now()); changed {
+			emitMembership(redisClient, event)
+		}
+	}
+}
+
+func renewLease(redisClient *redis.Client, heartbeat pkg.Heartbeat, now time.Time) (MembershipEvent, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	storage, exists := storages[heartbeat.Id]
+	if !exists {
+		if !isLeader() || isDecommissioned(redisClient, heartbeat.Id) {
+			return MembershipEvent{}, false
+		}
+		registerStorage(redisClient, heartbeat.Id, heartbeat.Port, heartbeat.Labels)
+		return MembershipEvent{StorageId: heartbeat.Id, To: pkg.MemberAlive, At: now}, true
+	}
+	previous := storage.Status
+	storage.LastUpdate = now
+	storage.Status = pkg.MemberAlive
+	storage.UsedBytes = heartbeat.UsedBytes
+	storages[heartbeat.Id] = storage
+	if previous == pkg.MemberAlive || !isLeader() {
+		return MembershipEvent{}, false
+	}
+	saveStorage(redisClient, storage)
+	return MembershipEvent{StorageId: heartbeat.Id, From: previous, To: pkg.MemberAlive, At: now}, true
+}
+
+// sweepMembership expires leases until ctx is done, it only runs on the leader
+func sweepMembership(ctx context.Context, redisClient *redis.Client) {
+	ticker := time.NewTicker(time.Duration(cfg.MembershipSweepInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, event := range expireLeases(redisClient, now) {
+				emitMembership(redisClient, event)
+			}
+		}
+	}
+}
+
+// expireLeases moves storages whose heartbeats stopped to suspect and then dead, dead ones leave the membership
+func expireLeases(redisClient *redis.Client, now time.Time) []MembershipEvent {
+	mu.Lock()
+	defer mu.Unlock()
+	var events []MembershipEvent
+	for id, storage := range storages {
+		state := memberState(storage.LastUpdate, now)
+		if state == storage.Status {
+			continue
+		}
+		events = append(events, MembershipEvent{StorageId: id, From: storage.Status, To: state, At: now})
+		if state == pkg.MemberDead {
+			removeStorage(redisClient, id)
+			continue
+		}
+		storage.Status = state
+		storages[id] = storage
+		saveStorage(redisClient, storage)
+	}
+	return events
+}
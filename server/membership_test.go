@@ -0,0 +1,44 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemberState(t *testing.T) {
+	cfg = &pkg.ServerConfig{SuspectTimeout: 15, DeadTimeout: 60}
+	now := time.Now()
+	assert.Equal(t, pkg.MemberAlive, memberState(now.Add(-5*time.Second), now))
+	assert.Equal(t, pkg.MemberSuspect, memberState(now.Add(-20*time.Second), now))
+	assert.Equal(t, pkg.MemberDead, memberState(now.Add(-2*time.Minute), now))
+}
+
+func TestLeaseLifecycle(t *testing.T) {
+	cfg = &pkg.ServerConfig{SuspectTimeout: 15, DeadTimeout: 60}
+	redisClient := db.NewRedisClient("")
+	storages = make(map[string]pkg.Storage)
+	leading.Store(true)
+	defer leading.Store(false)
+	now := time.Now()
+
+	event, changed := renewLease(redisClient, pkg.Heartbeat{Id: "storage1", Port: 9001}, now)
+	assert.True(t, changed)
+	assert.Equal(t, MembershipEvent{StorageId: "storage1", To: pkg.MemberAlive, At: now}, event)
+
+	_, changed = renewLease(redisClient, pkg.Heartbeat{Id: "storage1", Port: 9001, UsedBytes: 42}, now)
+	assert.False(t, changed)
+	assert.Equal(t, int64(42), storages["storage1"].UsedBytes)
+
+	events := expireLeases(redisClient, now.Add(20*time.Second))
+	assert.Equal(t, []MembershipEvent{{StorageId: "storage1", From: pkg.MemberAlive, To: pkg.MemberSuspect, At: now.Add(20 * time.Second)}}, events)
+	assert.Empty(t, expireLeases(redisClient, now.Add(30*time.Second)))
+
+	events = expireLeases(redisClient, now.Add(2*time.Minute))
+	assert.Len(t, events, 1)
+	assert.Equal(t, pkg.MemberDead, events[0].To)
+	assert.NotContains(t, storages, "storage1")
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	migrationLockKey = "migration-lock"
+	migrationLockTTL = 10 * time.Minute
+)
+
+// migrations upgrade metadata written by older servers, the last one is at db.SchemaVersion
+var migrations = []db.Migration{
+	{Version: 1, Description: "move files out of user documents", Up: splitUserFiles},
+	{Version: 2, Description: "repair upload times of files", Up: repairUploadTimes},
+	{Version: 3, Description: "record blob directories and agents of versions", Up: backfillVersions},
+}
+
+func recordString(record map[string]any, key string) string {
+	value, _ := record[key].(string)
+	return value
+}
+
+// splitUserFiles turns the files users kept in their own document into file and version records.
+// A file uploaded at the same path after the split takes over the versions of the embedded one.
+func splitUserFiles(ctx context.Context, m *db.Migrator) error {
+	fileIds := make(map[string]string) // owner and path key to file id
+	ids, err := m.IDs(ctx, db.KindFile)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		file, err := m.Get(ctx, db.KindFile, id)
+		if err != nil {
+			return err
+		}
+		owner, key := recordString(file, "owner"), db.PathKey(recordString(file, "path"), recordString(file, "name"))
+		fileIds[db.PathKey(owner, key)] = id
+	}
+	return m.Each(ctx, db.KindUser, 1, func(email string, user map[string]any) error {
+		embedded, _ := user["files"].([]any)
+		for _, entry := range embedded {
+			file, ok := entry.(map[string]any)
+			if !ok {
+				continue
+			}
+			pathKey := db.PathKey(email, db.PathKey(recordString(file, "path"), recordString(file, "name")))
+			fileId, exists := fileIds[pathKey]
+			if !exists {
+				fileId = recordString(file, "id")
+				record := maps.Clone(file)
+				delete(record, "versions")
+				record["owner"], record["schema_version"] = email, 1
+				if err := m.Put(ctx, db.KindFile, fileId, record); err != nil {
+					return err
+				}
+				fileIds[pathKey] = fileId
+			}
+			versions, _ := file["versions"].([]any)
+			parent := ""
+			for _, entry := range versions {
+				version, ok := entry.(map[string]any)
+				if !ok {
+					continue
+				}
+				version["file_id"], version["parent"], version["schema_version"] = fileId, parent, 1
+				if err := m.Put(ctx, db.KindVersion, recordString(version, "id"), version); err != nil {
+					return err
+				}
+				parent = recordString(version, "id")
+			}
+		}
+		delete(user, "files")
+		return nil
+	})
+}
+
+// repairUploadTimes replaces upload times that were lost to a wrong time layout with the
+// creation time of the file's first version
+func repairUploadTimes(ctx context.Context, m *db.Migrator) error {
+	firstCreated := make(map[string]string)
+	ids, err := m.IDs(ctx, db.KindVersion)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		version, err := m.Get(ctx, db.KindVersion, id)
+		if err != nil {
+			return err
+		}
+		fileId, created := recordString(version, "file_id"), recordString(version, "created_at")
+		if first, seen := firstCreated[fileId]; !seen || created < first {
+			firstCreated[fileId] = created
+		}
+	}
+	return m.Each(ctx, db.KindFile, 2, func(id string, file map[string]any) error {
+		uploadedAt, err := time.Parse(time.RFC3339, recordString(file, "uploaded_at"))
+		if err == nil && uploadedAt.Year() > 1 {
+			return nil
+		}
+		if created, exists := firstCreated[id]; exists {
+			file["uploaded_at"] = created
+		}
+		return nil
+	})
+}
+
+// backfillVersions records where the blobs of versions from before blob directories were kept, and
+// who uploaded them as far as their file knows, then stamps every remaining record
+func backfillVersions(ctx context.Context, m *db.Migrator) error {
+	err := m.Each(ctx, db.KindVersion, 3, func(id string, version map[string]any) error {
+		file, err := m.Get(ctx, db.KindFile, recordString(version, "file_id"))
+		if err != nil || file == nil {
+			return err
+		}
+		if recordString(version, "blob_dir") == "" {
+			version["blob_dir"] = legacyStoragePath(recordString(file, "owner"), recordString(file, "path"), recordString(file, "name"))
+		}
+		if recordString(version, "uploaded_by") == "" {
+			version["uploaded_by"] = recordString(file, "uploaded_by")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, kind := range []string{db.KindUser, db.KindFile} {
+		if err := m.Each(ctx, kind, 3, func(string, map[string]any) error { return nil }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateMetadata brings the metadata store up to this server's schema. Servers sharing a redis
+// store take turns, the ones waiting find nothing left to do.
+func migrateMetadata(dryRun bool) error {
+	ctx := context.Background()
+	if _, shared := store.(*db.RedisStore); shared && !dryRun {
+		for {
+			acquired, err := redisClient.SetNX(ctx, migrationLockKey, currentServerId, migrationLockTTL).Result()
+			if err != nil {
+				return err
+			}
+			if acquired {
+				break
+			}
+			slog.Info("waiting for another server to migrate metadata")
+			time.Sleep(time.Second)
+		}
+		defer redisClient.Del(ctx, migrationLockKey)
+	}
+	run, err := db.Migrate(ctx, store, migrations, dryRun)
+	if err != nil {
+		return err
+	}
+	for _, applied := range run.Applied {
+		slog.Info("metadata migration", "migration", applied, "dry_run", dryRun)
+	}
+	if len(run.Applied) > 0 {
+		slog.Info("metadata migrated", "from", run.From, "to", run.To, "changes", len(run.Changes), "dry_run", dryRun)
+	}
+	return nil
+}
+
+// MigrationStatus tells how far the metadata store is behind this server
+type MigrationStatus struct {
+	SchemaVersion int              `json:"schema_version"`
+	Latest        int              `json:"latest"`
+	Pending       []string         `json:"pending"`
+	LastRun       *db.MigrationRun `json:"last_run"`
+}
+
+func migrationStatus(c echo.Context) error {
+	ctx := c.Request().Context()
+	status := MigrationStatus{Latest: db.SchemaVersion, Pending: []string{}}
+	var err error
+	if status.SchemaVersion, err = store.StoredSchemaVersion(ctx); err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	for _, migration := range migrations {
+		if migration.Version > status.SchemaVersion {
+			status.Pending = append(status.Pending, migration.Description)
+		}
+	}
+	if status.LastRun, err = store.LoadMigrationRun(ctx); err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(200, status)
+}
+
+// runMigrations applies pending migrations, or with dry_run=true lists the changes they would make
+func runMigrations(c echo.Context) error {
+	if c.QueryParam("dry_run") == "true" {
+		run, err := db.Migrate(c.Request().Context(), store, migrations, true)
+		if err != nil {
+			return c.JSON(500, map[string]interface{}{
+				"message": err.Error(),
+			})
+		}
+		return c.JSON(200, run)
+	}
+	if err := migrateMetadata(false); err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	return migrationStatus(c)
+}
+
+func rollbackMigrations(c echo.Context) error {
+	run, err := db.Rollback(c.Request().Context(), store)
+	if err != nil {
+		return c.JSON(409, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(200, map[string]interface{}{"message": "migration run rolled back", "schema_version": run.From})
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+// legacyRecords keeps raw documents as JSON the way redis did, so users can still embed their files
+type legacyRecords struct {
+	records map[string]map[string]map[string]any
+	schema  int
+	run     *db.MigrationRun
+}
+
+func (l *legacyRecords) RecordIDs(ctx context.Context, kind string) ([]string, error) {
+	ids := []string{}
+	for id := range l.records[kind] {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func jsonCopy(record map[string]any) map[string]any {
+	if record == nil {
+		return nil
+	}
+	data, _ := json.Marshal(record)
+	var copied map[string]any
+	json.Unmarshal(data, &copied)
+	return copied
+}
+
+func (l *legacyRecords) GetRecord(ctx context.Context, kind, id string) (map[string]any, error) {
+	return jsonCopy(l.records[kind][id]), nil
+}
+
+func (l *legacyRecords) PutRecord(ctx context.Context, kind, id string, record map[string]any) error {
+	if l.records[kind] == nil {
+		l.records[kind] = make(map[string]map[string]any)
+	}
+	l.records[kind][id] = jsonCopy(record)
+	return nil
+}
+
+func (l *legacyRecords) DeleteRecord(ctx context.Context, kind, id string) error {
+	delete(l.records[kind], id)
+	return nil
+}
+
+func (l *legacyRecords) StoredSchemaVersion(ctx context.Context) (int, error) {
+	return l.schema, nil
+}
+
+func (l *legacyRecords) SetStoredSchemaVersion(ctx context.Context, version int) error {
+	l.schema = version
+	return nil
+}
+
+func (l *legacyRecords) LoadMigrationRun(ctx context.Context) (*db.MigrationRun, error) {
+	return l.run, nil
+}
+
+func (l *legacyRecords) SaveMigrationRun(ctx context.Context, run *db.MigrationRun) error {
+	l.run = run
+	return nil
+}
+
+func TestMigrations(t *testing.T) {
+	assert.Equal(t, db.SchemaVersion, migrations[len(migrations)-1].Version)
+	ctx := context.Background()
+	records := &legacyRecords{records: map[string]map[string]map[string]any{
+		db.KindUser: {"legacy@gmail.com": {
+			"email": "legacy@gmail.com",
+			"files": []any{map[string]any{
+				"id": "bashrc", "name": ".bashrc", "path": "home/", "uploaded_at": "0001-01-01T00:00:00Z", "uploaded_by": "laptop",
+				"versions": []any{
+					map[string]any{"id": "first", "created_at": "2024-03-01T10:00:00Z"},
+					map[string]any{"id": "second", "created_at": "2024-03-02T10:00:00Z"},
+				},
+			}},
+		}},
+		db.KindFile: {"current": {"id": "current", "owner": "legacy@gmail.com", "name": "notes.txt", "path": "", "uploaded_at": "2024-03-03T10:00:00Z", "schema_version": float64(db.SchemaVersion)}},
+	}}
+
+	dry, err := db.Migrate(ctx, records, migrations, true)
+	assert.Nil(t, err)
+	assert.Equal(t, db.SchemaVersion, dry.To)
+	assert.NotEmpty(t, dry.Changes)
+	assert.Equal(t, 0, records.schema)
+	assert.Nil(t, records.records[db.KindVersion], "a dry run writes nothing")
+
+	run, err := db.Migrate(ctx, records, migrations, false)
+	assert.Nil(t, err)
+	assert.Len(t, run.Applied, len(migrations))
+	user := records.records[db.KindUser]["legacy@gmail.com"]
+	assert.NotContains(t, user, "files")
+	assert.Equal(t, db.SchemaVersion, db.RecordSchemaVersion(user))
+	file := records.records[db.KindFile]["bashrc"]
+	assert.Equal(t, "legacy@gmail.com", file["owner"])
+	assert.NotContains(t, file, "versions")
+	assert.Equal(t, "2024-03-01T10:00:00Z", file["uploaded_at"], "a lost upload time becomes the first version's creation time")
+	assert.Equal(t, db.SchemaVersion, db.RecordSchemaVersion(file))
+	assert.Equal(t, "2024-03-03T10:00:00Z", records.records[db.KindFile]["current"]["uploaded_at"])
+	second := records.records[db.KindVersion]["second"]
+	assert.Equal(t, "bashrc", second["file_id"])
+	assert.Equal(t, "first", second["parent"])
+	assert.Equal(t, legacyStoragePath("legacy@gmail.com", "home/", ".bashrc"), second["blob_dir"])
+	assert.Equal(t, "laptop", second["uploaded_by"])
+	assert.Equal(t, db.SchemaVersion, db.RecordSchemaVersion(second))
+
+	again, err := db.Migrate(ctx, records, migrations, false)
+	assert.Nil(t, err)
+	assert.Empty(t, again.Applied)
+
+	_, err = db.Rollback(ctx, records)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, records.schema)
+	assert.Contains(t, records.records[db.KindUser]["legacy@gmail.com"], "files")
+	assert.Empty(t, records.records[db.KindVersion])
+	assert.NotContains(t, records.records[db.KindFile], "bashrc")
+}
+
+func TestMigrateNewStore(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{})
+	assert.Nil(t, createUser("fresh@gmail.com", "agent", "password"))
+	_, err := uploadFile(uploadPacket("fresh@gmail.com", "home/", ".bashrc"), blobHash(), "sum")
+	assert.Nil(t, err)
+
+	assert.Nil(t, migrateMetadata(false))
+	version, _ := store.StoredSchemaVersion(context.Background())
+	assert.Equal(t, db.SchemaVersion, version)
+	response, _ := searchVersions("fresh@gmail.com", db.VersionQuery{Limit: 1})
+	assert.Len(t, response.Results, 1)
+	assert.NotEqual(t, "0001-01-01T00:00:00Z", response.Results[0].UploadedAt, "uploads record when they happened")
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const resetTokenTTL = time.Hour
+
+var (
+	errInvalidCredentials = errors.New("invalid email or password")
+	errEmailTaken         = errors.New("email already registered")
+	errWeakPassword       = errors.New("weak password")
+	errInvalidResetToken  = errors.New("invalid or expired reset token")
+)
+
+// dummyHash is compared against when a user does not exist, so logins take as long whether it does or not
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// checkPassword tells whether password is the one of email, false for users that do not exist
+func checkPassword(email, password string) (bool, error) {
+	user, err := findUser(email)
+	if err != nil {
+		return false, err
+	}
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false, nil
+	}
+	return bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil, nil
+}
+
+// register creates a user with agent as their first agent and logs the agent in
+func register(email, agent, password string) (*pkg.InvokeResponse, error) {
+	if err := pkg.ValidatePassword(password, email); err != nil {
+		return nil, fmt.Errorf("%w: %s", errWeakPassword, err.Error())
+	}
+	if user, err := findUser(email); err != nil {
+		return nil, err
+	} else if user != nil {
+		return nil, errEmailTaken
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	if err := createUser(email, agent, hash); err != nil {
+		return nil, err
+	}
+	return issueTokens(email, agent)
+}
+
+// login checks the password of a user and issues tokens to agent, adding it to the user's agents if it is new
+func login(email, agent, password string) (*pkg.InvokeResponse, error) {
+	valid, err := checkPassword(email, password)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, errInvalidCredentials
+	}
+	if err := updateAgents(email, agent); err != nil {
+		return nil, err
+	}
+	return issueTokens(email, agent)
+}
+
+// changePassword replaces the password of a user who knows the current one. Every other agent of
+// the user has to log in again.
+func changePassword(email, agent, oldPassword, newPassword string) error {
+	valid, err := checkPassword(email, oldPassword)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errInvalidCredentials
+	}
+	if err := pkg.ValidatePassword(newPassword, email); err != nil {
+		return fmt.Errorf("%w: %s", errWeakPassword, err.Error())
+	}
+	hash, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	if err := store.SetPassword(context.Background(), email, hash); err != nil {
+		return err
+	}
+	return revokeOtherAgents(email, agent)
+}
+
+// issueResetToken gives a user a token to set a new password with, replacing any they had
+func issueResetToken(email string, now time.Time) (*pkg.ResetTokenResponse, error) {
+	user, err := findUser(email)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("user %s not found", email)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(secret)
+	expiresAt := now.Add(resetTokenTTL).Format(time.RFC3339)
+	if err := store.SetResetToken(context.Background(), email, refreshDigest(token), expiresAt); err != nil {
+		return nil, err
+	}
+	return &pkg.ResetTokenResponse{Token: token, ExpiresAt: expiresAt}, nil
+}
+
+// resetPassword sets a new password for a user holding a reset token, the token works once: it is
+// consumed in the store before the password is set, so of two resets racing one fails. Every agent of
+// the user has to log in again.
+func resetPassword(email, token, newPassword string, now time.Time) error {
+	user, err := findUser(email)
+	if err != nil {
+		return err
+	}
+	if user == nil || user.ResetToken == "" || subtle.ConstantTimeCompare([]byte(user.ResetToken), []byte(refreshDigest(token))) != 1 {
+		return errInvalidResetToken
+	}
+	if expiresAt, err := time.Parse(time.RFC3339, user.ResetExpiresAt); err != nil || now.After(expiresAt) {
+		return errInvalidResetToken
+	}
+	if err := pkg.ValidatePassword(newPassword, email); err != nil {
+		return fmt.Errorf("%w: %s", errWeakPassword, err.Error())
+	}
+	err = store.ConsumeResetToken(context.Background(), email, refreshDigest(token))
+	if errors.Is(err, db.ErrConflict) || errors.Is(err, db.ErrNotFound) {
+		return errInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+	hash, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	if err := store.SetPassword(context.Background(), email, hash); err != nil {
+		return err
+	}
+	return revokeOtherAgents(email, "")
+}
+
+// authError answers a failed authentication request with the status its error calls for
+func authError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, errWeakPassword):
+		return c.JSON(400, map[string]interface{}{"message": err.Error()})
+	case errors.Is(err, errInvalidCredentials), errors.Is(err, errInvalidResetToken):
+		return c.JSON(401, map[string]interface{}{"message": err.Error()})
+	case errors.Is(err, errEmailTaken):
+		return c.JSON(409, map[string]interface{}{"message": err.Error()})
+	}
+	return c.JSON(500, map[string]interface{}{
+		"message": "internal server error",
+	})
+}
+
+func bindAuthBody(c echo.Context, body any) error {
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+	return c.Validate(body)
+}
+
+func registerView(c echo.Context) error {
+	var body pkg.InvokeBody
+	if err := bindAuthBody(c, &body); err != nil {
+		return c.JSON(400, map[string]interface{}{
+			"message": "invalid request",
+		})
+	}
+	c.Set(auditActorKey, body.Email)
+	tokens, err := register(body.Email, c.Request().Header.Get("User-Agent"), body.Password)
+	if err != nil {
+		return authError(c, err)
+	}
+	return c.JSON(200, tokens)
+}
+
+func loginView(c echo.Context) error {
+	var body pkg.InvokeBody
+	if err := bindAuthBody(c, &body); err != nil {
+		return c.JSON(400, map[string]interface{}{
+			"message": "invalid request",
+		})
+	}
+	c.Set(auditActorKey, body.Email)
+	tokens, err := login(body.Email, c.Request().Header.Get("User-Agent"), body.Password)
+	if err != nil {
+		return authError(c, err)
+	}
+	return c.JSON(200, tokens)
+}
+
+func changePasswordView(c echo.Context) error {
+	token := c.Request().Header.Get("Authorization")
+	email, err := validateToken(token)
+	if err != nil {
+		return c.JSON(401, map[string]interface{}{
+			"message": fmt.Sprintf("invalid token %s", err.Error()),
+		})
+	}
+	var body pkg.PasswordChangeBody
+	if err := bindAuthBody(c, &body); err != nil {
+		return c.JSON(400, map[string]interface{}{
+			"message": "invalid request",
+		})
+	}
+	claims, _ := pkg.DecodeToken(token)
+	agent, _ := claims["agent"].(string)
+	if err := changePassword(email, agent, body.OldPassword, body.NewPassword); err != nil {
+		return authError(c, err)
+	}
+	return c.JSON(200, map[string]interface{}{"message": "password changed"})
+}
+
+// resetTokenView lets an admin issue a reset token for a user, to hand to them out of band
+func resetTokenView(c echo.Context) error {
+	reset, err := issueResetToken(c.Param("email"), time.Now())
+	if err != nil {
+		return c.JSON(404, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(200, reset)
+}
+
+func resetPasswordView(c echo.Context) error {
+	var body pkg.PasswordResetBody
+	if err := bindAuthBody(c, &body); err != nil {
+		return c.JSON(400, map[string]interface{}{
+			"message": "invalid request",
+		})
+	}
+	c.Set(auditActorKey, body.Email)
+	if err := resetPassword(body.Email, body.Token, body.NewPassword, time.Now()); err != nil {
+		return authError(c, err)
+	}
+	return c.JSON(200, map[string]interface{}{"message": "password reset"})
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterAndLogin(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{})
+
+	_, err := register("login@gmail.com", "laptop", "password")
+	assert.True(t, errors.Is(err, errWeakPassword))
+	laptop, err := register("login@gmail.com", "laptop", "Correct-Horse-7")
+	assert.Nil(t, err)
+	_, err = validateToken(laptop.Token)
+	assert.Nil(t, err)
+	_, err = register("login@gmail.com", "laptop", "Correct-Horse-7")
+	assert.True(t, errors.Is(err, errEmailTaken))
+	user, _ := findUser("login@gmail.com")
+	assert.NotEqual(t, "Correct-Horse-7", user.Password, "passwords are stored hashed")
+
+	_, err = login("login@gmail.com", "desktop", "Wrong-Horse-7")
+	assert.True(t, errors.Is(err, errInvalidCredentials))
+	_, err = login("nobody@gmail.com", "desktop", "Correct-Horse-7")
+	assert.True(t, errors.Is(err, errInvalidCredentials))
+	desktop, err := login("login@gmail.com", "desktop", "Correct-Horse-7")
+	assert.Nil(t, err)
+	exists, _ := agentExists("login@gmail.com", "desktop")
+	assert.True(t, exists)
+
+	assert.True(t, errors.Is(changePassword("login@gmail.com", "laptop", "Wrong-Horse-7", "Battery-Staple-8"), errInvalidCredentials))
+	assert.True(t, errors.Is(changePassword("login@gmail.com", "laptop", "Correct-Horse-7", "short"), errWeakPassword))
+	assert.Nil(t, changePassword("login@gmail.com", "laptop", "Correct-Horse-7", "Battery-Staple-8"))
+	_, err = login("login@gmail.com", "laptop", "Correct-Horse-7")
+	assert.True(t, errors.Is(err, errInvalidCredentials))
+	_, _, err = refreshTokens(desktop.RefreshToken)
+	assert.True(t, errors.Is(err, errInvalidRefreshToken), "other agents log in again after a password change")
+	_, laptop, err = refreshTokens(laptop.RefreshToken)
+	assert.Nil(t, err, "the agent that changed the password stays logged in")
+
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	reset, err := issueResetToken("login@gmail.com", now)
+	assert.Nil(t, err)
+	_, err = issueResetToken("nobody@gmail.com", now)
+	assert.NotNil(t, err)
+	assert.True(t, errors.Is(resetPassword("login@gmail.com", "forged", "Reset-Horse-9", now), errInvalidResetToken))
+	assert.True(t, errors.Is(resetPassword("login@gmail.com", reset.Token, "Reset-Horse-9", now.Add(2*time.Hour)), errInvalidResetToken), "reset tokens expire")
+	assert.True(t, errors.Is(resetPassword("login@gmail.com", reset.Token, "weak", now), errWeakPassword))
+	assert.Nil(t, resetPassword("login@gmail.com", reset.Token, "Reset-Horse-9", now))
+	assert.True(t, errors.Is(resetPassword("login@gmail.com", reset.Token, "Reset-Horse-10", now), errInvalidResetToken), "reset tokens work once")
+	_, _, err = refreshTokens(laptop.RefreshToken)
+	assert.True(t, errors.Is(err, errInvalidRefreshToken), "every agent logs in again after a reset")
+	_, err = login("login@gmail.com", "laptop", "Reset-Horse-9")
+	assert.Nil(t, err)
+}
+
+func TestConcurrentReset(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{})
+	_, err := register("reset-race@gmail.com", "laptop", "Correct-Horse-7")
+	assert.Nil(t, err)
+	now := time.Now()
+	reset, err := issueResetToken("reset-race@gmail.com", now)
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	var succeeded atomic.Int32
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := resetPassword("reset-race@gmail.com", reset.Token, "Reset-Horse-9", now); err == nil {
+				succeeded.Add(1)
+			} else {
+				assert.True(t, errors.Is(err, errInvalidResetToken))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), succeeded.Load(), "a reset token works once however many use it at the same time")
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+)
+
+// replicationFactor is how many storages should hold each version, every storage when not configured
+func replicationFactor() int {
+	if cfg.ReplicationFactor > 0 {
+		return cfg.ReplicationFactor
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return len(storages)
+}
+
+func placementScore(key, storageId string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte(storageId))
+	return h.Sum64()
+}
+
+// placeReplicas picks up to count storages for key next to the storages already holding it.
+// Candidates are ordered with rendezvous hashing, so a key keeps landing on the same storages
+// while membership does not change, and then picked so replicas spread over the failure domains
+// named by the PlacementSpreadBy labels. When they cannot be spread placement fails in strict mode
+// and only warns otherwise.
+func placeReplicas(key string, count int, holders, exclude []string) ([]pkg.Storage, error) {
+	if count <= 0 {
+		return nil, nil
+	}
+	mu.Lock()
+	var candidates, placed []pkg.Storage
+	for id, storage := range storages {
+		switch {
+		case slices.Contains(holders, id):
+			placed = append(placed, storage)
+		case slices.Contains(exclude, id), storage.Draining:
+		default:
+			candidates = append(candidates, storage)
+		}
+	}
+	mu.Unlock()
+	sort.Slice(candidates, func(i, j int) bool {
+		return placementScore(key, candidates[i].Id) > placementScore(key, candidates[j].Id)
+	})
+	var chosen []pkg.Storage
+	for len(chosen) < count && len(candidates) > 0 {
+		used := append(slices.Clone(placed), chosen...)
+		best := 0
+		for i := 1; i < len(candidates); i++ {
+			if spreadsFurther(candidates[i], candidates[best], used) {
+				best = i
+			}
+		}
+		chosen = append(chosen, candidates[best])
+		candidates = slices.Delete(candidates, best, best+1)
+	}
+	if unmet := unmetSpread(append(placed, chosen...)); len(unmet) > 0 {
+		if cfg.PlacementStrict {
+			return nil, fmt.Errorf("cannot spread replicas of %s across distinct %s", key, strings.Join(unmet, ", "))
+		}
+		slog.Warn("replicas share a failure domain", "key", key, "labels", unmet)
+	}
+	return chosen, nil
+}
+
+// spreadsFurther reports whether a opens a failure domain that b does not, comparing labels in priority order
+func spreadsFurther(a, b pkg.Storage, used []pkg.Storage) bool {
+	for _, label := range cfg.PlacementSpreadBy {
+		newA, newB := !domainUsed(a, label, used), !domainUsed(b, label, used)
+		if newA != newB {
+			return newA
+		}
+	}
+	return false
+}
+
+func domainUsed(storage pkg.Storage, label string, used []pkg.Storage) bool {
+	for _, other := range used {
+		if other.Labels[label] == storage.Labels[label] {
+			return true
+		}
+	}
+	return false
+}
+
+// unmetSpread lists the labels on which two of the replicas share a value
+func unmetSpread(replicas []pkg.Storage) []string {
+	var unmet []string
+	for _, label := range cfg.PlacementSpreadBy {
+		for i, replica := range replicas {
+			if domainUsed(replica, label, replicas[:i]) {
+				unmet = append(unmet, label)
+				break
+			}
+		}
+	}
+	return unmet
+}
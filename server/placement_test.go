@@ -0,0 +1,64 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func placed(t *testing.T, key string, count int, holders, exclude []string) []string {
+	replicas, err := placeReplicas(key, count, holders, exclude)
+	assert.Nil(t, err)
+	return storageIds(replicas)
+}
+
+func TestPlaceReplicas(t *testing.T) {
+	cfg = &pkg.ServerConfig{}
+	storages = map[string]pkg.Storage{
+		"a": {Id: "a"},
+		"b": {Id: "b"},
+		"c": {Id: "c"},
+		"d": {Id: "d"},
+	}
+	first := placed(t, "version-hash", 2, nil, nil)
+	assert.Len(t, first, 2)
+	assert.Equal(t, first, placed(t, "version-hash", 2, nil, nil), "placement must be stable")
+
+	excluded := placed(t, "version-hash", 2, nil, []string{first[0]})
+	assert.NotContains(t, excluded, first[0])
+	assert.Contains(t, excluded, first[1], "excluding one storage should keep the rest of the placement")
+
+	assert.NotContains(t, placed(t, "version-hash", 3, []string{"a"}, nil), "a")
+	storages["b"] = pkg.Storage{Id: "b", Draining: true}
+	assert.NotContains(t, placed(t, "version-hash", 4, nil, nil), "b", "draining storages get no new replicas")
+	storages["b"] = pkg.Storage{Id: "b"}
+	assert.Len(t, placed(t, "version-hash", 10, nil, nil), 4)
+	assert.Empty(t, placed(t, "version-hash", 0, nil, nil))
+}
+
+func TestPlaceReplicasAcrossZones(t *testing.T) {
+	cfg = &pkg.ServerConfig{PlacementSpreadBy: []string{"zone", "host"}}
+	storages = map[string]pkg.Storage{
+		"a1": {Id: "a1", Labels: map[string]string{"zone": "a", "host": "h1"}},
+		"a2": {Id: "a2", Labels: map[string]string{"zone": "a", "host": "h2"}},
+		"b1": {Id: "b1", Labels: map[string]string{"zone": "b", "host": "h3"}},
+		"b2": {Id: "b2", Labels: map[string]string{"zone": "b", "host": "h3"}},
+	}
+	for _, key := range []string{"first", "second", "third", "fourth"} {
+		zones := map[string]bool{}
+		for _, id := range placed(t, key, 2, nil, nil) {
+			zones[storages[id].Labels["zone"]] = true
+		}
+		assert.Len(t, zones, 2, "replicas of %s should land in both zones", key)
+	}
+
+	replicas := placed(t, "first", 1, []string{"a1"}, nil)
+	assert.Equal(t, "b", storages[replicas[0]].Labels["zone"], "new replicas should avoid the zones of existing ones")
+
+	cfg.PlacementStrict = true
+	_, err := placeReplicas("first", 3, nil, nil)
+	assert.NotNil(t, err, "three replicas cannot be spread over two zones")
+	_, err = placeReplicas("first", 2, nil, nil)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/labstack/echo/v4"
+)
+
+var errQuotaExceeded = db.ErrQuotaExceeded
+
+// userQuota is the first configured quota applying to email, nil when none does
+func userQuota(email string) *pkg.Quota {
+	for i, quota := range cfg.Quotas {
+		if quota.User == "" || quota.User == email {
+			return &cfg.Quotas[i]
+		}
+	}
+	return nil
+}
+
+// quotaLimits are the limits of the quota applying to email, nil when none does
+func quotaLimits(email string) *db.Limits {
+	quota := userQuota(email)
+	if quota == nil {
+		return nil
+	}
+	return &db.Limits{MaxBytes: quota.MaxBytes, MaxFiles: quota.MaxFiles, MaxVersions: quota.MaxVersions}
+}
+
+// checkQuota refuses a version of size bytes of the file at dir and name that would take email over its quota.
+// It turns uploads away before their data is sent, the store checks the quota again when the version is recorded.
+func checkQuota(email, dir, name string, size int64) error {
+	limits := quotaLimits(email)
+	if limits == nil {
+		return nil
+	}
+	ctx := context.Background()
+	usage, err := store.GetUsage(ctx, email)
+	if err != nil {
+		return err
+	}
+	file, err := store.FindFile(ctx, email, dir, name)
+	if err != nil {
+		return err
+	}
+	return limits.Check(*usage, file == nil, size)
+}
+
+func userUsage(email string) (pkg.UsageResponse, error) {
+	usage, err := store.GetUsage(context.Background(), email)
+	if err != nil {
+		return pkg.UsageResponse{}, err
+	}
+	response := pkg.UsageResponse{Files: usage.Files, Versions: usage.Versions, Bytes: usage.Bytes}
+	if quota := userQuota(email); quota != nil {
+		response.MaxFiles, response.MaxVersions, response.MaxBytes = quota.MaxFiles, quota.MaxVersions, quota.MaxBytes
+	}
+	return response, nil
+}
+
+// usageView reports what the user stores against their quota
+func usageView(c echo.Context) error {
+	email, err := validateToken(c.Request().Header.Get("Authorization"))
+	if err != nil {
+		return c.JSON(401, map[string]interface{}{
+			"message": fmt.Sprintf("invalid token %s", err.Error()),
+		})
+	}
+	usage, err := userUsage(email)
+	if err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": "internal server error",
+		})
+	}
+	return c.JSON(200, usage)
+}
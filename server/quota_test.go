@@ -0,0 +1,40 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadQuota(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{Quotas: []pkg.Quota{
+		{User: "unlimited@gmail.com"},
+		{MaxBytes: 1000, MaxFiles: 2, MaxVersions: 3},
+	}})
+	assert.Nil(t, createUser("quota@gmail.com", "agent", "password"))
+	upload := func(name string, size int64) error {
+		packet := uploadPacket("quota@gmail.com", "home/", name)
+		packet.OriginalSize = size
+		_, err := uploadFile(packet, blobHash(), "sum")
+		return err
+	}
+
+	assert.Nil(t, upload(".bashrc", 400))
+	assert.Nil(t, upload(".vimrc", 400))
+	err := upload(".zshrc", 10)
+	assert.True(t, errors.Is(err, errQuotaExceeded), "a third file is over the file quota")
+	assert.Contains(t, err.Error(), "2 of 2 files")
+	err = upload(".bashrc", 300)
+	assert.True(t, errors.Is(err, errQuotaExceeded), "the upload would take the bytes over the quota")
+	assert.Nil(t, upload(".bashrc", 100))
+	assert.True(t, errors.Is(upload(".bashrc", 10), errQuotaExceeded), "a fourth version is over the version quota")
+
+	usage, err := userUsage("quota@gmail.com")
+	assert.Nil(t, err)
+	assert.Equal(t, pkg.UsageResponse{Files: 2, Versions: 3, Bytes: 900, MaxFiles: 2, MaxVersions: 3, MaxBytes: 1000}, usage)
+	usage, err = userUsage("unlimited@gmail.com")
+	assert.Nil(t, err)
+	assert.Equal(t, pkg.UsageResponse{}, usage, "the first matching quota applies")
+}
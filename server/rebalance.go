@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	rebalanceStatusKey   = "rebalance-status"
+	rebalancePausedKey   = "rebalance-paused"
+	rebalanceRequestChan = "rebalance-requests"
+)
+
+// RebalanceStatus is the progress of the latest rebalance, shared in redis so every server can report it
+type RebalanceStatus struct {
+	Running    bool      `json:"running"`
+	Paused     bool      `json:"paused"`
+	Planned    int       `json:"planned"`
+	Moved      int       `json:"moved"`
+	Failed     int       `json:"failed"`
+	BytesMoved int64     `json:"bytes_moved"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// VersionMove brings the replicas of one version in line with the placement policy
+type VersionMove struct {
+	Email     string   `json:"email"`
+	VersionID string   `json:"version_id"`
+	Add       []string `json:"add"`
+	Remove    []string `json:"remove"`
+}
+
+var rebalancing sync.Mutex
+var rebalanceAgain atomic.Bool
+
+// planMove compares the storages holding a version with the ones placement wants,
+// replicas are only removed once the desired ones are all in place
+func planMove(holders, desired []string) (add, remove []string) {
+	for _, id := range desired {
+		if !slices.Contains(holders, id) {
+			add = append(add, id)
+		}
+	}
+	for _, id := range holders {
+		if !slices.Contains(desired, id) {
+			remove = append(remove, id)
+		}
+	}
+	return add, remove
+}
+
+func planRebalance() ([]VersionMove, error) {
+	var moves []VersionMove
+	err := forEachVersion(func(email string, file db.File, version db.FileVersion) {
+		holders := storageIds(rankReplicas(version.Storages))
+		if len(holders) == 0 {
+			return
+		}
+		placement, err := placeReplicas(version.Hash, replicationFactor(), nil, nil)
+		if err != nil {
+			slog.Warn("skipping version that cannot be placed", "version", version.ID, "err", err.Error())
+			return
+		}
+		add, remove := planMove(holders, storageIds(placement))
+		if len(add) == 0 && len(remove) == 0 {
+			return
+		}
+		moves = append(moves, VersionMove{Email: email, VersionID: version.ID, Add: add, Remove: remove})
+	})
+	return moves, err
+}
+
+// triggerRebalance starts a rebalance on the leader, or schedules another pass if one is already running
+func triggerRebalance(redisClient *redis.Client) {
+	if !rebalancing.TryLock() {
+		rebalanceAgain.Store(true)
+		return
+	}
+	go func() {
+		defer rebalancing.Unlock()
+		for {
+			rebalanceAgain.Store(false)
+			runRebalance(redisClient)
+			if !rebalanceAgain.Load() || !isLeader() {
+				return
+			}
+		}
+	}()
+}
+
+// watchRebalanceRequests lets any server ask the leader for a rebalance
+func watchRebalanceRequests(ctx context.Context, redisClient *redis.Client) {
+	requests := db.Subscribe(ctx, redisClient, rebalanceRequestChan)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-requests:
+			triggerRebalance(redisClient)
+		}
+	}
+}
+
+func runRebalance(redisClient *redis.Client) {
+	moves, err := planRebalance()
+	if err != nil {
+		slog.Error("error planning rebalance", "err", err.Error())
+		return
+	}
+	status := RebalanceStatus{Running: true, Planned: len(moves), StartedAt: time.Now()}
+	saveRebalanceStatus(redisClient, status)
+	limiter := newBandwidthLimiter(int64(cfg.RebalanceBandwidth) * 1024)
+	for _, move := range moves {
+		for rebalancePaused(redisClient) && isLeader() {
+			status.Paused = true
+			saveRebalanceStatus(redisClient, status)
+			time.Sleep(time.Second)
+		}
+		status.Paused = false
+		if !isLeader() {
+			break
+		}
+		moved, err := executeMove(move, limiter)
+		if err != nil {
+			slog.Error("rebalance move failed", "version", move.VersionID, "err", err.Error())
+			status.Failed++
+		} else {
+			status.Moved++
+			status.BytesMoved += moved
+		}
+		saveRebalanceStatus(redisClient, status)
+	}
+	status.Running = false
+	status.FinishedAt = time.Now()
+	saveRebalanceStatus(redisClient, status)
+	slog.Info("rebalance finished", "moved", status.Moved, "failed", status.Failed, "bytes", status.BytesMoved)
+}
+
+// executeMove copies a version to its new storages and verifies the copies, swaps the storages
+// in the version's replicas in one atomic update and only then deletes the copies that are no longer wanted
+func executeMove(move VersionMove, limiter *bandwidthLimiter) (int64, error) {
+	file, version, err := findVersion(move.Email, move.VersionID)
+	if err != nil {
+		return 0, err
+	}
+	uploadPath := versionPath(move.Email, *file, *version)
+	var moved int64
+	added := []string{}
+	if len(move.Add) > 0 {
+		data, err := readVersion(uploadPath, *version)
+		if err != nil {
+			return 0, err
+		}
+		for _, target := range rankReplicas(move.Add) {
+			limiter.wait(len(data))
+			if err := copyToStorage(target, uploadPath, version.Hash, data); err != nil {
+				slog.Error("error copying version", "version", version.ID, "storage", target.Id, "err", err.Error())
+				continue
+			}
+			moved += int64(len(data))
+			added = append(added, target.Id)
+		}
+	}
+	removed := move.Remove
+	if len(added) < len(move.Add) {
+		// keep every old replica until the version reached all of its new storages
+		removed = nil
+	}
+	if err := replaceVersionStorages(version.ID, removed, added); err != nil {
+		return moved, err
+	}
+	for _, storage := range rankReplicas(removed) {
+		if err := deleteFromStorage(storage, uploadPath, version.Hash); err != nil {
+			slog.Warn("error deleting moved replica", "version", version.ID, "storage", storage.Id, "err", err.Error())
+		}
+	}
+	return moved, nil
+}
+
+func saveRebalanceStatus(redisClient *redis.Client, status RebalanceStatus) {
+	entry, _ := json.Marshal(status)
+	if err := redisClient.Set(context.Background(), rebalanceStatusKey, entry, 0).Err(); err != nil {
+		slog.Error("error saving rebalance status", "err", err.Error())
+	}
+}
+
+func loadRebalanceStatus(redisClient *redis.Client) (RebalanceStatus, error) {
+	var status RebalanceStatus
+	entry, err := redisClient.Get(context.Background(), rebalanceStatusKey).Result()
+	if err == redis.Nil {
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+	err = json.Unmarshal([]byte(entry), &status)
+	status.Paused = rebalancePaused(redisClient)
+	return status, err
+}
+
+func rebalancePaused(redisClient *redis.Client) bool {
+	paused, _ := redisClient.Exists(context.Background(), rebalancePausedKey).Result()
+	return paused == 1
+}
+
+func pauseRebalance(redisClient *redis.Client, paused bool) error {
+	if paused {
+		return redisClient.Set(context.Background(), rebalancePausedKey, 1, 0).Err()
+	}
+	return redisClient.Del(context.Background(), rebalancePausedKey).Err()
+}
+
+// bandwidthLimiter spaces out transfers so they average at most bytesPerSecond
+type bandwidthLimiter struct {
+	bytesPerSecond int64
+	next           time.Time
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	return &bandwidthLimiter{bytesPerSecond: bytesPerSecond, next: time.Now()}
+}
+
+func (l *bandwidthLimiter) wait(size int) {
+	if l.bytesPerSecond <= 0 {
+		return
+	}
+	if delay := time.Until(l.next); delay > 0 {
+		time.Sleep(delay)
+	}
+	l.next = time.Now().Add(time.Duration(int64(size) * int64(time.Second) / l.bytesPerSecond))
+}
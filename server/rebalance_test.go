@@ -0,0 +1,64 @@
+package server
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanMove(t *testing.T) {
+	add, remove := planMove([]string{"a", "b"}, []string{"b", "c"})
+	assert.Equal(t, []string{"c"}, add)
+	assert.Equal(t, []string{"a"}, remove)
+
+	add, remove = planMove([]string{"a", "b"}, []string{"b", "a"})
+	assert.Empty(t, add)
+	assert.Empty(t, remove)
+}
+
+func TestExecuteMove(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{})
+	assert.Nil(t, createUser("move@gmail.com", "agent", "password"))
+	source, target, corrupt := startTestStorage(t, "source"), startTestStorage(t, "target"), startTestStorage(t, "corrupt")
+	corrupt.corrupt = true
+	storages = map[string]pkg.Storage{"source": source.Storage, "target": target.Storage, "corrupt": corrupt.Storage}
+	data := []byte("compressed")
+	versionId, err := uploadFile(uploadPacket("move@gmail.com", "home/", ".bashrc"), blobHash(), pkg.Checksum(data))
+	assert.Nil(t, err)
+	file, version, _ := findVersion("move@gmail.com", versionId)
+	blob := path.Join(versionPath("move@gmail.com", *file, *version), version.Hash)
+	assert.Nil(t, pushToStorage(source.Storage, path.Dir(blob), version.Hash, data))
+	assert.Nil(t, addVersionStorage(versionId, "source"))
+	limiter := newBandwidthLimiter(0)
+
+	_, err = executeMove(VersionMove{Email: "move@gmail.com", VersionID: versionId, Add: []string{"corrupt"}, Remove: []string{"source"}}, limiter)
+	assert.Nil(t, err)
+	_, version, _ = findVersion("move@gmail.com", versionId)
+	assert.Equal(t, []string{"source"}, version.Storages, "copies that do not verify are not recorded")
+	assert.True(t, source.holds(blob), "the source stays until the new copy is verified")
+
+	moved, err := executeMove(VersionMove{Email: "move@gmail.com", VersionID: versionId, Add: []string{"target"}, Remove: []string{"source"}}, limiter)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), moved)
+	_, version, _ = findVersion("move@gmail.com", versionId)
+	assert.Equal(t, []string{"target"}, version.Storages)
+	assert.True(t, target.holds(blob))
+	assert.Eventually(t, func() bool { return !source.holds(blob) }, time.Second, 10*time.Millisecond, "the old copy is deleted")
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	limiter := newBandwidthLimiter(1024 * 1024)
+	start := time.Now()
+	limiter.wait(256 * 1024)
+	limiter.wait(256 * 1024)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+	unlimited := newBandwidthLimiter(0)
+	start = time.Now()
+	unlimited.wait(1 << 30)
+	unlimited.wait(1 << 30)
+	assert.Less(t, time.Since(start), 10*time.Millisecond)
+}
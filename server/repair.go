@@ -0,0 +1,292 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// RepairJob copies one version from its surviving replicas to a new storage
+type RepairJob struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	VersionID string    `json:"version_id"`
+	Lost      string    `json:"lost"`
+	Target    string    `json:"target"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type RepairProgress struct {
+	Queued  int         `json:"queued"`
+	Running int         `json:"running"`
+	Done    int         `json:"done"`
+	Failed  int         `json:"failed"`
+	Jobs    []RepairJob `json:"jobs"`
+}
+
+// repairQueue runs jobs on this server and keeps their progress in redis so every server can report it
+type repairQueue struct {
+	mu      sync.Mutex
+	pending chan *RepairJob
+}
+
+var repairs = &repairQueue{pending: make(chan *RepairJob, 1024)}
+
+const (
+	repairWorkers     = 2
+	repairJobsKey     = "repair-jobs"
+	repairRequestChan = "repair-requests"
+)
+
+var repairing sync.Mutex
+
+// watchRepairRequests lets any server ask the leader to repair under replicated versions
+func watchRepairRequests(ctx context.Context, redisClient *redis.Client) {
+	requests := db.Subscribe(ctx, redisClient, repairRequestChan)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-requests:
+			if repairing.TryLock() {
+				go func() {
+					defer repairing.Unlock()
+					scheduled, err := repairUnderReplicated()
+					if err != nil {
+						slog.Error("error scheduling repairs", "err", err.Error())
+					}
+					slog.Info("repair scheduled", "jobs", scheduled)
+				}()
+			}
+		}
+	}
+}
+
+func startRepairWorkers() {
+	for range repairWorkers {
+		go func() {
+			for job := range repairs.pending {
+				repairs.setStatus(job, JobRunning, nil)
+				repairs.setStatus(job, JobDone, runRepairJob(job))
+			}
+		}()
+	}
+}
+
+func (q *repairQueue) enqueue(email, versionId, lost, target string) {
+	job := &RepairJob{
+		ID:        uuid.New().String(),
+		Email:     email,
+		VersionID: versionId,
+		Lost:      lost,
+		Target:    target,
+		Status:    JobQueued,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	q.save(job)
+	q.dispatch(job)
+}
+
+// dispatch hands a job to the workers without blocking the caller, which may be the leader's
+// own loop. When the workers are backed up the job waits in a goroutine of its own, saved as queued.
+func (q *repairQueue) dispatch(job *RepairJob) {
+	select {
+	case q.pending <- job:
+	default:
+		go func() { q.pending <- job }()
+	}
+}
+
+func (q *repairQueue) save(job *RepairJob) {
+	entry, _ := json.Marshal(job)
+	if err := redisClient.HSet(context.Background(), repairJobsKey, job.ID, entry).Err(); err != nil {
+		slog.Error("error saving repair job", "job", job.ID, "err", err.Error())
+	}
+}
+
+func (q *repairQueue) setStatus(job *RepairJob, status string, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job.Status = status
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+		slog.Error("repair job failed", "job", job.ID, "version", job.VersionID, "err", err.Error())
+	}
+	job.UpdatedAt = time.Now()
+	q.save(job)
+}
+
+func (q *repairQueue) load() ([]RepairJob, error) {
+	entries, err := redisClient.HGetAll(context.Background(), repairJobsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	jobs := []RepairJob{}
+	for _, entry := range entries {
+		var job RepairJob
+		if err := json.Unmarshal([]byte(entry), &job); err != nil {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+	return jobs, nil
+}
+
+// resume picks up jobs a previous leader left unfinished. They are handed to the workers from a
+// goroutine of their own, however many there are, so the leader is not held up.
+func (q *repairQueue) resume() {
+	jobs, err := q.load()
+	if err != nil {
+		slog.Error("error loading repair jobs", "err", err.Error())
+		return
+	}
+	unfinished := []*RepairJob{}
+	for _, job := range jobs {
+		if job.Status == JobQueued || job.Status == JobRunning {
+			unfinished = append(unfinished, &job)
+		}
+	}
+	go func() {
+		for _, job := range unfinished {
+			q.pending <- job
+		}
+	}()
+}
+
+func (q *repairQueue) progress() (RepairProgress, error) {
+	jobs, err := q.load()
+	if err != nil {
+		return RepairProgress{}, err
+	}
+	progress := RepairProgress{Jobs: jobs}
+	for _, job := range jobs {
+		switch job.Status {
+		case JobQueued:
+			progress.Queued++
+		case JobRunning:
+			progress.Running++
+		case JobDone:
+			progress.Done++
+		case JobFailed:
+			progress.Failed++
+		}
+	}
+	return progress, nil
+}
+
+// onStorageLost schedules a copy for every version that lost a replica with the departed storage
+func onStorageLost(storageId string) {
+	held, err := versionsHeldBy(storageId)
+	if err != nil {
+		slog.Error("error listing versions for re-replication", "storage", storageId, "err", err.Error())
+		return
+	}
+	for _, item := range held {
+		scheduleRepair(item.email, item.version, storageId)
+	}
+}
+
+// repairUnderReplicated schedules copies for every version with fewer live replicas than it should have
+func repairUnderReplicated() (int, error) {
+	scheduled := 0
+	err := forEachVersion(func(email string, file db.File, version db.FileVersion) {
+		scheduled += scheduleRepair(email, version, "")
+	})
+	return scheduled, err
+}
+
+// scheduleRepair queues the copies a version needs to get back to the replication factor,
+// lost is the storage the version is known to be missing from, if any
+func scheduleRepair(email string, version db.FileVersion, lost string) int {
+	holders := storageIds(rankReplicas(version.Storages))
+	if len(holders) == 0 {
+		slog.Error("version lost its last replica", "email", email, "version", version.ID, "storage", lost)
+		return 0
+	}
+	missing := replicationFactor() - len(holders)
+	if missing <= 0 {
+		if lost == "" {
+			return 0
+		}
+		if err := replaceVersionStorage(email, version.ID, lost, ""); err != nil {
+			slog.Error("error dropping lost replica", "version", version.ID, "err", err.Error())
+		}
+		return 0
+	}
+	targets, err := placeReplicas(version.Hash, missing, holders, []string{lost})
+	if err != nil {
+		slog.Error("no placement for missing replica", "version", version.ID, "err", err.Error())
+		return 0
+	}
+	for _, target := range targets {
+		repairs.enqueue(email, version.ID, lost, target.Id)
+	}
+	return len(targets)
+}
+
+func runRepairJob(job *RepairJob) error {
+	file, version, err := findVersion(job.Email, job.VersionID)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	target, exists := storages[job.Target]
+	mu.Unlock()
+	if !exists {
+		return fmt.Errorf("target storage %s is gone", job.Target)
+	}
+	uploadPath := versionPath(job.Email, *file, *version)
+	data, err := readVersion(uploadPath, *version)
+	if err != nil {
+		return err
+	}
+	if err := copyToStorage(target, uploadPath, version.Hash, data); err != nil {
+		return err
+	}
+	return replaceVersionStorage(job.Email, job.VersionID, job.Lost, job.Target)
+}
+
+// replaceVersionStorage drops lost from the replicas of a version and records target instead, if any,
+// in one atomic update
+func replaceVersionStorage(email, versionId, lost, target string) error {
+	if _, _, err := findVersion(email, versionId); err != nil {
+		return err
+	}
+	add := []string{}
+	if target != "" {
+		add = append(add, target)
+	}
+	return replaceVersionStorages(versionId, []string{lost}, add)
+}
+
+func storageIds(replicas []pkg.Storage) []string {
+	ids := make([]string, 0, len(replicas))
+	for _, replica := range replicas {
+		ids = append(ids, replica.Id)
+	}
+	return ids
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunRepairJob(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{})
+	assert.Nil(t, createUser("repair@gmail.com", "agent", "password"))
+	survivor, target, corrupt := startTestStorage(t, "survivor"), startTestStorage(t, "target"), startTestStorage(t, "corrupt")
+	corrupt.corrupt = true
+	storages = map[string]pkg.Storage{"survivor": survivor.Storage, "target": target.Storage, "corrupt": corrupt.Storage}
+	data := []byte("compressed")
+	versionId, err := uploadFile(uploadPacket("repair@gmail.com", "home/", ".bashrc"), blobHash(), pkg.Checksum(data))
+	assert.Nil(t, err)
+	file, version, _ := findVersion("repair@gmail.com", versionId)
+	uploadPath := versionPath("repair@gmail.com", *file, *version)
+	assert.Nil(t, pushToStorage(survivor.Storage, uploadPath, version.Hash, data))
+	assert.Nil(t, replaceVersionStorages(versionId, nil, []string{"survivor", "lost"}))
+
+	err = runRepairJob(&RepairJob{Email: "repair@gmail.com", VersionID: versionId, Lost: "lost", Target: "corrupt"})
+	assert.NotNil(t, err, "copies that do not verify fail the job")
+	_, version, _ = findVersion("repair@gmail.com", versionId)
+	assert.Equal(t, []string{"survivor", "lost"}, version.Storages)
+
+	assert.Nil(t, runRepairJob(&RepairJob{Email: "repair@gmail.com", VersionID: versionId, Lost: "lost", Target: "target"}))
+	_, version, _ = findVersion("repair@gmail.com", versionId)
+	assert.Equal(t, []string{"survivor", "target"}, version.Storages)
+	assert.True(t, target.holds(path.Join(uploadPath, version.Hash)))
+}
+
+func TestDispatchRepairJob(t *testing.T) {
+	queue := &repairQueue{pending: make(chan *RepairJob)}
+	dispatched := make(chan bool)
+	go func() {
+		queue.dispatch(&RepairJob{ID: "job"})
+		close(dispatched)
+	}()
+	select {
+	case <-dispatched:
+	case <-time.After(time.Second):
+		t.Fatal("dispatching blocked on busy workers")
+	}
+	assert.Equal(t, "job", (<-queue.pending).ID, "the job still reaches the workers")
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+)
+
+// latencies keeps a moving average of how long each storage took to answer a transfer
+var latencies = make(map[string]time.Duration)
+var latencyMu sync.Mutex
+
+const latencyWeight = 0.3
+
+func recordLatency(storageId string, took time.Duration) {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+	current, exists := latencies[storageId]
+	if !exists {
+		latencies[storageId] = took
+		return
+	}
+	latencies[storageId] = time.Duration(latencyWeight*float64(took) + (1-latencyWeight)*float64(current))
+}
+
+func storageLatency(storageId string) time.Duration {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+	return latencies[storageId]
+}
+
+// rankReplicas returns the known storages among ids, healthy ones first and faster ones before slower ones
+func rankReplicas(ids []string) []pkg.Storage {
+	mu.Lock()
+	var replicas []pkg.Storage
+	for _, id := range ids {
+		if storage, exists := storages[id]; exists {
+			replicas = append(replicas, storage)
+		}
+	}
+	mu.Unlock()
+	sort.SliceStable(replicas, func(i, j int) bool {
+		healthyI, healthyJ := replicas[i].Status == pkg.MemberAlive, replicas[j].Status == pkg.MemberAlive
+		if healthyI != healthyJ {
+			return healthyI
+		}
+		return storageLatency(replicas[i].Id) < storageLatency(replicas[j].Id)
+	})
+	return replicas
+}
+
+func fetchFromStorage(storage pkg.Storage, uploadPath, hash string) ([]byte, error) {
+	ticket, err := storageTicket(storage, pkg.Ticket{Operation: pkg.TicketDownload, UploadPath: uploadPath, Hash: hash})
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	packet, err := requestStorage(storage, pkg.TransferPacket{
+		Command:    "download",
+		Meta:       map[string]string{"Hash": hash, "Path": uploadPath, "Ticket": ticket},
+		SenderMeta: pkg.SenderMeta{Application: "server"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if packet.Meta["Error"] != "" {
+		return nil, errors.New(packet.Meta["Error"])
+	}
+	recordLatency(storage.Id, time.Since(start))
+	return packet.Compressed, nil
+}
+
+// requestStorage sends tr to a storage and waits for the packet it answers with
+func requestStorage(storage pkg.Storage, tr pkg.TransferPacket) (*pkg.TransferPacket, error) {
+	serialized, err := pkg.SerializePacket(&tr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pkg.SendDataOverTcp(storage.Port, int64(len(serialized)), serialized)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	data, err := pkg.ReadConnBuffers(conn)
+	if err != nil {
+		return nil, err
+	}
+	return pkg.DeserializePacket(data)
+}
+
+func pushToStorage(storage pkg.Storage, uploadPath, hash string, data []byte) error {
+	ticket, err := storageTicket(storage, pkg.Ticket{Operation: pkg.TicketReplicate, UploadPath: uploadPath, Hash: hash, Checksum: pkg.Checksum(data)})
+	if err != nil {
+		return err
+	}
+	tr := pkg.TransferPacket{
+		Command:      "upload",
+		OriginalSize: int64(len(data)),
+		Compressed:   data,
+		Meta:         map[string]string{"UploadPath": uploadPath, "UploadHash": hash, "Ticket": ticket},
+		SenderMeta:   pkg.SenderMeta{Application: "server"},
+	}
+	serialized, err := pkg.SerializePacket(&tr)
+	if err != nil {
+		return err
+	}
+	conn, err := pkg.SendDataOverTcp(storage.Port, int64(len(serialized)), serialized)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+const verifyAttempts = 3
+
+// copyToStorage pushes a blob to a storage and reads it back, failing unless the storage holds an
+// exact copy. Storages write uploads in the background, so the copy is read again a few times.
+func copyToStorage(storage pkg.Storage, uploadPath, hash string, data []byte) error {
+	if err := pushToStorage(storage, uploadPath, hash, data); err != nil {
+		return err
+	}
+	var err error
+	for attempt := 1; attempt <= verifyAttempts; attempt++ {
+		var copied []byte
+		if copied, err = fetchFromStorage(storage, uploadPath, hash); err == nil && pkg.Checksum(copied) != pkg.Checksum(data) {
+			err = errors.New("copy does not match")
+		}
+		if err == nil {
+			return nil
+		}
+		time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+	}
+	return fmt.Errorf("verifying copy on %s: %w", storage.Id, err)
+}
+
+func deleteFromStorage(storage pkg.Storage, uploadPath, hash string) error {
+	ticket, err := storageTicket(storage, pkg.Ticket{Operation: pkg.TicketDelete, UploadPath: uploadPath, Hash: hash})
+	if err != nil {
+		return err
+	}
+	tr := pkg.TransferPacket{
+		Command:    "delete",
+		Meta:       map[string]string{"Hash": hash, "Path": uploadPath, "Ticket": ticket},
+		SenderMeta: pkg.SenderMeta{Application: "server"},
+	}
+	serialized, err := pkg.SerializePacket(&tr)
+	if err != nil {
+		return err
+	}
+	conn, err := pkg.SendDataOverTcp(storage.Port, int64(len(serialized)), serialized)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// readVersion tries the replicas of a version until one returns data matching its checksum,
+// replicas that failed along the way get a fresh copy of the data in the background
+func readVersion(uploadPath string, version db.FileVersion) ([]byte, error) {
+	var damaged []pkg.Storage
+	for _, storage := range rankReplicas(version.Storages) {
+		data, err := fetchFromStorage(storage, uploadPath, version.Hash)
+		if err != nil {
+			slog.Warn("replica read failed", "storage", storage.Id, "version", version.ID, "err", err.Error())
+			damaged = append(damaged, storage)
+			continue
+		}
+		if version.Checksum != "" && pkg.Checksum(data) != version.Checksum {
+			slog.Warn("replica checksum mismatch", "storage", storage.Id, "version", version.ID)
+			damaged = append(damaged, storage)
+			continue
+		}
+		if len(damaged) > 0 {
+			go repairReplicas(damaged, uploadPath, version.Hash, data)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("no replica available for version %s", version.ID)
+}
+
+func repairReplicas(replicas []pkg.Storage, uploadPath, hash string, data []byte) {
+	for _, storage := range replicas {
+		if err := pushToStorage(storage, uploadPath, hash, data); err != nil {
+			slog.Error("read repair failed", "storage", storage.Id, "hash", hash, "err", err.Error())
+			continue
+		}
+		slog.Info("read repair done", "storage", storage.Id, "hash", hash)
+	}
+}
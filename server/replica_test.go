@@ -0,0 +1,117 @@
+package server
+
+import (
+	"net"
+	"path"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+// testStorage serves uploads, downloads and deletes of blobs it keeps in memory, handling one request at a time.
+// Like a real storage it only acts on blobs a server signed a ticket for.
+type testStorage struct {
+	pkg.Storage
+	mu      sync.Mutex
+	blobs   map[string][]byte
+	corrupt bool // answer downloads with data that does not match what was uploaded
+}
+
+func startTestStorage(t *testing.T, id string) *testStorage {
+	listener, err := net.Listen("tcp", ":0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	storage := &testStorage{Storage: pkg.Storage{Id: id, Port: listener.Addr().(*net.TCPAddr).Port, Status: pkg.MemberAlive}, blobs: make(map[string][]byte)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			storage.serve(conn)
+		}
+	}()
+	return storage
+}
+
+func (s *testStorage) serve(conn net.Conn) {
+	defer conn.Close()
+	buf, err := pkg.GetIncomingBuf(conn)
+	if err != nil {
+		return
+	}
+	tr, err := pkg.DeserializePacket(buf.Bytes())
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch tr.Command {
+	case "upload":
+		if ticket := s.ticketFor(tr, pkg.TicketReplicate); ticket != nil && pkg.Checksum(tr.Compressed) == ticket.Checksum {
+			s.blobs[path.Join(ticket.UploadPath, ticket.Hash)] = tr.Compressed
+		}
+	case "delete":
+		if ticket := s.ticketFor(tr, pkg.TicketDelete); ticket != nil {
+			delete(s.blobs, path.Join(ticket.UploadPath, ticket.Hash))
+		}
+	case "download":
+		ticket := s.ticketFor(tr, pkg.TicketDownload)
+		if ticket == nil {
+			serialized, _ := pkg.SerializePacket(&pkg.TransferPacket{Meta: map[string]string{"Error": "invalid ticket"}})
+			pkg.SendByteToConn(conn, serialized)
+			return
+		}
+		data := s.blobs[path.Join(ticket.UploadPath, ticket.Hash)]
+		if s.corrupt {
+			data = append(slices.Clone(data), 0)
+		}
+		serialized, _ := pkg.SerializePacket(&pkg.TransferPacket{Compressed: data})
+		pkg.SendByteToConn(conn, serialized)
+	}
+}
+
+// ticketFor is the ticket tr carries if it is valid for operation on this storage
+func (s *testStorage) ticketFor(tr *pkg.TransferPacket, operation string) *pkg.Ticket {
+	ticket, _, err := pkg.VerifyTicket(tr.Meta["Ticket"])
+	if err != nil || ticket.Operation != operation || ticket.StorageId != s.Id {
+		return nil
+	}
+	return ticket
+}
+
+func (s *testStorage) holds(blob string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, exists := s.blobs[blob]
+	return exists
+}
+
+func TestRankReplicas(t *testing.T) {
+	storages = map[string]pkg.Storage{
+		"stale": {Id: "stale", Port: 1, Status: pkg.MemberSuspect},
+		"slow":  {Id: "slow", Port: 2, Status: pkg.MemberAlive},
+		"fast":  {Id: "fast", Port: 3, Status: pkg.MemberAlive},
+	}
+	recordLatency("slow", 300*time.Millisecond)
+	recordLatency("fast", 20*time.Millisecond)
+	recordLatency("stale", time.Millisecond)
+
+	ranked := rankReplicas([]string{"stale", "slow", "missing", "fast"})
+	ids := []string{}
+	for _, storage := range ranked {
+		ids = append(ids, storage.Id)
+	}
+	assert.Equal(t, []string{"fast", "slow", "stale"}, ids)
+}
+
+func TestReadVersionWithoutReplicas(t *testing.T) {
+	storages = map[string]pkg.Storage{}
+	_, err := readVersion("path", db.FileVersion{ID: "v1", Storages: []string{"gone"}})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/redis/go-redis/v9"
+)
+
+const pruneStatusKey = "prune-status"
+
+// PruneStatus is the outcome of the latest pruning of versions retention policies no longer keep
+type PruneStatus struct {
+	Running    bool      `json:"running"`
+	Files      int       `json:"files"`
+	Pruned     int       `json:"pruned"`
+	Failed     int       `json:"failed"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// retentionPolicy is the first configured policy matching a user's file, nil when none does
+func retentionPolicy(email string, file db.File) *pkg.RetentionPolicy {
+	for i, policy := range cfg.RetentionPolicies {
+		if policy.User != "" && policy.User != email {
+			continue
+		}
+		if policy.Pattern != "" && !matchesPattern(policy.Pattern, file) {
+			continue
+		}
+		return &cfg.RetentionPolicies[i]
+	}
+	return nil
+}
+
+func matchesPattern(pattern string, file db.File) bool {
+	for _, candidate := range []string{path.Join(file.Path, file.Name), file.Name} {
+		if matched, _ := path.Match(pattern, candidate); matched {
+			return true
+		}
+	}
+	return false
+}
+
+type retentionBucket struct {
+	count int
+	key   func(created time.Time) string
+}
+
+// retainedVersions picks the versions a policy keeps out of versions ordered oldest first. Walking from
+// the newest, the daily, weekly and monthly rules keep the first version seen in each of their periods.
+// The latest version and versions with an unreadable creation time are always kept.
+func retainedVersions(policy pkg.RetentionPolicy, versions []db.FileVersion, now time.Time) map[string]bool {
+	keep := make(map[string]bool)
+	if policy.KeepLast <= 0 && policy.KeepWithin <= 0 && policy.KeepDaily <= 0 && policy.KeepWeekly <= 0 && policy.KeepMonthly <= 0 {
+		for _, version := range versions {
+			keep[version.ID] = true
+		}
+		return keep
+	}
+	buckets := []retentionBucket{
+		{policy.KeepDaily, func(created time.Time) string { return created.Format(time.DateOnly) }},
+		{policy.KeepWeekly, func(created time.Time) string {
+			year, week := created.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{policy.KeepMonthly, func(created time.Time) string { return created.Format("2006-01") }},
+	}
+	seen := make([]map[string]bool, len(buckets))
+	for i := range buckets {
+		seen[i] = make(map[string]bool)
+	}
+	within := time.Duration(policy.KeepWithin) * time.Second
+	for i := len(versions) - 1; i >= 0; i-- {
+		version := versions[i]
+		if newer := len(versions) - 1 - i; newer == 0 || newer < policy.KeepLast {
+			keep[version.ID] = true
+		}
+		created, err := time.Parse(time.RFC3339, version.CreatedAt)
+		if err != nil {
+			keep[version.ID] = true
+			continue
+		}
+		created = created.UTC()
+		if within > 0 && now.Sub(created) < within {
+			keep[version.ID] = true
+		}
+		for j, bucket := range buckets {
+			key := bucket.key(created)
+			if bucket.count > 0 && !seen[j][key] && len(seen[j]) < bucket.count {
+				seen[j][key] = true
+				keep[version.ID] = true
+			}
+		}
+	}
+	return keep
+}
+
+// runPruner prunes versions on an interval while this server leads
+func runPruner(ctx context.Context, redisClient *redis.Client) {
+	if cfg.PruneInterval <= 0 || len(cfg.RetentionPolicies) == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(cfg.PruneInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			savePruneStatus(redisClient, PruneStatus{Running: true, StartedAt: now})
+			status := pruneVersions(now)
+			savePruneStatus(redisClient, status)
+			slog.Info("pruning finished", "files", status.Files, "pruned", status.Pruned, "failed", status.Failed)
+		}
+	}
+}
+
+// pruneVersions removes every version the retention policies no longer keep, the trash is left as it was deleted
+func pruneVersions(now time.Time) PruneStatus {
+	status := PruneStatus{StartedAt: now}
+	emails, err := listUserEmails()
+	if err != nil {
+		slog.Error("error listing users to prune", "err", err.Error())
+		status.Failed++
+	}
+	for _, email := range emails {
+		files, err := store.ListFiles(context.Background(), email)
+		if err != nil {
+			slog.Error("error listing files to prune", "email", email, "err", err.Error())
+			status.Failed++
+			continue
+		}
+		for _, file := range files {
+			policy := retentionPolicy(email, file)
+			if policy == nil || file.DeletedAt != "" {
+				continue
+			}
+			versions, err := store.ListVersions(context.Background(), file.ID)
+			if err != nil {
+				slog.Error("error listing versions to prune", "file", file.ID, "err", err.Error())
+				status.Failed++
+				continue
+			}
+			status.Files++
+			keep := retainedVersions(*policy, versions, now)
+			for _, version := range versions {
+				if keep[version.ID] {
+					continue
+				}
+				if err := removeVersion(email, file, version); err != nil {
+					slog.Error("error pruning version", "version", version.ID, "err", err.Error())
+					status.Failed++
+					continue
+				}
+				status.Pruned++
+			}
+		}
+	}
+	status.FinishedAt = time.Now()
+	return status
+}
+
+// removeVersion removes a version's metadata and then its blobs. A blob that cannot be deleted
+// is no longer referenced by then, so garbage collection removes it later.
+func removeVersion(email string, file db.File, version db.FileVersion) error {
+	if err := store.DeleteVersion(context.Background(), version.ID); err != nil {
+		return err
+	}
+	uploadPath := versionPath(email, file, version)
+	for _, storage := range rankReplicas(version.Storages) {
+		if err := deleteFromStorage(storage, uploadPath, version.Hash); err != nil {
+			slog.Warn("blob of removed version left for garbage collection", "storage", storage.Id, "version", version.ID, "err", err.Error())
+		}
+	}
+	return nil
+}
+
+func savePruneStatus(redisClient *redis.Client, status PruneStatus) {
+	entry, _ := json.Marshal(status)
+	if err := redisClient.Set(context.Background(), pruneStatusKey, entry, 0).Err(); err != nil {
+		slog.Error("error saving prune status", "err", err.Error())
+	}
+}
+
+func loadPruneStatus(redisClient *redis.Client) (PruneStatus, error) {
+	var status PruneStatus
+	entry, err := redisClient.Get(context.Background(), pruneStatusKey).Result()
+	if err == redis.Nil {
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+	return status, json.Unmarshal([]byte(entry), &status)
+}
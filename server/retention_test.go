@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+// dailyVersions makes one version a day for days days up to now, oldest first
+func dailyVersions(now time.Time, days int) []db.FileVersion {
+	versions := []db.FileVersion{}
+	for i := days - 1; i >= 0; i-- {
+		created := now.AddDate(0, 0, -i)
+		versions = append(versions, db.FileVersion{ID: fmt.Sprintf("v%d", i), CreatedAt: created.Format(time.RFC3339)})
+	}
+	return versions
+}
+
+func kept(keep map[string]bool) int {
+	count := 0
+	for _, kept := range keep {
+		if kept {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRetainedVersions(t *testing.T) {
+	now := time.Date(2024, time.June, 15, 12, 0, 0, 0, time.UTC)
+	versions := dailyVersions(now, 90)
+
+	assert.Equal(t, 90, kept(retainedVersions(pkg.RetentionPolicy{}, versions, now)), "a policy without rules keeps everything")
+
+	keep := retainedVersions(pkg.RetentionPolicy{KeepLast: 3}, versions, now)
+	assert.Equal(t, 3, kept(keep))
+	assert.True(t, keep["v0"] && keep["v1"] && keep["v2"])
+
+	keep = retainedVersions(pkg.RetentionPolicy{KeepWithin: 5 * 24 * 60 * 60}, versions, now)
+	assert.Equal(t, 5, kept(keep))
+
+	keep = retainedVersions(pkg.RetentionPolicy{KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 3}, versions, now)
+	assert.True(t, keep["v0"])
+	assert.True(t, keep["v6"])
+	assert.False(t, keep["v7"] && keep["v8"], "a week is only kept once")
+	assert.True(t, keep["v15"], "the last day of May is kept monthly")
+	assert.True(t, keep["v46"], "the last day of April is kept monthly")
+	assert.False(t, keep["v89"])
+
+	keep = retainedVersions(pkg.RetentionPolicy{KeepLast: 1}, append(versions, db.FileVersion{ID: "broken", CreatedAt: "yesterday"}), now)
+	assert.True(t, keep["broken"])
+	assert.Equal(t, 1, kept(keep), "the latest version is kept")
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	cfg = &pkg.ServerConfig{RetentionPolicies: []pkg.RetentionPolicy{
+		{User: "owner@gmail.com", Pattern: "home/.config/*", KeepLast: 1},
+		{Pattern: "*.log", KeepLast: 2},
+		{User: "owner@gmail.com"},
+	}}
+	config := db.File{Path: "home/.config", Name: "app.toml"}
+	assert.Equal(t, 1, retentionPolicy("owner@gmail.com", config).KeepLast)
+	assert.Nil(t, retentionPolicy("other@gmail.com", config))
+	assert.Equal(t, 2, retentionPolicy("other@gmail.com", db.File{Path: "var", Name: "sync.log"}).KeepLast)
+	assert.Equal(t, 0, retentionPolicy("owner@gmail.com", db.File{Path: "home", Name: ".bashrc"}).KeepLast)
+}
+
+func TestPruneVersions(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{RetentionPolicies: []pkg.RetentionPolicy{{Pattern: ".bashrc", KeepLast: 2}}})
+	assert.Nil(t, createUser("prune@gmail.com", "agent", "password"))
+
+	var latest string
+	for i := 0; i < 4; i++ {
+		versionId, err := uploadFile(uploadPacket("prune@gmail.com", "home", ".bashrc"), fmt.Sprintf("hash%d", i), "sum")
+		assert.Nil(t, err)
+		latest = versionId
+		_, err = uploadFile(uploadPacket("prune@gmail.com", "home", ".vimrc"), fmt.Sprintf("hash%d", i), "sum")
+		assert.Nil(t, err)
+	}
+	status := pruneVersions(time.Now())
+	assert.Equal(t, 1, status.Files)
+	assert.Equal(t, 2, status.Pruned)
+	assert.Equal(t, 0, status.Failed)
+
+	uploads, err := getUserUploads("prune@gmail.com", pkg.Tags{})
+	assert.Nil(t, err)
+	for _, upload := range uploads {
+		if upload.FileName == ".bashrc" {
+			assert.Len(t, upload.Versions, 2)
+			assert.Equal(t, latest, upload.Versions[1].ID)
+		} else {
+			assert.Len(t, upload.Versions, 4, "files without a policy keep every version")
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 500
+)
+
+var searchSorts = []string{db.SortCreated, db.SortUploaded, db.SortName, db.SortDir, db.SortSize}
+
+// parseSearchTime reads an RFC3339 time or a date, a date ending a range includes that whole day
+func parseSearchTime(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		return at, nil
+	}
+	day, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected a date or RFC3339", value)
+	}
+	if end {
+		return day.AddDate(0, 0, 1), nil
+	}
+	return day, nil
+}
+
+func parseSearchInt(params url.Values, key string) (int64, error) {
+	value := params.Get(key)
+	if value == "" {
+		return 0, nil
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid %s %q", key, value)
+	}
+	return number, nil
+}
+
+// parseVersionQuery reads the query parameters of a search
+func parseVersionQuery(params url.Values) (db.VersionQuery, error) {
+	query := db.VersionQuery{
+		Name:  params.Get("name"),
+		Dir:   params.Get("dir"),
+		Agent: params.Get("agent"),
+		Sort:  params.Get("sort"),
+		Desc:  params.Get("order") == "desc",
+		Limit: defaultSearchLimit,
+	}
+	if query.Sort == "" {
+		query.Sort = db.SortCreated
+	}
+	if !slices.Contains(searchSorts, query.Sort) {
+		return query, fmt.Errorf("invalid sort %q, expected one of %v", query.Sort, searchSorts)
+	}
+	if order := params.Get("order"); order != "" && order != "asc" && order != "desc" {
+		return query, fmt.Errorf("invalid order %q, expected asc or desc", order)
+	}
+	var err error
+	times := []struct {
+		key   string
+		end   bool
+		value *time.Time
+	}{
+		{"uploaded_from", false, &query.UploadedFrom},
+		{"uploaded_to", true, &query.UploadedTo},
+		{"created_from", false, &query.CreatedFrom},
+		{"created_to", true, &query.CreatedTo},
+	}
+	for _, bound := range times {
+		if *bound.value, err = parseSearchTime(params.Get(bound.key), bound.end); err != nil {
+			return query, fmt.Errorf("%s: %w", bound.key, err)
+		}
+	}
+	if query.MinSize, err = parseSearchInt(params, "min_size"); err != nil {
+		return query, err
+	}
+	if query.MaxSize, err = parseSearchInt(params, "max_size"); err != nil {
+		return query, err
+	}
+	offset, err := parseSearchInt(params, "offset")
+	if err != nil {
+		return query, err
+	}
+	query.Offset = int(offset)
+	if params.Get("limit") != "" {
+		limit, err := parseSearchInt(params, "limit")
+		if err != nil || limit == 0 || limit > maxSearchLimit {
+			return query, fmt.Errorf("invalid limit %q, expected 1 to %d", params.Get("limit"), maxSearchLimit)
+		}
+		query.Limit = int(limit)
+	}
+	tags, err := pkg.ParseTags(params["tag"], params["label"])
+	if err != nil {
+		return query, err
+	}
+	query.Tags, query.Labels = tags.Values, tags.Labels
+	return query, nil
+}
+
+func searchVersions(email string, query db.VersionQuery) (pkg.SearchResponse, error) {
+	response := pkg.SearchResponse{Offset: query.Offset, Limit: query.Limit, Results: []pkg.SearchResult{}}
+	found, err := store.SearchVersions(context.Background(), email, query)
+	if err != nil {
+		return response, err
+	}
+	response.Total = found.Total
+	for _, match := range found.Matches {
+		response.Results = append(response.Results, pkg.SearchResult{
+			FileID:      match.File.ID,
+			FileName:    match.File.Name,
+			Directory:   match.File.Path,
+			VersionID:   match.Version.ID,
+			Parent:      match.Version.Parent,
+			Agent:       match.Version.UploadedBy,
+			Size:        match.Version.Size,
+			FileTags:    pkg.Tags{Values: match.File.Tags, Labels: match.File.Labels},
+			VersionTags: pkg.Tags{Values: match.Version.Tags, Labels: match.Version.Labels},
+			UploadedAt:  match.File.UploadedAt,
+			CreatedAt:   match.Version.CreatedAt,
+		})
+	}
+	return response, nil
+}
+
+// searchView finds versions of the user's files by name, directory, dates, agent, size and tags
+func searchView(c echo.Context) error {
+	token := c.Request().Header.Get("Authorization")
+	email, err := validateToken(token)
+	if err != nil {
+		return c.JSON(401, map[string]interface{}{
+			"message": fmt.Sprintf("invalid token %s", err.Error()),
+		})
+	}
+	query, err := parseVersionQuery(c.QueryParams())
+	if err != nil {
+		return c.JSON(400, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	response, err := searchVersions(email, query)
+	if err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": "internal server error",
+		})
+	}
+	return c.JSON(200, response)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVersionQuery(t *testing.T) {
+	params := url.Values{
+		"name":         {"*rc"},
+		"created_from": {"2024-03-01"},
+		"created_to":   {"2024-03-02"},
+		"uploaded_to":  {"2024-03-05T10:00:00Z"},
+		"min_size":     {"10"},
+		"tag":          {"host=laptop"},
+		"label":        {"shell"},
+		"sort":         {"size"},
+		"order":        {"desc"},
+		"offset":       {"20"},
+		"limit":        {"10"},
+	}
+	query, err := parseVersionQuery(params)
+	assert.Nil(t, err)
+	assert.Equal(t, "*rc", query.Name)
+	assert.Equal(t, time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC), query.CreatedFrom)
+	assert.Equal(t, time.Date(2024, time.March, 3, 0, 0, 0, 0, time.UTC), query.CreatedTo, "a closing date includes the whole day")
+	assert.Equal(t, time.Date(2024, time.March, 5, 10, 0, 0, 0, time.UTC), query.UploadedTo)
+	assert.Equal(t, int64(10), query.MinSize)
+	assert.Equal(t, map[string]string{"host": "laptop"}, query.Tags)
+	assert.Equal(t, []string{"shell"}, query.Labels)
+	assert.Equal(t, db.SortSize, query.Sort)
+	assert.True(t, query.Desc)
+	assert.Equal(t, 20, query.Offset)
+	assert.Equal(t, 10, query.Limit)
+
+	query, err = parseVersionQuery(url.Values{})
+	assert.Nil(t, err)
+	assert.Equal(t, db.SortCreated, query.Sort)
+	assert.Equal(t, defaultSearchLimit, query.Limit)
+
+	for key, value := range map[string]string{"sort": "owner", "order": "up", "limit": "0", "min_size": "-1", "created_from": "yesterday", "tag": "=x"} {
+		_, err := parseVersionQuery(url.Values{key: {value}})
+		assert.NotNil(t, err, "%s=%s must be rejected", key, value)
+	}
+}
+
+func TestSearchVersions(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{})
+	assert.Nil(t, createUser("search@gmail.com", "agent", "password"))
+	assert.Nil(t, createUser("other@gmail.com", "agent", "password"))
+
+	for i, name := range []string{".bashrc", ".vimrc", "notes.txt"} {
+		packet := uploadPacket("search@gmail.com", "home/", name)
+		packet.OriginalSize = int64(100 * (i + 1))
+		_, err := uploadFile(packet, blobHash(), "sum")
+		assert.Nil(t, err)
+	}
+	_, err := uploadFile(uploadPacket("other@gmail.com", "home/", ".bashrc"), blobHash(), "sum")
+	assert.Nil(t, err)
+
+	response, err := searchVersions("search@gmail.com", db.VersionQuery{Name: "*rc", Sort: db.SortSize, Desc: true, Limit: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, response.Total)
+	assert.Len(t, response.Results, 1)
+	assert.Equal(t, ".vimrc", response.Results[0].FileName)
+	assert.Equal(t, int64(200), response.Results[0].Size)
+	assert.Equal(t, "agent", response.Results[0].Agent)
+
+	response, err = searchVersions("search@gmail.com", db.VersionQuery{MinSize: 300})
+	assert.Nil(t, err)
+	assert.Len(t, response.Results, 1)
+	assert.Equal(t, "notes.txt", response.Results[0].FileName)
+}
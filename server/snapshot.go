@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+)
+
+const (
+	snapshotPrefix = "metadata-"
+	snapshotLayout = "20060102T150405Z"
+)
+
+// writeDump writes a dump of the metadata store to path, replacing the file atomically
+func writeDump(path string) (*db.Dump, error) {
+	dump, err := db.Export(context.Background(), store)
+	if err != nil {
+		return nil, err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if err := db.WriteDump(tmp, dump); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	return dump, os.Rename(tmp.Name(), path)
+}
+
+// readDump imports the dump at path into the empty metadata store and migrates it to this server's schema
+func readDump(path string) (*db.Dump, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dump, err := db.ReadDump(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Import(context.Background(), store, dump); err != nil {
+		return nil, err
+	}
+	return dump, migrateMetadata(false)
+}
+
+// ExportMetadata writes every user, file and version of the configured metadata store to path
+func ExportMetadata(path string) error {
+	if err := openMetadata(); err != nil {
+		return err
+	}
+	dump, err := writeDump(path)
+	if err != nil {
+		return err
+	}
+	slog.Info("metadata exported", "path", path, "users", dump.Count(db.KindUser), "files", dump.Count(db.KindFile), "versions", dump.Count(db.KindVersion))
+	return nil
+}
+
+// ImportMetadata loads an export into the configured metadata store, which has to be empty
+func ImportMetadata(path string) error {
+	if err := openMetadata(); err != nil {
+		return err
+	}
+	id, _ := uuid.NewUUID()
+	currentServerId = id.String()
+	dump, err := readDump(path)
+	if err != nil {
+		return err
+	}
+	slog.Info("metadata imported", "path", path, "users", dump.Count(db.KindUser), "files", dump.Count(db.KindFile), "versions", dump.Count(db.KindVersion))
+	return nil
+}
+
+// takeSnapshot writes a dump of the metadata store into dir named after the time it was taken at
+func takeSnapshot(dir string, now time.Time) (string, error) {
+	path := filepath.Join(dir, snapshotPrefix+now.UTC().Format(snapshotLayout)+".json")
+	_, err := writeDump(path)
+	return path, err
+}
+
+// pruneSnapshots removes all but the newest keep snapshots in dir and returns how many it removed
+func pruneSnapshots(dir string, keep int) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	snapshots := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.HasPrefix(name, snapshotPrefix) && strings.HasSuffix(name, ".json") {
+			snapshots = append(snapshots, name)
+		}
+	}
+	// names sort by the time they were taken at
+	slices.Sort(snapshots)
+	removed := 0
+	for len(snapshots)-removed > keep {
+		if err := os.Remove(filepath.Join(dir, snapshots[removed])); err != nil {
+			return removed, fmt.Errorf("removing snapshot %s: %w", snapshots[removed], err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// runSnapshots snapshots the metadata store on an interval while this server leads
+func runSnapshots(ctx context.Context) {
+	if cfg.SnapshotInterval <= 0 || cfg.SnapshotDir == "" {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(cfg.SnapshotInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			path, err := takeSnapshot(cfg.SnapshotDir, now)
+			if err != nil {
+				slog.Error("error taking metadata snapshot", "err", err.Error())
+				continue
+			}
+			slog.Info("metadata snapshot taken", "path", path)
+			if cfg.SnapshotRetention <= 0 {
+				continue
+			}
+			removed, err := pruneSnapshots(cfg.SnapshotDir, cfg.SnapshotRetention)
+			if err != nil {
+				slog.Error("error pruning metadata snapshots", "err", err.Error())
+			}
+			if removed > 0 {
+				slog.Info("metadata snapshots pruned", "snapshots", removed)
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshots(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{})
+	assert.Nil(t, migrateMetadata(false))
+	assert.Nil(t, createUser("snapshot@gmail.com", "agent", "password"))
+	versionId, err := uploadFile(uploadPacket("snapshot@gmail.com", "home/", ".bashrc"), blobHash(), "sum")
+	assert.Nil(t, err)
+
+	dir := filepath.Join(t.TempDir(), "snapshots")
+	taken := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	var paths []string
+	for day := range 3 {
+		path, err := takeSnapshot(dir, taken.AddDate(0, 0, day))
+		assert.Nil(t, err)
+		paths = append(paths, path)
+	}
+	assert.Equal(t, "metadata-20240303T120000Z.json", filepath.Base(paths[2]))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0600))
+	removed, err := pruneSnapshots(dir, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	entries, _ := os.ReadDir(dir)
+	assert.Len(t, entries, 3, "the oldest snapshot is gone, other files stay")
+	_, err = os.Stat(paths[0])
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	assert.NotNil(t, func() error { _, err := readDump(paths[2]); return err }(), "dumps only go into empty stores")
+	store = db.NewMemoryStore()
+	dump, err := readDump(paths[2])
+	assert.Nil(t, err)
+	assert.Equal(t, 1, dump.Count(db.KindVersion))
+	_, version, err := findVersion("snapshot@gmail.com", versionId)
+	assert.Nil(t, err)
+	assert.Equal(t, "sum", version.Checksum)
+	schema, _ := store.StoredSchemaVersion(context.Background())
+	assert.Equal(t, db.SchemaVersion, schema)
+}
@@ -12,53 +12,78 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/jafari-mohammad-reza/dotsync/pkg"
 	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
 	"github.com/redis/go-redis/v9"
 )
 
-var storages map[string]pkg.Storage // map storage id to storage => if two storage connect at same time one will read from an empty storage we need to fix that
+var storages map[string]pkg.Storage // local cache of the storage registry kept in redis under storagesKey
 var mu sync.Mutex
 
 func InitStorageService(serverId string, redisClient *redis.Client) error {
+	currentServerId = serverId
 	mu.Lock()
-	defer mu.Unlock()
 	storages = loadStoragesFromRedis(redisClient)
-	go initRegisterSystem(serverId, redisClient)
-	go healthCheckStorages(redisClient)
+	mu.Unlock()
+	startRepairWorkers()
+	onMembershipChange(func(event MembershipEvent) {
+		switch {
+		case event.To == pkg.MemberDead:
+			onStorageLost(event.StorageId)
+		case event.From == "" && event.To == pkg.MemberAlive:
+			triggerRebalance(redisClient)
+		}
+	})
+	go receiveHeartbeats(redisClient)
+	go finaliseTransfers(serverId, redisClient)
+	go followCluster(redisClient)
+	go campaign(serverId, redisClient, func(ctx context.Context) {
+		syncStorages(redisClient)
+		repairs.resume()
+		go initRegisterSystem(ctx, serverId, redisClient)
+		go sweepMembership(ctx, redisClient)
+		go watchRebalanceRequests(ctx, redisClient)
+		go watchDrainRequests(ctx, redisClient)
+		go watchRepairRequests(ctx, redisClient)
+		go watchGCRequests(ctx, redisClient)
+		go runPruner(ctx, redisClient)
+		go runAuditTrimmer(ctx)
+		go runPurger(ctx)
+		go runSnapshots(ctx)
+	})
 
 	select {}
 }
+
+// loadStoragesFromRedis reads the storage registry shared by every server
 func loadStoragesFromRedis(redisClient *redis.Client) map[string]pkg.Storage {
 	activeStorages := make(map[string]pkg.Storage)
 
-	storageIds, err := redisClient.SMembers(context.Background(), "alive-storages").Result()
+	entries, err := redisClient.HGetAll(context.Background(), storagesKey).Result()
 	if err != nil {
 		slog.Error("Failed to fetch active storages", "err", err)
 		return activeStorages
 	}
 
-	for _, storageId := range storageIds {
-		port, err := redisClient.Get(context.Background(), fmt.Sprintf("storage:%s:port", storageId)).Int()
-		if err != nil {
-			slog.Warn("Missing port for storage", "storageId", storageId)
+	for storageId, entry := range entries {
+		var storage pkg.Storage
+		if err := json.Unmarshal([]byte(entry), &storage); err != nil {
+			slog.Warn("Invalid storage entry", "storageId", storageId, "err", err)
 			continue
 		}
-
-		activeStorages[storageId] = pkg.Storage{
-			Id:         storageId,
-			Index:      len(activeStorages) + 1,
-			LastUpdate: time.Now(),
-			Port:       port,
-		}
+		storage.LastUpdate = time.Now()
+		activeStorages[storageId] = storage
 	}
 
 	return activeStorages
 }
 
-func initRegisterSystem(serverId string, redisClient *redis.Client) {
+// initRegisterSystem assigns indexes to joining storages and drops leaving ones, it only runs on the leader
+func initRegisterSystem(ctx context.Context, serverId string, redisClient *redis.Client) {
 	stream := "storage-stream"
 	disconnctStream := "disconnect-stream"
 	group := "storage-index"
@@ -68,205 +93,212 @@ func initRegisterSystem(serverId string, redisClient *redis.Client) {
 	db.CreateConsumerGroup(context.Background(), redisClient, disconnctStream, group)
 
 	go func() {
-		for msg := range db.Consume(context.Background(), redisClient, stream, group, consumer) {
+		for msg := range db.Consume(ctx, redisClient, stream, group, consumer) {
 			storageId := msg.Values["ID"].(string)
 			port := msg.Values["Port"].(string)
 			portNum, _ := strconv.Atoi(port)
+			var labels map[string]string
+			if encoded, ok := msg.Values["Labels"].(string); ok {
+				json.Unmarshal([]byte(encoded), &labels)
+			}
 
-			if _, exists := storages[storageId]; !exists {
-				err := redisClient.SAdd(context.Background(), "alive-storages", storageId).Err()
-				if err != nil {
-					slog.Error("error adding new storage", "err", err.Error())
-				}
-				redisClient.Set(context.Background(), fmt.Sprintf("storage:%s:port", storageId), portNum, 0)
-				storages[storageId] = pkg.Storage{
-					Id:         storageId,
-					Index:      len(storages) + 1,
-					LastUpdate: time.Now(),
-					Port:       portNum,
-				}
+			mu.Lock()
+			_, exists := storages[storageId]
+			if !exists {
+				registerStorage(redisClient, storageId, portNum, labels)
 			}
-			db.DeleteStream(context.Background(), redisClient, stream, msg.ID)
 			storagesMsg, _ := json.Marshal(storages)
+			mu.Unlock()
+			if !exists {
+				emitMembership(redisClient, MembershipEvent{StorageId: storageId, To: pkg.MemberAlive, At: time.Now()})
+			}
+			db.DeleteStream(context.Background(), redisClient, stream, msg.ID)
 			db.Publish(context.Background(), redisClient, updateStream, string(storagesMsg))
 		}
 	}()
 	go func() {
-		for msg := range db.Consume(context.Background(), redisClient, disconnctStream, group, consumer) {
+		for msg := range db.Consume(ctx, redisClient, disconnctStream, group, consumer) {
 			storageId := msg.Values["ID"].(string)
 
-			if _, exists := storages[storageId]; exists {
-				err := redisClient.SRem(context.Background(), "alive-storages", storageId).Err()
-				if err != nil {
-					slog.Error("error removing disconnected storage", "err", err.Error())
-				}
-				redisClient.Del(context.Background(), fmt.Sprintf("storage:%s:port", storageId))
-				delete(storages, storageId)
+			mu.Lock()
+			storage, exists := storages[storageId]
+			if exists {
+				removeStorage(redisClient, storageId)
+			}
+			mu.Unlock()
+			if exists {
+				emitMembership(redisClient, MembershipEvent{StorageId: storageId, From: storage.Status, To: pkg.MemberDead, At: time.Now()})
 			}
 
 			db.DeleteStream(context.Background(), redisClient, disconnctStream, msg.ID)
 		}
 	}()
 }
-func healthCheckStorages(redisClient *redis.Client) {
-	ticker := time.NewTicker(time.Duration(cfg.HealthCheckInterval) * time.Minute)
-	defer ticker.Stop()
-	for range ticker.C {
-		for _, storage := range storages {
-			if time.Since(storage.LastUpdate) > time.Duration(cfg.HealthCheckTimeout)*time.Minute {
-				channel := fmt.Sprintf("%s-health", storage.Id)
-				redisClient.Publish(context.Background(), channel, "ping")
 
-				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-				go func() {
-					defer cancel()
-
-					select {
-					case msg := <-db.Subscribe(context.Background(), redisClient, channel):
-						if msg.Payload == "pong" {
-							storage.LastUpdate = time.Now()
-						}
-					case <-ctx.Done():
-						delete(storages, storage.Id)
-					}
-				}()
-			}
-		}
+// authenticatePacket checks the access token a TCP request carries and makes the user and agent it
+// was issued to the sender, whatever the packet itself claims. The token is not passed on to storages.
+func authenticatePacket(tr *pkg.TransferPacket) error {
+	token := tr.Token
+	tr.Email, tr.Agent, tr.Token = "", "", ""
+	if claims, err := pkg.DecodeToken(token); err == nil {
+		tr.Email, _ = claims["email"].(string)
+		tr.Agent, _ = claims["agent"].(string)
 	}
+	if _, err := validateToken(token); err != nil {
+		return fmt.Errorf("%w: %s", errUnauthenticated, err.Error())
+	}
+	return nil
 }
+
 func HandleConnection(conn net.Conn) error {
 	buf, err := pkg.GetIncomingBuf(conn)
 	if err != nil {
 		slog.Error("Error getting incoming data", "err", err.Error())
+		return err
 	}
 	tr, err := pkg.DeserializePacket(buf.Bytes())
 	if err != nil {
 		slog.Error("Error DeserializePacket", "err", err.Error())
+		return err
+	}
+	if err := authenticatePacket(tr); err != nil {
+		auditPacket(conn.RemoteAddr().String(), tr, tr.Meta["Version"], err)
+		return replyToClient(conn, map[string]string{"Error": err.Error()})
 	}
 	switch tr.Command {
 	case "upload":
-		return handleUpload(tr)
+		versionId, err := handleUpload(tr)
+		auditPacket(conn.RemoteAddr().String(), tr, versionId, err)
+		if err != nil {
+			replyToClient(conn, map[string]string{"Error": err.Error()})
+			return err
+		}
+		return replyToClient(conn, map[string]string{"VersionID": versionId})
 	case "download":
-		return handleDownload(tr, conn)
+		err := handleDownload(tr, conn)
+		auditPacket(conn.RemoteAddr().String(), tr, tr.Meta["Version"], err)
+		if err != nil {
+			replyToClient(conn, map[string]string{"Error": err.Error()})
+		}
+		return err
 	}
 	return nil
 }
-func handleDownload(tr *pkg.TransferPacket, conn net.Conn) error {
-	fileId := tr.Meta["FileID"]
-	versionId, exist := tr.Meta["Version"]
-	user, err := findUser(tr.Email)
+func replyToClient(conn net.Conn, meta map[string]string) error {
+	serialized, err := pkg.SerializePacket(&pkg.TransferPacket{Meta: meta})
 	if err != nil {
 		return err
 	}
-	var file db.File
-	for _, f := range user.Files {
-		if f.ID == fileId {
-			file = f
-			break
-		}
-		continue
-	}
-	var version db.FileVersion
-	if exist {
-		// download specific version
-		for _, v := range file.Versions {
-			if v.ID == versionId {
-				version = v
-				break
-			}
-			continue
-		}
-	} else {
-		// download latest version
-		version = file.Versions[len(file.Versions)-1]
-	}
-	var storage pkg.Storage
-	for _, st := range version.Storages {
-		s, exist := storages[st]
-		if exist {
-			storage = s
-			break
-		}
-		continue
-	}
-	tr.Meta["Hash"] = version.Hash
-	ext := filepath.Ext(file.Name)
-	dirPath := path.Join(file.Path, strings.ReplaceAll(file.Name, ext, ""))
-	dirHash := pkg.HashPath(dirPath)
-	uploadPath := path.Join(tr.Email, dirHash.Filename)
-	tr.Meta["Path"] = uploadPath
-	// TODO: save upload path + upload hash as hash
-	serialized, err := pkg.SerializePacket(tr)
+	return pkg.SendByteToConn(conn, serialized)
+}
+func handleDownload(tr *pkg.TransferPacket, conn net.Conn) error {
+	file, version, err := findFileVersion(tr.Email, tr.Meta["FileID"], tr.Meta["Version"])
 	if err != nil {
 		return err
 	}
-	responseConn, err := pkg.SendDataOverTcp(storage.Port, int64(len(serialized)), serialized)
+	data, err := readVersion(versionPath(tr.Email, *file, *version), *version)
 	if err != nil {
 		return err
 	}
-	data, err := pkg.ReadConnBuffers(responseConn)
-	if err != nil {
-		return err
+	packet := pkg.TransferPacket{
+		Compressed:   data,
+		OriginalSize: int64(len(data)),
+		Meta:         map[string]string{"FileName": file.Name},
 	}
-	packet, err := pkg.DeserializePacket(data)
+	sendData, err := pkg.SerializePacket(&packet)
 	if err != nil {
 		return err
 	}
-	packet.Meta = map[string]string{"FileName": file.Name}
-	sendData, err := pkg.SerializePacket(packet)
-	if err != nil {
-		return err
+	return pkg.SendByteToConn(conn, sendData)
+}
+
+// storagePath is the directory on storages holding the versions of a user's file. It hashes the
+// file's identity, so every file gets its own directory whatever characters its name contains.
+func storagePath(email, dir, fileName string) string {
+	return path.Join(email, pkg.HashPath(db.PathKey(dir, fileName)).Filename)
+}
+
+// legacyStoragePath is where versions were stored before they recorded their directory. Dropping the
+// extension and joining directory and name made different files share it.
+func legacyStoragePath(email, dir, fileName string) string {
+	ext := filepath.Ext(fileName)
+	dirPath := path.Join(dir, strings.ReplaceAll(fileName, ext, ""))
+	dirHash := pkg.HashPath(dirPath)
+	return path.Join(email, dirHash.Filename)
+}
+
+// versionPath is the directory on storages holding a version
+func versionPath(email string, file db.File, version db.FileVersion) string {
+	if version.BlobDir != "" {
+		return version.BlobDir
 	}
-	err = pkg.SendByteToConn(conn, sendData)
-	if err != nil {
-		return err
+	return legacyStoragePath(email, file.Path, file.Name)
+}
+
+// blobHashLayout is the layout of the time a blob hash starts with
+const blobHashLayout = "20060102150405"
+
+// blobHash names a new version's blob, unique even for uploads of one file in the same second
+func blobHash() string {
+	return fmt.Sprintf("%s_%s", time.Now().UTC().Format(blobHashLayout), strings.ReplaceAll(uuid.New().String(), "-", ""))
+}
+
+// blobCreatedAt reads when blobHash named a blob, blobs named otherwise have no known time
+func blobCreatedAt(blob string) (time.Time, bool) {
+	stamp, _, found := strings.Cut(path.Base(blob), "_")
+	if !found {
+		return time.Time{}, false
 	}
-	defer responseConn.Close()
-	return nil
+	createdAt, err := time.Parse(blobHashLayout, stamp)
+	return createdAt, err == nil
 }
-func handleUpload(tr *pkg.TransferPacket) error {
-	email := tr.SenderMeta.Email
+
+// handleUpload records a new version, sends it to the storages placement picks and returns its id
+func handleUpload(tr *pkg.TransferPacket) (string, error) {
+	email := tr.Email
 	user, err := findUser(email)
 	if err != nil {
-		return err
+		return "", err
 	}
 	if user == nil {
-		return errors.New("user not found")
+		return "", errors.New("user not found")
+	}
+	if err := pkg.ValidateFileName(tr.Meta["FileName"]); err != nil {
+		return "", err
+	}
+	uploadPath := storagePath(tr.Email, tr.Meta["Dir"], tr.Meta["FileName"])
+	writeHash := blobHash()
+	targets, err := placeReplicas(writeHash, replicationFactor(), nil, nil)
+	if err == nil && len(targets) == 0 {
+		err = errors.New("no storage available")
 	}
-	fileName := tr.Meta["FileName"]
-	dir := tr.Meta["Dir"]
-	ext := filepath.Ext(fileName)
-	dirPath := path.Join(dir, strings.ReplaceAll(fileName, ext, ""))
-	dirHash := pkg.HashPath(dirPath)
-	uploadPath := path.Join(tr.Email, dirHash.Filename)
-	uploadHash := pkg.HashPath(uploadPath)
-	writeHash := fmt.Sprintf("%s_%s", time.Now().UTC().Format("20060102150405"), uploadHash.Filename)
-	err = uploadFile(tr, writeHash)
+	if err != nil {
+		return "", err
+	}
+	versionId, err := uploadFile(tr, writeHash, pkg.Checksum(tr.Compressed))
 	if err != nil {
 		slog.Error("error inserting upload", "err", err)
-		return err
+		return "", err
 	}
+	var stored atomic.Int32
 	wg := sync.WaitGroup{}
-	wg.Add(len(storages))
-	for _, storage := range storages {
+	wg.Add(len(targets))
+	for _, storage := range targets {
 		go func(storage pkg.Storage) {
-			tr.Meta["UploadedIn"] = time.Now().String()
-			tr.Meta["UploadPath"] = uploadPath
-			tr.Meta["UploadHash"] = writeHash
-			tr.SenderMeta.Application = "server"
-			serialized, err := pkg.SerializePacket(tr)
-			if err != nil {
-				slog.Error("error serializing file", "err", err)
-			}
-			conn, err := pkg.SendDataOverTcp(storage.Port, int64(len(serialized)), serialized)
-			if err != nil {
+			defer wg.Done()
+			if err := pushToStorage(storage, uploadPath, writeHash, tr.Compressed); err != nil {
 				slog.Error("error sending data to storage", "err", err)
+				return
+			}
+			stored.Add(1)
+			if err := addVersionStorage(versionId, storage.Id); err != nil {
+				slog.Error("error recording storage of upload", "storage", storage.Id, "err", err)
 			}
-			updateFileStorages(tr, writeHash, storage.Id)
-			defer conn.Close()
-			defer wg.Done()
 		}(storage)
 	}
 	wg.Wait()
-	return nil
+	if stored.Load() == 0 {
+		return "", errors.Join(errors.New("no storage accepted the upload"), discardVersion(versionId))
+	}
+	return versionId, nil
 }
@@ -3,6 +3,8 @@ package server
 import (
 	"context"
 	"fmt"
+	"net"
+	"path"
 	"testing"
 	"time"
 
@@ -15,10 +17,10 @@ func TestRegisterSystem(t *testing.T) {
 
 	storages = make(map[string]pkg.Storage)
 
-	redisClient := db.NewRedisClient()
+	redisClient := db.NewRedisClient("")
 	assert.Len(t, storages, 0)
 
-	initRegisterSystem("server1", redisClient)
+	initRegisterSystem(context.Background(), "server1", redisClient)
 	time.Sleep(1 * time.Second)
 
 	for i := 0; i < 2; i++ {
@@ -45,3 +47,35 @@ func TestRegisterSystem(t *testing.T) {
 
 	fmt.Println("Storage count after removal:", len(storages))
 }
+
+func TestUploadRollback(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{})
+	assert.Nil(t, createUser("rollback@gmail.com", "agent", "password"))
+	listener, err := net.Listen("tcp", ":0")
+	assert.Nil(t, err)
+	closedPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	storages = map[string]pkg.Storage{}
+	_, err = handleUpload(uploadPacket("rollback@gmail.com", "home/", ".bashrc"))
+	assert.NotNil(t, err, "uploads fail without storages")
+	storages = map[string]pkg.Storage{"down": {Id: "down", Port: closedPort}}
+	_, err = handleUpload(uploadPacket("rollback@gmail.com", "home/", ".bashrc"))
+	assert.NotNil(t, err, "uploads fail when no storage takes them")
+
+	uploads, _ := getUserUploads("rollback@gmail.com", pkg.Tags{})
+	assert.Empty(t, uploads, "failed uploads leave no version behind")
+	usage, _ := store.GetUsage(context.Background(), "rollback@gmail.com")
+	assert.Equal(t, db.Usage{}, *usage)
+
+	up := startTestStorage(t, "up")
+	storages = map[string]pkg.Storage{"up": up.Storage}
+	packet := uploadPacket("rollback@gmail.com", "home/", ".bashrc")
+	packet.Compressed = []byte("compressed")
+	versionId, err := handleUpload(packet)
+	assert.Nil(t, err)
+	file, version, _ := findVersion("rollback@gmail.com", versionId)
+	assert.Equal(t, []string{"up"}, version.Storages)
+	blob := path.Join(versionPath("rollback@gmail.com", *file, *version), version.Hash)
+	assert.Eventually(t, func() bool { return up.holds(blob) }, time.Second, 10*time.Millisecond, "storages take uploads the server signed")
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/labstack/echo/v4"
+)
+
+// bindTags reads the tags of a request, replying itself when they are invalid
+func bindTags(c echo.Context) (string, pkg.Tags, bool) {
+	var tags pkg.Tags
+	email, err := validateToken(c.Request().Header.Get("Authorization"))
+	if err != nil {
+		c.JSON(401, map[string]interface{}{
+			"message": fmt.Sprintf("invalid token %s", err.Error()),
+		})
+		return "", tags, false
+	}
+	if err := c.Bind(&tags); err != nil {
+		c.JSON(400, map[string]interface{}{
+			"message": "invalid request",
+		})
+		return "", tags, false
+	}
+	if err := tags.Validate(); err != nil {
+		c.JSON(400, map[string]interface{}{
+			"message": err.Error(),
+		})
+		return "", tags, false
+	}
+	return email, tags, true
+}
+
+// setFileTags replaces the tags and labels of one of the user's files
+func setFileTags(c echo.Context) error {
+	email, tags, ok := bindTags(c)
+	if !ok {
+		return nil
+	}
+	file, err := findFile(email, c.Param("id"))
+	if err == nil && file.DeletedAt != "" {
+		err = fmt.Errorf("file %s is in the trash", file.ID)
+	}
+	if err != nil {
+		return c.JSON(404, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	if err := store.SetFileTags(context.Background(), file.ID, tags.Values, tags.Labels); err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": "internal server error",
+		})
+	}
+	return c.JSON(200, tags)
+}
+
+// setVersionTags replaces the tags and labels of one version of the user's files
+func setVersionTags(c echo.Context) error {
+	email, tags, ok := bindTags(c)
+	if !ok {
+		return nil
+	}
+	_, version, err := findFileVersion(email, c.Param("id"), c.Param("version"))
+	if err != nil {
+		return c.JSON(404, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	if err := store.SetVersionTags(context.Background(), version.ID, tags.Values, tags.Labels); err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": "internal server error",
+		})
+	}
+	return c.JSON(200, tags)
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	confirmStream = "transfer-confirmations"
+	confirmGroup  = "transfer-finalise"
+	// confirmGrace is how long after its tickets expire a direct upload can still be confirmed
+	confirmGrace      = time.Minute
+	finaliseLockTTL   = 10 * time.Second
+	finaliseLockTries = 50
+)
+
+func pendingUploadKey(versionId string) string { return "pending-upload:" + versionId }
+func finaliseLockKey(versionId string) string  { return "finalise-lock:" + versionId }
+
+// pendingUpload is a direct upload clients hold tickets for. Its version is only recorded once a
+// storage confirms receiving it, and the upload is forgotten when nothing confirms it in time.
+type pendingUpload struct {
+	File    db.File        `json:"file"`
+	Version db.FileVersion `json:"version"`
+	Parent  string         `json:"parent"`
+}
+
+func ticketTTL() time.Duration {
+	if cfg.TicketTTL <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(cfg.TicketTTL) * time.Second
+}
+
+func issueTickets(ticket pkg.Ticket, targets []pkg.Storage) ([]pkg.TransferTicket, error) {
+	tickets := []pkg.TransferTicket{}
+	for _, storage := range targets {
+		ticket.StorageId = storage.Id
+		signed, err := pkg.IssueTicket(ticket, uuid.New().String(), ticketTTL())
+		if err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, pkg.TransferTicket{StorageId: storage.Id, Port: storage.Port, Ticket: signed})
+	}
+	return tickets, nil
+}
+
+// storageTicket signs ticket for a request the server itself makes to a storage
+func storageTicket(storage pkg.Storage, ticket pkg.Ticket) (string, error) {
+	ticket.StorageId = storage.Id
+	return pkg.IssueTicket(ticket, uuid.New().String(), ticketTTL())
+}
+
+// uploadTickets records a pending upload and lets the client push it straight to the chosen storages,
+// its version is recorded when the first of them confirms the transfer
+func uploadTickets(c echo.Context) error {
+	token := c.Request().Header.Get("Authorization")
+	email, err := validateToken(token)
+	if err != nil {
+		return c.JSON(401, map[string]interface{}{
+			"message": fmt.Sprintf("invalid token %s", err.Error()),
+		})
+	}
+	var body pkg.UploadTicketBody
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(400, map[string]interface{}{
+			"message": "invalid request",
+		})
+	}
+	if err := c.Validate(&body); err != nil {
+		return c.JSON(400, map[string]interface{}{
+			"message": "invalid request",
+		})
+	}
+	claims, _ := pkg.DecodeToken(token)
+	agent, _ := claims["agent"].(string)
+	if err := pkg.ValidateFileName(body.FileName); err != nil {
+		return c.JSON(400, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	if err := errors.Join(body.FileTags.Validate(), body.VersionTags.Validate()); err != nil {
+		return c.JSON(400, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	uploadPath := storagePath(email, body.Directory, body.FileName)
+	writeHash := blobHash()
+	targets, err := placeReplicas(writeHash, replicationFactor(), nil, nil)
+	if err != nil || len(targets) == 0 {
+		return c.JSON(503, map[string]interface{}{
+			"message": "no storage available",
+		})
+	}
+	tr := &pkg.TransferPacket{
+		OriginalSize: body.Size,
+		Meta:         map[string]string{"FileName": body.FileName, "Dir": body.Directory, "UploadedIn": time.Now().String(), "ParentVersion": body.ParentVersion},
+		SenderMeta:   pkg.SenderMeta{Email: email, Agent: agent, Application: "client"},
+	}
+	pkg.EncodeTags(tr.Meta, "FileTags", body.FileTags)
+	pkg.EncodeTags(tr.Meta, "VersionTags", body.VersionTags)
+	file, version, err := newVersion(tr, writeHash, body.Checksum)
+	if err == nil {
+		err = errors.Join(checkQuota(email, file.Path, file.Name, version.Size), checkParent(email, file.Path, file.Name, body.ParentVersion))
+	}
+	if errors.Is(err, db.ErrConflict) {
+		return c.JSON(409, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		return c.JSON(403, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	if err == nil {
+		err = savePendingUpload(redisClient, pendingUpload{File: file, Version: version, Parent: body.ParentVersion})
+	}
+	if err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": "internal server error",
+		})
+	}
+	versionId := version.ID
+	tickets, err := issueTickets(pkg.Ticket{
+		Operation:  pkg.TicketUpload,
+		Email:      email,
+		VersionId:  versionId,
+		UploadPath: uploadPath,
+		Hash:       writeHash,
+		Checksum:   body.Checksum,
+	}, targets)
+	if err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": "internal server error",
+		})
+	}
+	return c.JSON(200, pkg.TicketsResponse{VersionId: versionId, FileName: body.FileName, Checksum: body.Checksum, Tickets: tickets})
+}
+
+// downloadTickets lets the client read a version from its replicas, best ranked first
+func downloadTickets(c echo.Context) error {
+	email, err := validateToken(c.Request().Header.Get("Authorization"))
+	if err != nil {
+		return c.JSON(401, map[string]interface{}{
+			"message": fmt.Sprintf("invalid token %s", err.Error()),
+		})
+	}
+	file, version, err := findFileVersion(email, c.QueryParam("id"), c.QueryParam("version"))
+	if err != nil {
+		return c.JSON(404, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	tickets, err := issueTickets(pkg.Ticket{
+		Operation:  pkg.TicketDownload,
+		Email:      email,
+		VersionId:  version.ID,
+		UploadPath: versionPath(email, *file, *version),
+		Hash:       version.Hash,
+		Checksum:   version.Checksum,
+	}, rankReplicas(version.Storages))
+	if err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": "internal server error",
+		})
+	}
+	if len(tickets) == 0 {
+		return c.JSON(503, map[string]interface{}{
+			"message": "no replica available",
+		})
+	}
+	return c.JSON(200, pkg.TicketsResponse{VersionId: version.ID, FileName: file.Name, Checksum: version.Checksum, Tickets: tickets})
+}
+
+// savePendingUpload keeps upload until its tickets expire and confirmations had time to arrive
+func savePendingUpload(redisClient *redis.Client, upload pendingUpload) error {
+	entry, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return redisClient.Set(context.Background(), pendingUploadKey(upload.Version.ID), entry, ticketTTL()+confirmGrace).Err()
+}
+
+// loadPendingUpload returns nil without an error when the upload was finalised or expired
+func loadPendingUpload(redisClient *redis.Client, versionId string) (*pendingUpload, error) {
+	entry, err := redisClient.Get(context.Background(), pendingUploadKey(versionId)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var upload pendingUpload
+	return &upload, json.Unmarshal([]byte(entry), &upload)
+}
+
+// pendingBlobs marks the blobs of direct uploads still waiting for confirmation as referenced, their
+// version is not recorded yet while storages may already hold them
+func pendingBlobs(redisClient *redis.Client, referenced map[string]bool) error {
+	iter := redisClient.Scan(context.Background(), 0, pendingUploadKey("*"), 1000).Iterator()
+	for iter.Next(context.Background()) {
+		upload, err := loadPendingUpload(redisClient, strings.TrimPrefix(iter.Val(), pendingUploadKey("")))
+		if err != nil {
+			return err
+		}
+		if upload != nil {
+			referenced[path.Join(versionPath(upload.File.Owner, upload.File, upload.Version), upload.Version.Hash)] = true
+		}
+	}
+	return iter.Err()
+}
+
+// confirmUpload records that storageId holds a direct upload, recording its version on the first
+// confirmation. upload is nil once the upload expired.
+func confirmUpload(upload *pendingUpload, email, versionId, storageId string) error {
+	if _, _, err := findVersion(email, versionId); err == nil {
+		return addVersionStorage(versionId, storageId)
+	}
+	if upload == nil || upload.File.Owner != email || upload.Version.ID != versionId {
+		return fmt.Errorf("upload of version %s expired before a storage confirmed it", versionId)
+	}
+	upload.Version.Storages = []string{storageId}
+	_, err := recordVersion(upload.File, upload.Version, upload.Parent)
+	return err
+}
+
+// finaliseUpload confirms a direct upload while holding a lock on its version, so storages confirming
+// at once through different servers do not both record it
+func finaliseUpload(redisClient *redis.Client, serverId, email, versionId, storageId string) error {
+	ctx := context.Background()
+	for attempt := 1; ; attempt++ {
+		acquired, err := redisClient.SetNX(ctx, finaliseLockKey(versionId), serverId, finaliseLockTTL).Result()
+		if err != nil {
+			return err
+		}
+		if acquired {
+			break
+		}
+		if attempt == finaliseLockTries {
+			return fmt.Errorf("version %s is being finalised by another server", versionId)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	defer redisClient.Del(ctx, finaliseLockKey(versionId))
+	upload, err := loadPendingUpload(redisClient, versionId)
+	if err != nil {
+		return err
+	}
+	if err := confirmUpload(upload, email, versionId, storageId); err != nil {
+		return err
+	}
+	return redisClient.Del(ctx, pendingUploadKey(versionId)).Err()
+}
+
+// finaliseTransfers records direct uploads and adds storages to their versions once they confirm receiving them
+func finaliseTransfers(serverId string, redisClient *redis.Client) {
+	db.CreateConsumerGroup(context.Background(), redisClient, confirmStream, confirmGroup)
+	for msg := range db.Consume(context.Background(), redisClient, confirmStream, confirmGroup, serverId) {
+		email, _ := msg.Values["Email"].(string)
+		versionId, _ := msg.Values["VersionID"].(string)
+		storageId, _ := msg.Values["StorageID"].(string)
+		err := finaliseUpload(redisClient, serverId, email, versionId, storageId)
+		if err != nil {
+			slog.Error("error finalising direct upload", "version", versionId, "storage", storageId, "err", err.Error())
+		}
+		db.DeleteStream(context.Background(), redisClient, confirmStream, msg.ID)
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfirmUpload(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{})
+	assert.Nil(t, createUser("direct@gmail.com", "agent", "password"))
+	packet := uploadPacket("direct@gmail.com", "home/", ".bashrc")
+	packet.OriginalSize = 100
+	file, version, err := newVersion(packet, blobHash(), "sum")
+	assert.Nil(t, err)
+	upload := &pendingUpload{File: file, Version: version}
+
+	uploads, _ := getUserUploads("direct@gmail.com", pkg.Tags{})
+	assert.Empty(t, uploads, "pending uploads have no version yet")
+	usage, _ := store.GetUsage(context.Background(), "direct@gmail.com")
+	assert.Zero(t, usage.Bytes, "pending uploads do not count towards quotas")
+
+	assert.NotNil(t, confirmUpload(nil, "direct@gmail.com", version.ID, "storage1"), "expired uploads are not recorded")
+	assert.NotNil(t, confirmUpload(upload, "other@gmail.com", version.ID, "storage1"))
+	assert.Nil(t, confirmUpload(upload, "direct@gmail.com", version.ID, "storage1"))
+	assert.Nil(t, confirmUpload(nil, "direct@gmail.com", version.ID, "storage2"), "later confirmations add their storage")
+	_, confirmed, err := findVersion("direct@gmail.com", version.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"storage1", "storage2"}, confirmed.Storages)
+	usage, _ = store.GetUsage(context.Background(), "direct@gmail.com")
+	assert.Equal(t, int64(100), usage.Bytes)
+
+	assert.Nil(t, checkParent("direct@gmail.com", "home/", ".bashrc", ""))
+	assert.Nil(t, checkParent("direct@gmail.com", "home/", ".bashrc", version.ID))
+	assert.True(t, errors.Is(checkParent("direct@gmail.com", "home/", ".bashrc", "stale"), db.ErrConflict))
+	assert.True(t, errors.Is(checkParent("direct@gmail.com", "home/", ".vimrc", version.ID), db.ErrConflict))
+
+	packet.Meta["ParentVersion"] = "stale"
+	file, stale, _ := newVersion(packet, blobHash(), "sum")
+	err = confirmUpload(&pendingUpload{File: file, Version: stale, Parent: "stale"}, "direct@gmail.com", stale.ID, "storage1")
+	assert.True(t, errors.Is(err, db.ErrConflict), "uploads based on an old version are refused when confirmed")
+}
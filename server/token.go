@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	errInvalidRefreshToken = errors.New("invalid refresh token")
+	// errUnauthenticated means a TCP request came without a valid access token
+	errUnauthenticated = errors.New("invalid token")
+	errTokenRevoked    = errors.New("token was revoked")
+)
+
+func accessTokenTTL() time.Duration {
+	if cfg.AccessTokenTTL <= 0 {
+		return 15 * time.Minute
+	}
+	return time.Duration(cfg.AccessTokenTTL) * time.Second
+}
+
+func refreshTokenTTL() time.Duration {
+	if cfg.RefreshTokenTTL <= 0 {
+		return 30 * 24 * time.Hour
+	}
+	return time.Duration(cfg.RefreshTokenTTL) * time.Second
+}
+
+// refreshDigest is what the server keeps of a refresh token's id, enough to recognise it but not to forge it
+func refreshDigest(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// agentSwapTries bounds how often swapAgent starts over after other requests changed the agent
+const agentSwapTries = 10
+
+// swapAgent saves change applied to the agent of a user named agentName, as long as no other request
+// changed the agent since it was read. When one did, change is applied again to the agent as it is now,
+// so a revoke and a login racing each other both take effect.
+func swapAgent(email, agentName string, change func(agent db.Agent) db.Agent) (db.Agent, error) {
+	for try := 1; ; try++ {
+		user, err := findUser(email)
+		if err != nil {
+			return db.Agent{}, err
+		}
+		if user == nil {
+			return db.Agent{}, fmt.Errorf("user %s: %w", email, db.ErrNotFound)
+		}
+		index := slices.IndexFunc(user.Agents, func(agent db.Agent) bool { return agent.Name == agentName })
+		if index == -1 {
+			return db.Agent{}, fmt.Errorf("agent %s: %w", agentName, db.ErrNotFound)
+		}
+		current := user.Agents[index]
+		agent := change(current)
+		err = store.SwapAgent(context.Background(), email, current, agent)
+		if errors.Is(err, db.ErrConflict) && try < agentSwapTries {
+			continue
+		}
+		return agent, err
+	}
+}
+
+// issueTokens gives an agent of a user a new access token and a new refresh token, the refresh
+// token the agent had before stops working
+func issueTokens(email, agentName string) (*pkg.InvokeResponse, error) {
+	var refreshId string
+	agent, err := swapAgent(email, agentName, func(agent db.Agent) db.Agent {
+		agent, refreshId = renewAgent(agent)
+		return agent
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signTokens(email, agent, refreshId)
+}
+
+// renewAgent gives an agent a new refresh token and returns it with the token's id
+func renewAgent(agent db.Agent) (db.Agent, string) {
+	now := time.Now()
+	refreshId := uuid.New().String()
+	agent.RefreshToken = refreshDigest(refreshId)
+	agent.RefreshExpiresAt = now.Add(refreshTokenTTL()).Format(time.RFC3339)
+	agent.LastRequest = now.Format(time.DateOnly)
+	return agent, refreshId
+}
+
+func signTokens(email string, agent db.Agent, refreshId string) (*pkg.InvokeResponse, error) {
+	token, err := pkg.GenerateApiKey(email, agent.Name, agent.Generation, accessTokenTTL())
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := pkg.GenerateRefreshToken(email, agent.Name, refreshId, agent.Generation, refreshTokenTTL())
+	if err != nil {
+		return nil, err
+	}
+	return &pkg.InvokeResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresAt:    time.Now().Add(accessTokenTTL()).Format(time.RFC3339),
+	}, nil
+}
+
+// refreshTokens trades the refresh token an agent was last issued for a new pair and returns the
+// email of its user. Each refresh token works once, and not at all once its agent was revoked: the
+// agent is only renewed while it still holds the token, so of two refreshes racing one fails.
+func refreshTokens(refreshToken string) (string, *pkg.InvokeResponse, error) {
+	claims, err := pkg.DecodeRefreshToken(refreshToken)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %s", errInvalidRefreshToken, err.Error())
+	}
+	email, _ := claims["email"].(string)
+	agentName, _ := claims["agent"].(string)
+	id, _ := claims["jti"].(string)
+	user, err := findUser(email)
+	if err != nil {
+		return email, nil, err
+	}
+	if user == nil {
+		return email, nil, errInvalidRefreshToken
+	}
+	index := slices.IndexFunc(user.Agents, func(agent db.Agent) bool { return agent.Name == agentName })
+	if index == -1 {
+		return email, nil, fmt.Errorf("%w: agent was revoked", errInvalidRefreshToken)
+	}
+	agent := user.Agents[index]
+	if pkg.TokenGeneration(claims) != agent.Generation {
+		return email, nil, fmt.Errorf("%w: token was revoked", errInvalidRefreshToken)
+	}
+	if agent.RefreshToken == "" || subtle.ConstantTimeCompare([]byte(agent.RefreshToken), []byte(refreshDigest(id))) != 1 {
+		return email, nil, fmt.Errorf("%w: token was already used or replaced", errInvalidRefreshToken)
+	}
+	if expiresAt, err := time.Parse(time.RFC3339, agent.RefreshExpiresAt); err != nil || time.Now().After(expiresAt) {
+		return email, nil, fmt.Errorf("%w: token expired", errInvalidRefreshToken)
+	}
+	renewed, refreshId := renewAgent(agent)
+	err = store.SwapAgent(context.Background(), email, agent, renewed)
+	if errors.Is(err, db.ErrConflict) || errors.Is(err, db.ErrNotFound) {
+		return email, nil, fmt.Errorf("%w: token was already used or replaced", errInvalidRefreshToken)
+	}
+	if err != nil {
+		return email, nil, err
+	}
+	tokens, err := signTokens(email, renewed, refreshId)
+	return email, tokens, err
+}
+
+// revokeAgents signs out the agents of a user revoke selects by raising their token generation, so
+// every access and refresh token they hold stops working at once. Agents stay listed and log in again.
+func revokeAgents(email string, revoke func(agent db.Agent) bool) (int, error) {
+	user, err := findUser(email)
+	if err != nil {
+		return 0, err
+	}
+	if user == nil {
+		return 0, fmt.Errorf("user %s: %w", email, db.ErrNotFound)
+	}
+	revoked := 0
+	for _, agent := range user.Agents {
+		if !revoke(agent) {
+			continue
+		}
+		_, err := swapAgent(email, agent.Name, func(agent db.Agent) db.Agent {
+			agent.Generation++
+			agent.RefreshToken, agent.RefreshExpiresAt = "", ""
+			return agent
+		})
+		if errors.Is(err, db.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+// revokeOtherAgents signs out every agent of a user but keep, all of them when keep is empty
+func revokeOtherAgents(email, keep string) error {
+	_, err := revokeAgents(email, func(agent db.Agent) bool { return agent.Name != keep })
+	return err
+}
+
+func refreshTokenView(c echo.Context) error {
+	var body pkg.RefreshBody
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(400, map[string]interface{}{
+			"message": "invalid request",
+		})
+	}
+	if err := c.Validate(&body); err != nil {
+		return c.JSON(400, map[string]interface{}{
+			"message": "invalid request",
+		})
+	}
+	email, tokens, err := refreshTokens(body.RefreshToken)
+	c.Set(auditActorKey, email)
+	if errors.Is(err, errInvalidRefreshToken) {
+		return c.JSON(401, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": "internal server error",
+		})
+	}
+	return c.JSON(200, tokens)
+}
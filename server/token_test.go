@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// sendPacket hands tr to HandleConnection over an in-memory connection and returns the reply
+func sendPacket(t *testing.T, tr *pkg.TransferPacket) *pkg.TransferPacket {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		HandleConnection(server)
+	}()
+	serialized, err := pkg.SerializePacket(tr)
+	assert.Nil(t, err)
+	assert.Nil(t, binary.Write(client, binary.BigEndian, int64(len(serialized))))
+	_, err = client.Write(serialized)
+	assert.Nil(t, err)
+	response, err := pkg.ReadConnBuffers(client)
+	assert.Nil(t, err)
+	reply, err := pkg.DeserializePacket(response)
+	assert.Nil(t, err)
+	return reply
+}
+
+func TestRefreshTokens(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{AccessTokenTTL: 60})
+	assert.Nil(t, createUser("refresh@gmail.com", "laptop", "password"))
+
+	issued, err := issueTokens("refresh@gmail.com", "laptop")
+	assert.Nil(t, err)
+	email, err := validateToken(issued.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, "refresh@gmail.com", email)
+	expiresAt, _ := time.Parse(time.RFC3339, issued.ExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), expiresAt, 2*time.Second)
+	_, err = validateToken(issued.RefreshToken)
+	assert.NotNil(t, err, "refresh tokens do not grant access")
+
+	email, refreshed, err := refreshTokens(issued.RefreshToken)
+	assert.Nil(t, err)
+	assert.Equal(t, "refresh@gmail.com", email)
+	_, err = validateToken(refreshed.Token)
+	assert.Nil(t, err)
+	_, _, err = refreshTokens(issued.RefreshToken)
+	assert.True(t, errors.Is(err, errInvalidRefreshToken), "refresh tokens work once")
+	_, _, err = refreshTokens(refreshed.Token)
+	assert.True(t, errors.Is(err, errInvalidRefreshToken), "access tokens do not refresh")
+
+	assert.Nil(t, deleteAgent("refresh@gmail.com", "laptop"))
+	_, _, err = refreshTokens(refreshed.RefreshToken)
+	assert.True(t, errors.Is(err, errInvalidRefreshToken), "revoked agents cannot refresh")
+
+	expired, err := pkg.GenerateApiKey("refresh@gmail.com", "laptop", 0, -time.Minute)
+	assert.Nil(t, err)
+	_, err = validateToken(expired)
+	assert.NotNil(t, err)
+	reply := sendPacket(t, &pkg.TransferPacket{Command: "download", Meta: map[string]string{"FileID": "f1"},
+		SenderMeta: pkg.SenderMeta{Email: "refresh@gmail.com", Agent: "laptop", Token: expired}})
+	assert.Contains(t, reply.Meta["Error"], "invalid token", "expired tokens are refused over TCP")
+	entries, _ := auditTrail(db.AuditQuery{Actor: "refresh@gmail.com"})
+	assert.Empty(t, entries, "refused packets are not put on the user they name")
+}
+
+func TestConcurrentRefresh(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{})
+	assert.Nil(t, createUser("race@gmail.com", "laptop", "password"))
+	issued, err := issueTokens("race@gmail.com", "laptop")
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	var succeeded atomic.Int32
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := refreshTokens(issued.RefreshToken); err == nil {
+				succeeded.Add(1)
+			} else {
+				assert.True(t, errors.Is(err, errInvalidRefreshToken))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), succeeded.Load(), "a refresh token is traded once however many use it at the same time")
+}
+
+func TestConcurrentLoginAndRevoke(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{})
+	assert.Nil(t, createUser("revoke-race@gmail.com", "laptop", "password"))
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := issueTokens("revoke-race@gmail.com", "laptop")
+			assert.Nil(t, err)
+		}()
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, revokeOtherAgents("revoke-race@gmail.com", ""))
+		}()
+	}
+	wg.Wait()
+	user, _ := findUser("revoke-race@gmail.com")
+	assert.Equal(t, 10, user.Agents[0].Generation, "no revoke is undone by a login saving the agent it read before")
+}
+
+func TestPacketIdentity(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{})
+	assert.Nil(t, createUser("victim@gmail.com", "laptop", "password"))
+	assert.Nil(t, createUser("attacker@gmail.com", "laptop", "password"))
+	versionId, err := uploadFile(uploadPacket("victim@gmail.com", "home/", ".bashrc"), blobHash(), "sum")
+	assert.Nil(t, err)
+	version, _ := store.GetVersion(context.Background(), versionId)
+	attacker, _ := issueTokens("attacker@gmail.com", "laptop")
+	meta := map[string]string{"FileID": version.FileID, "Version": versionId}
+
+	tr := &pkg.TransferPacket{Command: "download", Meta: meta,
+		SenderMeta: pkg.SenderMeta{Email: "victim@gmail.com", Agent: "laptop", Token: attacker.Token}}
+	assert.Nil(t, authenticatePacket(tr))
+	assert.Equal(t, "attacker@gmail.com", tr.Email, "the token decides who is asking")
+	assert.Empty(t, tr.Token, "tokens are not passed on to storages")
+	reply := sendPacket(t, &pkg.TransferPacket{Command: "download", Meta: meta,
+		SenderMeta: pkg.SenderMeta{Email: "victim@gmail.com", Agent: "laptop", Token: attacker.Token}})
+	assert.NotEmpty(t, reply.Meta["Error"], "other users' files cannot be downloaded")
+	entries, _ := auditTrail(db.AuditQuery{Actor: "victim@gmail.com"})
+	assert.Empty(t, entries)
+
+	tr = &pkg.TransferPacket{Command: "download", SenderMeta: pkg.SenderMeta{Email: "victim@gmail.com", Agent: "laptop"}}
+	assert.True(t, errors.Is(authenticatePacket(tr), errUnauthenticated))
+	assert.Empty(t, tr.Email, "packets without a token have no identity")
+}
+
+func TestRevokeTokens(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{})
+	assert.Nil(t, createUser("revoke@gmail.com", "laptop", "password"))
+	assert.Nil(t, updateAgents("revoke@gmail.com", "desktop"))
+	laptop, _ := issueTokens("revoke@gmail.com", "laptop")
+	desktop, _ := issueTokens("revoke@gmail.com", "desktop")
+
+	revoke := func(token, query string) int {
+		req := httptest.NewRequest("GET", "/api/revoke-token"+query, nil)
+		req.Header.Set("Authorization", token)
+		rec := httptest.NewRecorder()
+		assert.Nil(t, revokeToken(echo.New().NewContext(req, rec)))
+		return rec.Code
+	}
+	assert.Equal(t, 200, revoke(laptop.Token, ""))
+	_, err := validateToken(laptop.Token)
+	assert.True(t, errors.Is(err, errTokenRevoked), "revoked tokens stop working before they expire")
+	reply := sendPacket(t, &pkg.TransferPacket{Command: "download", Meta: map[string]string{"FileID": "f1"},
+		SenderMeta: pkg.SenderMeta{Email: "revoke@gmail.com", Agent: "laptop", Token: laptop.Token}})
+	assert.Contains(t, reply.Meta["Error"], "token was revoked", "revoked tokens are refused over TCP")
+	_, _, err = refreshTokens(laptop.RefreshToken)
+	assert.True(t, errors.Is(err, errInvalidRefreshToken))
+	_, err = validateToken(desktop.Token)
+	assert.Nil(t, err, "other agents stay signed in")
+	assert.Equal(t, 401, revoke(laptop.Token, ""))
+
+	relogin, _ := issueTokens("revoke@gmail.com", "laptop")
+	_, err = validateToken(relogin.Token)
+	assert.Nil(t, err)
+	_, err = validateToken(laptop.Token)
+	assert.NotNil(t, err, "logging in again does not bring back revoked tokens")
+
+	assert.Equal(t, 200, revoke(desktop.Token, "?all=true"))
+	for _, token := range []string{relogin.Token, desktop.Token} {
+		_, err = validateToken(token)
+		assert.True(t, errors.Is(err, errTokenRevoked), "all sessions are revoked")
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/labstack/echo/v4"
+)
+
+const purgeInterval = time.Hour
+
+// trashRetention is how long trashed files are kept, forever when 0
+func trashRetention() time.Duration {
+	return time.Duration(cfg.TrashRetention) * time.Second
+}
+
+// trashFile moves one of the user's files with all its versions to the trash
+func trashFile(email, fileId string, now time.Time) error {
+	file, err := findFile(email, fileId)
+	if err != nil {
+		return err
+	}
+	if file.DeletedAt != "" {
+		return fmt.Errorf("file %s is already in the trash", fileId)
+	}
+	return store.TrashFile(context.Background(), file.ID, now)
+}
+
+// trashedFiles lists the files email has in the trash
+func trashedFiles(email string) ([]db.File, error) {
+	files, err := store.ListFiles(context.Background(), email)
+	if err != nil {
+		return nil, err
+	}
+	trashed := []db.File{}
+	for _, file := range files {
+		if file.DeletedAt != "" {
+			trashed = append(trashed, file)
+		}
+	}
+	return trashed, nil
+}
+
+func listTrash(email string) ([]pkg.TrashedFile, error) {
+	files, err := trashedFiles(email)
+	if err != nil {
+		return nil, err
+	}
+	result := []pkg.TrashedFile{}
+	for _, file := range files {
+		versions, err := store.ListVersions(context.Background(), file.ID)
+		if err != nil {
+			return nil, err
+		}
+		item := pkg.TrashedFile{ID: file.ID, FileName: file.Name, Directory: file.Path, DeletedAt: file.DeletedAt, Versions: len(versions)}
+		for _, version := range versions {
+			item.Size += version.Size
+		}
+		if deletedAt, err := time.Parse(time.RFC3339, file.DeletedAt); err == nil && trashRetention() > 0 {
+			item.PurgeAt = deletedAt.Add(trashRetention()).Format(time.RFC3339)
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+// restoreFile takes one of the user's files out of the trash
+func restoreFile(email, fileId string) error {
+	file, err := findFile(email, fileId)
+	if err != nil {
+		return err
+	}
+	if file.DeletedAt == "" {
+		return fmt.Errorf("file %s is not in the trash", fileId)
+	}
+	return store.RestoreFile(context.Background(), file.ID)
+}
+
+// purgeFile removes a file with its versions for good
+func purgeFile(file db.File) error {
+	versions, err := store.ListVersions(context.Background(), file.ID)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if err := removeVersion(file.Owner, file, version); err != nil {
+			return err
+		}
+	}
+	return store.DeleteFile(context.Background(), file.ID)
+}
+
+// purgeTrash purges the files email trashed before a time, the whole trash when before is zero
+func purgeTrash(email string, before time.Time) (int, error) {
+	files, err := trashedFiles(email)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	var errs []error
+	for _, file := range files {
+		deletedAt, err := time.Parse(time.RFC3339, file.DeletedAt)
+		if !before.IsZero() && err == nil && !deletedAt.Before(before) {
+			continue
+		}
+		if err := purgeFile(file); err != nil {
+			errs = append(errs, fmt.Errorf("file %s: %w", file.ID, err))
+			continue
+		}
+		purged++
+	}
+	return purged, errors.Join(errs...)
+}
+
+// runPurger purges files whose time in the trash ran out on an interval while this server leads
+func runPurger(ctx context.Context) {
+	if trashRetention() <= 0 {
+		return
+	}
+	ticker := time.NewTicker(min(trashRetention(), purgeInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			emails, err := listUserEmails()
+			if err != nil {
+				slog.Error("error listing users to purge", "err", err.Error())
+				continue
+			}
+			for _, email := range emails {
+				purged, err := purgeTrash(email, now.Add(-trashRetention()))
+				if err != nil {
+					slog.Error("error purging trash", "email", email, "err", err.Error())
+				}
+				if purged > 0 {
+					slog.Info("trash purged", "email", email, "files", purged)
+				}
+			}
+		}
+	}
+}
+
+func deleteFileView(c echo.Context) error {
+	email, err := validateToken(c.Request().Header.Get("Authorization"))
+	if err != nil {
+		return c.JSON(401, map[string]interface{}{
+			"message": fmt.Sprintf("invalid token %s", err.Error()),
+		})
+	}
+	if err := trashFile(email, c.Param("id"), time.Now()); err != nil {
+		return c.JSON(404, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(200, map[string]interface{}{"message": "file moved to the trash"})
+}
+
+func trashListView(c echo.Context) error {
+	email, err := validateToken(c.Request().Header.Get("Authorization"))
+	if err != nil {
+		return c.JSON(401, map[string]interface{}{
+			"message": fmt.Sprintf("invalid token %s", err.Error()),
+		})
+	}
+	trash, err := listTrash(email)
+	if err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": "internal server error",
+		})
+	}
+	return c.JSON(200, trash)
+}
+
+func restoreFileView(c echo.Context) error {
+	email, err := validateToken(c.Request().Header.Get("Authorization"))
+	if err != nil {
+		return c.JSON(401, map[string]interface{}{
+			"message": fmt.Sprintf("invalid token %s", err.Error()),
+		})
+	}
+	err = restoreFile(email, c.Param("id"))
+	if errors.Is(err, db.ErrConflict) {
+		return c.JSON(409, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.JSON(404, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(200, map[string]interface{}{"message": "file restored"})
+}
+
+func emptyTrashView(c echo.Context) error {
+	email, err := validateToken(c.Request().Header.Get("Authorization"))
+	if err != nil {
+		return c.JSON(401, map[string]interface{}{
+			"message": fmt.Sprintf("invalid token %s", err.Error()),
+		})
+	}
+	purged, err := purgeTrash(email, time.Time{})
+	if err != nil {
+		return c.JSON(500, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(200, map[string]interface{}{"message": "trash emptied", "purged": purged})
+}
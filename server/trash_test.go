@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrash(t *testing.T) {
+	useMemoryStore(t, pkg.ServerConfig{TrashRetention: 24 * 60 * 60})
+	assert.Nil(t, createUser("trash@gmail.com", "agent", "password"))
+	assert.Nil(t, createUser("other@gmail.com", "agent", "password"))
+	versionId, err := uploadFile(uploadPacket("trash@gmail.com", "home/", ".bashrc"), blobHash(), "sum")
+	assert.Nil(t, err)
+	_, version, _ := findVersion("trash@gmail.com", versionId)
+	fileId := version.FileID
+	deletedAt := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.NotNil(t, trashFile("other@gmail.com", fileId, deletedAt), "only the owner deletes a file")
+	assert.Nil(t, trashFile("trash@gmail.com", fileId, deletedAt))
+	assert.NotNil(t, trashFile("trash@gmail.com", fileId, deletedAt))
+	uploads, _ := getUserUploads("trash@gmail.com", pkg.Tags{})
+	assert.Empty(t, uploads)
+	_, _, err = findFileVersion("trash@gmail.com", fileId, "")
+	assert.NotNil(t, err, "trashed files cannot be downloaded")
+	trash, err := listTrash("trash@gmail.com")
+	assert.Nil(t, err)
+	assert.Len(t, trash, 1)
+	assert.Equal(t, 1, trash[0].Versions)
+	assert.Equal(t, "2024-03-02T12:00:00Z", trash[0].PurgeAt)
+
+	_, err = uploadFile(uploadPacket("trash@gmail.com", "home/", ".bashrc"), blobHash(), "sum")
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(restoreFile("trash@gmail.com", fileId), db.ErrConflict), "a new file took the path")
+	uploads, _ = getUserUploads("trash@gmail.com", pkg.Tags{})
+	assert.Nil(t, trashFile("trash@gmail.com", uploads[0].ID, deletedAt.Add(time.Hour)))
+	assert.Nil(t, restoreFile("trash@gmail.com", fileId))
+	uploads, _ = getUserUploads("trash@gmail.com", pkg.Tags{})
+	assert.Equal(t, fileId, uploads[0].ID)
+
+	purged, err := purgeTrash("trash@gmail.com", deletedAt)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, purged, "files trashed after the cutoff stay")
+	purged, err = purgeTrash("trash@gmail.com", time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, purged)
+	trash, _ = listTrash("trash@gmail.com")
+	assert.Empty(t, trash)
+	usage, _ := userUsage("trash@gmail.com")
+	assert.Equal(t, int64(1), usage.Files)
+}
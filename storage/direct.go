@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/jafari-mohammad-reza/dotsync/pkg"
+	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+)
+
+// verifyTicket makes sure a request carries a ticket a server issued to this storage for the given operation
+func verifyTicket(tr *pkg.TransferPacket, operation string) (*pkg.Ticket, string, error) {
+	ticket, ticketId, err := pkg.VerifyTicket(tr.Meta["Ticket"])
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid ticket: %w", err)
+	}
+	if ticket.Operation != operation || ticket.StorageId != nodeId {
+		return nil, "", errors.New("ticket is not valid for this request")
+	}
+	return ticket, ticketId, nil
+}
+
+// consumeTicket makes sure a verified ticket is used once, remembering it until it expires
+func consumeTicket(signed, ticketId string) error {
+	expiresAt, err := pkg.TokenExpiry(signed)
+	if err != nil {
+		return err
+	}
+	ttl := max(time.Until(expiresAt), time.Second)
+	fresh, err := redisClient.SetNX(context.Background(), "used-ticket:"+ticketId, nodeId, ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return errors.New("ticket was already used")
+	}
+	return nil
+}
+
+func replyToClient(conn net.Conn, meta map[string]string) error {
+	serialized, err := pkg.SerializePacket(&pkg.TransferPacket{Meta: meta})
+	if err != nil {
+		return err
+	}
+	return pkg.SendByteToConn(conn, serialized)
+}
+
+// handleDirectUpload stores a version a client sent without going through the server
+// and tells the servers so they can record this storage as one of its replicas
+func handleDirectUpload(tr *pkg.TransferPacket, conn net.Conn) error {
+	ticket, ticketId, err := verifyTicket(tr, pkg.TicketUpload)
+	if err != nil {
+		replyToClient(conn, map[string]string{"Error": err.Error()})
+		return err
+	}
+	if pkg.Checksum(tr.Compressed) != ticket.Checksum {
+		replyToClient(conn, map[string]string{"Error": "checksum mismatch"})
+		return errors.New("checksum mismatch")
+	}
+	if err := consumeTicket(tr.Meta["Ticket"], ticketId); err != nil {
+		replyToClient(conn, map[string]string{"Error": err.Error()})
+		return err
+	}
+	tr.Token = ""
+	tr.Meta = map[string]string{
+		"UploadPath": ticket.UploadPath,
+		"UploadHash": ticket.Hash,
+		"FileName":   tr.Meta["FileName"],
+		"Dir":        tr.Meta["Dir"],
+	}
+	if err := handleUpload(tr); err != nil {
+		replyToClient(conn, map[string]string{"Error": "could not store upload"})
+		return err
+	}
+	db.Produce(context.Background(), redisClient, "transfer-confirmations", map[string]interface{}{
+		"TicketID":  ticketId,
+		"StorageID": nodeId,
+		"Email":     ticket.Email,
+		"VersionID": ticket.VersionId,
+	})
+	slog.Info("direct upload stored", "version", ticket.VersionId, "ticket", ticketId)
+	return replyToClient(conn, map[string]string{"Status": "stored"})
+}
+
+// handleReplicate stores the copy of a blob a server signed the request for
+func handleReplicate(tr *pkg.TransferPacket) error {
+	ticket, _, err := verifyTicket(tr, pkg.TicketReplicate)
+	if err != nil {
+		slog.Warn("refused upload request", "err", err.Error())
+		return err
+	}
+	if pkg.Checksum(tr.Compressed) != ticket.Checksum {
+		return errors.New("checksum mismatch")
+	}
+	tr.Token = ""
+	tr.Meta = map[string]string{"UploadPath": ticket.UploadPath, "UploadHash": ticket.Hash}
+	return handleUpload(tr)
+}
+
+// handleDecommission stops heartbeats when a server signed the request for this storage
+func handleDecommission(tr *pkg.TransferPacket) error {
+	if _, _, err := verifyTicket(tr, pkg.TicketDecommission); err != nil {
+		slog.Warn("refused decommission request", "err", err.Error())
+		return err
+	}
+	slog.Warn("storage decommissioned by server, stopping heartbeats", "storage", nodeId)
+	decommissioned.Store(true)
+	return nil
+}
+
+// handleDirectDownload sends the blob a ticket names, to clients downloading directly and to servers
+func handleDirectDownload(tr *pkg.TransferPacket, conn net.Conn) error {
+	ticket, _, err := verifyTicket(tr, pkg.TicketDownload)
+	if err != nil {
+		replyToClient(conn, map[string]string{"Error": err.Error()})
+		return err
+	}
+	tr.Meta = map[string]string{"Hash": ticket.Hash, "Path": ticket.UploadPath}
+	return handleDownload(tr, conn)
+}
@@ -7,16 +7,36 @@ import (
 	"math/rand/v2"
 	"os"
 	"path"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jafari-mohammad-reza/dotsync/pkg"
 	"github.com/jafari-mohammad-reza/dotsync/pkg/db"
+	"github.com/redis/go-redis/v9"
+)
+
+// identity of this storage node, set once by InitStorage
+var (
+	nodeId      string
+	redisClient *redis.Client
 )
 
 func InitStorage() error {
+	cfg, err := pkg.GetStorageConfig()
+	if err != nil {
+		slog.Error("Error getting storage config", "err", err.Error())
+		cfg = &pkg.StorageConfig{}
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = 5
+	}
 	id, _ := uuid.NewUUID()
-	redisClient := db.NewRedisClient()
-	port := rand.IntN(9000-8080) + 8080
+	nodeId = id.String()
+	redisClient = db.NewRedisClient(cfg.RedisAddr)
+	port := cfg.Port
+	if port == 0 {
+		port = rand.IntN(9000-8080) + 8080
+	}
 	fmt.Println("Storage port", port)
 	defer func() {
 		if r := recover(); r != nil {
@@ -32,8 +52,8 @@ func InitStorage() error {
 		slog.Error("init storage file system", "err", err.Error())
 	}
 	go pkg.InitTcpListener(port, handleConnection)
-	go connectToService(id.String(), port, redisClient)
-	go healthCheck(id.String(), redisClient)
+	go connectToService(id.String(), port, cfg.Labels, redisClient)
+	go heartbeat(id.String(), port, cfg.Labels, time.Duration(cfg.HeartbeatInterval)*time.Second, redisClient)
 	return nil
 }
 func initFileSystem() error {
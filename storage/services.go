@@ -9,6 +9,8 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"path/filepath"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -17,9 +19,9 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
-func connectToService(storageId string, port int, redisClient *redis.Client) {
-	var storages map[string]pkg.Storage
-	go db.Produce(context.Background(), redisClient, "storage-stream", map[string]interface{}{"ID": storageId, "Port": port})
+func connectToService(storageId string, port int, labels map[string]string, redisClient *redis.Client) {
+	encodedLabels, _ := json.Marshal(labels)
+	go db.Produce(context.Background(), redisClient, "storage-stream", map[string]interface{}{"ID": storageId, "Port": port, "Labels": string(encodedLabels)})
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	go func() {
@@ -31,62 +33,40 @@ func connectToService(storageId string, port int, redisClient *redis.Client) {
 		})
 		os.Exit(0)
 	}()
-	for msg := range db.Subscribe(context.Background(), redisClient, "storage-update") {
-		fmt.Println("new storage subscribd", msg)
-		json.Unmarshal([]byte(msg.Payload), &storages)
-		currentStorage := storages[storageId]
-		if len(storages) > 1 {
-			var previousStorage pkg.Storage
-			for _, storage := range storages {
-				if storage.Index == currentStorage.Index-1 {
-					previousStorage = storage
-					break
-				}
-			}
-			if previousStorage.Index != 0 {
-				// Fetch existing data from previous storage
-				go restoreData(storageId, &previousStorage, "")
-			}
-		}
-	}
 }
-func restoreData(id string, storage *pkg.Storage, startSpan string) {
-	meta := map[string]string{"Storage": id}
-	if startSpan != "" {
-		meta["StartSpan"] = startSpan
-	}
-	tr := pkg.TransferPacket{
-		Command:    "cacheup",
-		Compressed: nil,
-		SenderMeta: pkg.SenderMeta{},
-		Meta:       meta,
-	}
-	packet, _ := pkg.SerializePacket(&tr)
-	conn, err := pkg.SendDataOverTcp(storage.Port, int64(len(packet)), packet)
-	if err != nil {
-		return
-	}
-	if conn != nil {
-		defer conn.Close()
-	}
-	buffer, err := pkg.ReadConnBuffers(conn)
-	if err != nil {
-		return
-	}
-	err = pkg.DecompressBytes(buffer, path.Join("storage", "uploads"))
-	if err != nil {
-		fmt.Println("failed to decompress data:", err.Error())
-		return
-	}
 
-}
-func healthCheck(storageId string, redisClient *redis.Client) {
-	channel := fmt.Sprintf("%s-health", storageId)
-	msg := <-db.Subscribe(context.Background(), redisClient, channel)
-	if msg.Payload == "ping" {
-		db.Publish(context.Background(), redisClient, channel, "pong")
+// decommissioned is set once a server retired this storage
+var decommissioned atomic.Bool
+
+// heartbeat keeps the membership lease of this storage alive on the servers until it is decommissioned
+func heartbeat(storageId string, port int, labels map[string]string, interval time.Duration, redisClient *redis.Client) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for !decommissioned.Load() {
+		beat, _ := json.Marshal(pkg.Heartbeat{
+			Id:        storageId,
+			Port:      port,
+			Status:    "ready",
+			UsedBytes: diskUsage(path.Join("storage", "uploads")),
+			Labels:    labels,
+			SentAt:    time.Now(),
+		})
+		if err := redisClient.Publish(context.Background(), "storage-heartbeat", beat).Err(); err != nil {
+			slog.Error("error sending heartbeat", "err", err.Error())
+		}
+		<-ticker.C
 	}
 }
+func diskUsage(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
 
 func handleConnection(conn net.Conn) error {
 	buf, err := pkg.GetIncomingBuf(conn)
@@ -99,11 +79,63 @@ func handleConnection(conn net.Conn) error {
 	}
 	switch tr.Command {
 	case "upload":
-		return handleUpload(tr)
+		return handleReplicate(tr)
 	case "cacheup":
 		return handleCacheUp(tr, conn)
-	case "download":
-		return handleDownload(tr, conn)
+	case "delete":
+		return handleDelete(tr)
+	case "direct-upload":
+		return handleDirectUpload(tr, conn)
+	case "download", "direct-download":
+		return handleDirectDownload(tr, conn)
+	case "inventory":
+		return handleInventory(tr, conn)
+	case "decommission":
+		return handleDecommission(tr)
+	}
+	return nil
+}
+
+// handleInventory lists every stored blob as its upload path joined with its hash, for servers only
+func handleInventory(tr *pkg.TransferPacket, conn net.Conn) error {
+	if _, _, err := verifyTicket(tr, pkg.TicketInventory); err != nil {
+		replyToClient(conn, map[string]string{"Error": err.Error()})
+		return err
+	}
+	root := path.Join("storage", "uploads")
+	blobs := []string{}
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relPath, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, filepath.ToSlash(relPath))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	data, _ := json.Marshal(blobs)
+	serialized, err := pkg.SerializePacket(&pkg.TransferPacket{Compressed: data, OriginalSize: int64(len(data))})
+	if err != nil {
+		return err
+	}
+	return pkg.SendByteToConn(conn, serialized)
+}
+
+// handleDelete removes the one blob a server signed the request for
+func handleDelete(tr *pkg.TransferPacket) error {
+	ticket, _, err := verifyTicket(tr, pkg.TicketDelete)
+	if err != nil {
+		slog.Warn("refused delete request", "err", err.Error())
+		return err
+	}
+	err = os.Remove(path.Join("storage", "uploads", ticket.UploadPath, ticket.Hash))
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
 	return nil
 }
@@ -244,7 +276,7 @@ func recordTransferLog(tr *pkg.TransferPacket) error {
 			return err
 		}
 	}
-	tr.Compressed = nil
+	tr.Compressed, tr.Token = nil, ""
 	tr.Meta["UploadedIn"] = time.Now().Format(time.DateOnly)
 	data, err := json.Marshal(tr)
 	if err != nil {